@@ -0,0 +1,286 @@
+// Package cloudcontroller looks up the CF metadata of the apps (app, space
+// and org names) in the Cloud Controller v3 API, for the pods which don't
+// carry it. The lookups are authenticated with the UAA client credentials,
+// cached, and limited in concurrency so that starting many tails at once
+// doesn't flood the Cloud Controller.
+package cloudcontroller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+)
+
+var log = logger.Named("cloud-controller")
+
+// ErrAppNotFound is returned for the apps unknown to the Cloud Controller
+var ErrAppNotFound = errors.New("app not found")
+
+// tokenExpiryMargin is how long before its expiry a token is renewed
+const tokenExpiryMargin = 30 * time.Second
+
+// App is the CF metadata of an app
+type App struct {
+	ID, Name                         string
+	SpaceID, SpaceName               string
+	OrganizationID, OrganizationName string
+}
+
+// Client resolves app GUIDs to their App. Lookups of the same app are
+// shared, the results are cached.
+type Client struct {
+	options config.CloudControllerOptions
+	http    *http.Client
+	sem     chan struct{}
+
+	mu      sync.Mutex
+	cache   map[string]cacheEntry
+	pending map[string]*lookup
+
+	tokenMu      sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+type cacheEntry struct {
+	app     App
+	err     error
+	expires time.Time
+}
+
+type lookup struct {
+	done chan struct{}
+	app  App
+	err  error
+}
+
+// NewClient returns the Client of the options, which are expected to be
+// valid. The unset limits get their defaults.
+func NewClient(opts config.CloudControllerOptions) (*Client, error) {
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = config.DefaultCloudControllerCacheTTL
+	}
+	if opts.NegativeCacheTTL == 0 {
+		opts.NegativeCacheTTL = config.DefaultCloudControllerNegativeCacheTTL
+	}
+	if opts.MaxConcurrency == 0 {
+		opts.MaxConcurrency = config.DefaultCloudControllerMaxConcurrency
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = config.DefaultCloudControllerTimeout
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.SkipSSLValidation}
+	if opts.CAPath != "" {
+		ca, err := ioutil.ReadFile(opts.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("cloud-controller ca-path: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("cloud-controller ca-path %q: no certificate found", opts.CAPath)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		options: opts,
+		http:    &http.Client{Transport: transport, Timeout: opts.Timeout},
+		sem:     make(chan struct{}, opts.MaxConcurrency),
+		cache:   map[string]cacheEntry{},
+		pending: map[string]*lookup{},
+	}, nil
+}
+
+// App returns the app of the GUID, from the cache when possible. Failed
+// lookups, including the unknown apps, are cached for the negative cache
+// TTL.
+func (c *Client) App(ctx context.Context, guid string) (App, error) {
+	c.mu.Lock()
+	if e, ok := c.cache[guid]; ok && time.Now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.app, e.err
+	}
+	l, ok := c.pending[guid]
+	if !ok {
+		l = &lookup{done: make(chan struct{})}
+		c.pending[guid] = l
+		go c.resolve(guid, l)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.app, l.err
+	case <-ctx.Done():
+		return App{}, ctx.Err()
+	}
+}
+
+// resolve looks up the app, once a request slot is free, and caches the
+// result. It doesn't depend on the callers' context, as they share it.
+func (c *Client) resolve(guid string, l *lookup) {
+	c.sem <- struct{}{}
+	l.app, l.err = c.fetchApp(guid)
+	<-c.sem
+
+	ttl := c.options.CacheTTL
+	if l.err != nil {
+		log.Warn("Looking up app ", guid, ": ", l.err.Error())
+		ttl = c.options.NegativeCacheTTL
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, e := range c.cache {
+		if !now.Before(e.expires) {
+			delete(c.cache, key)
+		}
+	}
+	c.cache[guid] = cacheEntry{app: l.app, err: l.err, expires: now.Add(ttl)}
+	delete(c.pending, guid)
+	close(l.done)
+}
+
+// appResource is the v3 app, with its space and org included
+type appResource struct {
+	GUID          string `json:"guid"`
+	Name          string `json:"name"`
+	Relationships struct {
+		Space struct {
+			Data struct {
+				GUID string `json:"guid"`
+			} `json:"data"`
+		} `json:"space"`
+	} `json:"relationships"`
+	Included struct {
+		Spaces []struct {
+			GUID          string `json:"guid"`
+			Name          string `json:"name"`
+			Relationships struct {
+				Organization struct {
+					Data struct {
+						GUID string `json:"guid"`
+					} `json:"data"`
+				} `json:"organization"`
+			} `json:"relationships"`
+		} `json:"spaces"`
+		Organizations []struct {
+			GUID string `json:"guid"`
+			Name string `json:"name"`
+		} `json:"organizations"`
+	} `json:"included"`
+}
+
+func (c *Client) fetchApp(guid string) (App, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
+	defer cancel()
+
+	u := strings.TrimSuffix(c.options.URL, "/") + "/v3/apps/" + url.PathEscape(guid) + "?include=space.organization"
+	resp, err := c.get(ctx, u, false)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// The token may have been revoked
+		resp.Body.Close()
+		resp, err = c.get(ctx, u, true)
+	}
+	if err != nil {
+		return App{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return App{}, ErrAppNotFound
+	default:
+		return App{}, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	var resource appResource
+	if err := json.NewDecoder(resp.Body).Decode(&resource); err != nil {
+		return App{}, fmt.Errorf("decoding the app: %s", err.Error())
+	}
+
+	app := App{ID: resource.GUID, Name: resource.Name, SpaceID: resource.Relationships.Space.Data.GUID}
+	for _, space := range resource.Included.Spaces {
+		if space.GUID == app.SpaceID {
+			app.SpaceName = space.Name
+			app.OrganizationID = space.Relationships.Organization.Data.GUID
+		}
+	}
+	for _, org := range resource.Included.Organizations {
+		if org.GUID == app.OrganizationID {
+			app.OrganizationName = org.Name
+		}
+	}
+	return app, nil
+}
+
+func (c *Client) get(ctx context.Context, u string, refreshToken bool) (*http.Response, error) {
+	token, err := c.accessToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	return c.http.Do(req)
+}
+
+// accessToken returns the UAA token, a new one when it is about to expire
+// or when refresh is true
+func (c *Client) accessToken(ctx context.Context, refresh bool) (string, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	if !refresh && c.token != "" && time.Now().Before(c.tokenExpires) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	u := strings.TrimSuffix(c.options.UAAURL, "/") + "/oauth/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.options.ClientID), url.QueryEscape(c.options.ClientSecret))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting a UAA token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("decoding the UAA token: %s", err.Error())
+	}
+	c.token = token.AccessToken
+	c.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	return c.token, nil
+}
@@ -0,0 +1,199 @@
+package cloudcontroller_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/cloudcontroller"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCC stands in for the UAA and the Cloud Controller
+type fakeCC struct {
+	sync.Mutex
+	tokens, lookups   int
+	inFlight, maxSeen int
+	revoked           bool
+	delay             time.Duration
+}
+
+func (f *fakeCC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/oauth/token" {
+		id, secret, _ := r.BasicAuth()
+		if id != "bridge" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.Lock()
+		f.tokens++
+		token := fmt.Sprintf("token-%d", f.tokens)
+		f.Unlock()
+		fmt.Fprintf(w, `{"access_token":%q,"token_type":"bearer","expires_in":3600}`, token)
+		return
+	}
+
+	f.Lock()
+	f.lookups++
+	f.inFlight++
+	if f.inFlight > f.maxSeen {
+		f.maxSeen = f.inFlight
+	}
+	revoked := f.revoked && r.Header.Get("Authorization") == "bearer token-1"
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		f.inFlight--
+		f.Unlock()
+	}()
+	time.Sleep(f.delay)
+
+	guid := strings.TrimPrefix(r.URL.Path, "/v3/apps/")
+	switch {
+	case revoked:
+		w.WriteHeader(http.StatusUnauthorized)
+	case !strings.HasPrefix(r.Header.Get("Authorization"), "bearer token-"):
+		w.WriteHeader(http.StatusUnauthorized)
+	case r.URL.Query().Get("include") != "space.organization":
+		w.WriteHeader(http.StatusBadRequest)
+	case strings.HasPrefix(guid, "missing"):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		fmt.Fprintf(w, `{
+			"guid": %q, "name": "app-name",
+			"relationships": {"space": {"data": {"guid": "space-guid"}}},
+			"included": {
+				"spaces": [{"guid": "space-guid", "name": "dev", "relationships": {"organization": {"data": {"guid": "org-guid"}}}}],
+				"organizations": [{"guid": "org-guid", "name": "acme"}]
+			}
+		}`, guid)
+	}
+}
+
+func (f *fakeCC) counts() (tokens, lookups, maxSeen int) {
+	f.Lock()
+	defer f.Unlock()
+	return f.tokens, f.lookups, f.maxSeen
+}
+
+var _ = Describe("Client", func() {
+	var (
+		cc     *fakeCC
+		server *httptest.Server
+		opts   config.CloudControllerOptions
+	)
+
+	BeforeEach(func() {
+		cc = &fakeCC{}
+		server = httptest.NewServer(cc)
+		opts = config.CloudControllerOptions{URL: server.URL, UAAURL: server.URL, ClientID: "bridge", ClientSecret: "s3cret"}
+	})
+	AfterEach(func() { server.Close() })
+
+	newClient := func() *Client {
+		c, err := NewClient(opts)
+		Expect(err).ToNot(HaveOccurred())
+		return c
+	}
+
+	It("resolves the app, space and org", func() {
+		app, err := newClient().App(context.Background(), "app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app).To(Equal(App{
+			ID: "app-guid", Name: "app-name",
+			SpaceID: "space-guid", SpaceName: "dev",
+			OrganizationID: "org-guid", OrganizationName: "acme",
+		}))
+	})
+
+	It("caches the apps and the token", func() {
+		c := newClient()
+		for i := 0; i < 3; i++ {
+			_, err := c.App(context.Background(), "app-guid")
+			Expect(err).ToNot(HaveOccurred())
+		}
+		_, err := c.App(context.Background(), "other-guid")
+		Expect(err).ToNot(HaveOccurred())
+		tokens, lookups, _ := cc.counts()
+		Expect(tokens).To(Equal(1))
+		Expect(lookups).To(Equal(2))
+	})
+
+	It("looks the apps up again once the cache expired", func() {
+		opts.CacheTTL = 50 * time.Millisecond
+		c := newClient()
+		_, err := c.App(context.Background(), "app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		time.Sleep(100 * time.Millisecond)
+		_, err = c.App(context.Background(), "app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		_, lookups, _ := cc.counts()
+		Expect(lookups).To(Equal(2))
+	})
+
+	It("caches the unknown apps for the negative cache TTL", func() {
+		opts.NegativeCacheTTL = 50 * time.Millisecond
+		c := newClient()
+		for i := 0; i < 3; i++ {
+			_, err := c.App(context.Background(), "missing-guid")
+			Expect(err).To(Equal(ErrAppNotFound))
+		}
+		_, lookups, _ := cc.counts()
+		Expect(lookups).To(Equal(1))
+
+		time.Sleep(100 * time.Millisecond)
+		_, err := c.App(context.Background(), "missing-guid")
+		Expect(err).To(Equal(ErrAppNotFound))
+		_, lookups, _ = cc.counts()
+		Expect(lookups).To(Equal(2))
+	})
+
+	It("limits the concurrent lookups", func() {
+		opts.MaxConcurrency = 2
+		cc.delay = 20 * time.Millisecond
+		c := newClient()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer GinkgoRecover()
+				_, err := c.App(context.Background(), fmt.Sprintf("app-%d", i%3))
+				Expect(err).ToNot(HaveOccurred())
+			}(i)
+		}
+		wg.Wait()
+		_, lookups, maxSeen := cc.counts()
+		Expect(lookups).To(Equal(3))
+		Expect(maxSeen).To(Equal(2))
+	})
+
+	It("gets a new token when the current one is rejected", func() {
+		cc.revoked = true
+		_, err := newClient().App(context.Background(), "app-guid")
+		Expect(err).ToNot(HaveOccurred())
+		tokens, _, _ := cc.counts()
+		Expect(tokens).To(Equal(2))
+	})
+
+	It("fails when the client credentials are rejected", func() {
+		opts.ClientSecret = "wrong"
+		_, err := newClient().App(context.Background(), "app-guid")
+		Expect(err).To(MatchError(ContainSubstring("getting a UAA token: 401")))
+	})
+
+	It("gives up waiting when the context is done", func() {
+		cc.delay = 200 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := newClient().App(ctx, "app-guid")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
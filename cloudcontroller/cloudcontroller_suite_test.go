@@ -0,0 +1,13 @@
+package cloudcontroller_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestCloudController(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cloud Controller test Suite")
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"github.com/spf13/cobra"
+)
+
+// checkConfig runs all the checks done at startup
+func checkConfig(conf configpkg.ConfigType) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	if err := conf.ValidateCertificates(time.Now()); err != nil {
+		return err
+	}
+	if conf.LoggregatorPreflightDial {
+		return podwatcher.DialLoggregator(conf.GetLoggregatorOptions(), podwatcher.DefaultPreflightDialTimeout)
+	}
+	return nil
+}
+
+var validateConfigCmd = &cobra.Command{
+	Use:   "validate-config",
+	Short: "Checks the configuration and exits non-zero if it is invalid",
+	Long: `Runs the checks done at startup on the configuration, including the
+Loggregator certificates (and the connection to Loggregator when
+loggregator-preflight-dial is set).`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkConfig(config); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid configuration:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+	},
+}
+
+var printConfigCmd = &cobra.Command{
+	Use:   "print-config",
+	Short: "Prints the effective configuration and where each value comes from",
+	Long: `Prints the configuration merged from the defaults, the config file, the
+environment variables and the flags, with the source of each value. Secrets
+are redacted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		printConfig(os.Stdout, config)
+	},
+}
+
+func printConfig(out io.Writer, conf configpkg.ConfigType) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, s := range conf.Settings() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, s.Value, settingSource(s.Key))
+	}
+	w.Flush()
+}
+
+// settingSource returns where the value of a setting comes from, following
+// the precedence of viper: flag, env, config file, default
+func settingSource(key string) string {
+	if flag := rootCmd.PersistentFlags().Lookup(key); flag != nil && flag.Changed {
+		return "flag --" + key
+	}
+	if env, ok := envVars[key]; ok {
+		if _, set := os.LookupEnv(env); set {
+			return "env " + env
+		}
+	}
+	if configFile.IsSet(key) {
+		return "file " + cfgFile
+	}
+	return "default"
+}
+
+func init() {
+	rootCmd.AddCommand(validateConfigCmd)
+	rootCmd.AddCommand(printConfigCmd)
+}
@@ -0,0 +1,55 @@
+// grace-wrapper runs the entrypoint of the containers mutated by the
+// eirini-loggregator-bridge webhook, for the images without a shell:
+//
+//	grace-wrapper install DEST
+//	grace-wrapper sleep SECONDS
+//	grace-wrapper [--success-grace SECONDS] [--fail-grace SECONDS] -- COMMAND [ARG...]
+//
+// install copies the wrapper to DEST, from the init container injected by the
+// webhook. sleep waits for SECONDS, for the preStop hooks of the images
+// without a sleep binary. Otherwise COMMAND is run, with the signals forwarded
+// to it, and its exit code is returned once the grace period is over.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/gracewrapper"
+)
+
+func main() {
+	if len(os.Args) == 3 && os.Args[1] == "install" {
+		if err := gracewrapper.Install(os.Args[2]); err != nil {
+			fmt.Fprintf(os.Stderr, "grace-wrapper: installing to %s: %s\n", os.Args[2], err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) == 3 && os.Args[1] == "sleep" {
+		seconds, err := strconv.ParseUint(os.Args[2], 10, 32)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "grace-wrapper: invalid number of seconds %q\n", os.Args[2])
+			os.Exit(2)
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		return
+	}
+
+	flags := flag.NewFlagSet("grace-wrapper", flag.ExitOnError)
+	successGrace := flags.Uint("success-grace", 5, "Seconds to wait for once the command succeeded")
+	failGrace := flags.Uint("fail-grace", 5, "Seconds to wait for once the command failed")
+	_ = flags.Parse(os.Args[1:])
+
+	signals := make(chan os.Signal, 16)
+	signal.Notify(signals)
+
+	os.Exit(gracewrapper.Run(flags.Args(), gracewrapper.Options{
+		SuccessGracePeriod: time.Duration(*successGrace) * time.Second,
+		FailGracePeriod:    time.Duration(*failGrace) * time.Second,
+	}, signals))
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	eirinix "code.cloudfoundry.org/eirinix"
+)
+
+// newManager returns the eirinix manager watching the namespace of conf, with
+// the given extensions added
+func newManager(ctx *context.Context, conf configpkg.ConfigType, extensions ...interface{}) (eirinix.Manager, error) {
+	filter := false
+	registerWebhooks := conf.Register
+	m := eirinix.NewManager(eirinix.ManagerOptions{
+		Namespace:           conf.Namespace,
+		KubeConfig:          conf.KubeConfig,
+		Context:             ctx,
+		OperatorFingerprint: "eirini-loggregator-bridge", // Not really used for now, but setting it up for future
+		FilterEiriniApps:    &filter,
+
+		Host:             conf.OperatorWebhookHost,
+		Port:             conf.OperatorWebhookPort,
+		ServiceName:      conf.OperatorServiceName,
+		WebhookNamespace: conf.OperatorWebhookNamespace,
+		RegisterWebHook:  &registerWebhooks,
+	})
+	for _, e := range extensions {
+		if err := m.AddExtension(e); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// managerRunner runs the eirinix manager until stopped. The manager is bound
+// to the watched namespace, it is replaced when the namespace is reloaded.
+type managerRunner struct {
+	mu      sync.Mutex
+	current eirinix.Manager
+	next    eirinix.Manager
+	stopped bool
+}
+
+// Run starts the current manager, and the next one each time it is replaced.
+// It returns once stopped, with the error of the last manager.
+func (r *managerRunner) Run() error {
+	for {
+		r.mu.Lock()
+		m := r.current
+		r.mu.Unlock()
+
+		err := m.Start()
+
+		r.mu.Lock()
+		if r.stopped || r.next == nil {
+			r.mu.Unlock()
+			return err
+		}
+		r.current, r.next = r.next, nil
+		r.mu.Unlock()
+		if err != nil {
+			LogError("The manager of the previous namespace failed: ", err.Error())
+		}
+	}
+}
+
+// Current returns the manager watching the current namespace, the one
+// replacing the running manager if any
+func (r *managerRunner) Current() eirinix.Manager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next != nil {
+		return r.next
+	}
+	return r.current
+}
+
+// Replace stops the current manager, Run starts next in its place. A
+// replacement still pending is dropped.
+func (r *managerRunner) Replace(next eirinix.Manager) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	if r.next == nil {
+		r.current.Stop()
+	}
+	r.next = next
+}
+
+// Stop stops the current manager, Run then returns
+func (r *managerRunner) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	if r.next == nil {
+		r.current.Stop()
+	}
+}
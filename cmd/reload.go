@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// configReloadDelay is how long to wait after a change of the config file
+// before reloading it, as it is usually not written at once
+const configReloadDelay = time.Second
+
+func graceOptions(conf configpkg.ConfigType) *podwatcher.GraceOptions {
+	return &podwatcher.GraceOptions{
+		FailGracePeriod:    conf.GracefulFailTime,
+		SuccessGracePeriod: conf.GracefulSuccessTime,
+
+		StagingDownloaderEntrypoint: conf.DownloaderEntrypoint,
+		StagingExecutorEntrypoint:   conf.ExecutorEntrypoint,
+		StagingUploaderEntrypoint:   conf.UploaderEntrypoint,
+		RuntimeEntrypoint:           conf.OpiEntrypoint,
+		GraceImageContainsString:    conf.OpiImageContains,
+		Strategies:                  conf.GraceStrategies,
+		WrapperImage:                conf.GraceWrapperImage,
+	}
+}
+
+// watchConfig reloads the config on SIGHUP and when the config file changes,
+// until ctx is done. SIGHUP forces the reload, e.g. to retry one which failed
+// because of the environment or of the certificates.
+func watchConfig(ctx context.Context, reload func(force bool)) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var events chan fsnotify.Event
+	if cfgFile != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			// The directory is watched, as mounted config maps are updated
+			// by swapping symlinks
+			err = watcher.Add(filepath.Dir(cfgFile))
+		}
+		if err != nil {
+			LogWarn("Not watching the config file, reload it with SIGHUP: ", err.Error())
+		} else {
+			defer watcher.Close()
+			events = watcher.Events
+		}
+	}
+
+	timer := time.NewTimer(configReloadDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			reload(true)
+		case <-events:
+			timer.Reset(configReloadDelay)
+		case <-timer.C:
+			reload(false)
+		}
+	}
+}
+
+// configReloader applies the reloadable settings to the running bridge
+type configReloader struct {
+	// manager is the one the bridge started with, it provides the kube
+	// connection whatever the namespace watched
+	manager  eirinix.Manager
+	runner   *managerRunner
+	watcher  *podwatcher.PodWatcher
+	injector *podwatcher.Extension
+	// newManager returns the manager watching the namespace of the config
+	newManager func(conf configpkg.ConfigType) (eirinix.Manager, error)
+}
+
+// reload reads the config file and the environment again. Invalid configs
+// are rejected as a whole, the current one is kept. Unless forced, nothing is
+// done when the config file is the same as the last one applied.
+func (r *configReloader) reload(force bool) {
+	var yamlFile []byte
+	if cfgFile != "" {
+		var err error
+		yamlFile, err = ioutil.ReadFile(cfgFile)
+		if err != nil {
+			LogError("Keeping the current config: ", err.Error())
+			return
+		}
+		if !force && bytes.Equal(yamlFile, configFileContents) {
+			// e.g. another file of the directory changed
+			return
+		}
+
+		viper.SetConfigType("yaml")
+		if err := viper.ReadConfig(bytes.NewBuffer(yamlFile)); err != nil {
+			LogError("Keeping the current config: ", err.Error())
+			return
+		}
+		configFile.ReadConfig(bytes.NewBuffer(yamlFile))
+	}
+
+	var next configpkg.ConfigType
+	if err := viper.Unmarshal(&next); err != nil {
+		LogError("Keeping the current config: ", err.Error())
+		return
+	}
+	reloaded, restart := config.Reload(next)
+	if err := checkConfig(reloaded); err != nil {
+		LogError("Keeping the current config: ", err.Error())
+		return
+	}
+	if len(restart) > 0 {
+		LogWarn("These settings changed but need a restart to apply: ", strings.Join(restart, ", "))
+	}
+
+	if err := r.apply(reloaded); err != nil {
+		LogError("Keeping the current config: ", err.Error())
+		return
+	}
+	// Only once applied, a rejected file is read again on the next change
+	configFileContents = yamlFile
+	LogInfo("Config reloaded")
+}
+
+// apply switches the running bridge to the reloaded config. Everything which
+// can fail is done before changing anything, so that on error the current
+// config is kept as a whole.
+func (r *configReloader) apply(reloaded configpkg.ConfigType) error {
+	// The watch and the webhook of the manager are bound to the namespace, a
+	// new manager takes over from the sync of the new namespace. It is only
+	// started once it replaces the running one.
+	manager := r.manager
+	namespaceChanged := reloaded.Namespace != config.Namespace
+	if namespaceChanged {
+		next, err := r.newManager(reloaded)
+		if err != nil {
+			return err
+		}
+		manager = next
+	}
+	// Last to fail, the running tails reconnect once it succeeds
+	if reloaded.DestinationChanged(config) {
+		if err := podwatcher.UpdateSharedCertWatcher(reloaded.GetLoggregatorOptions()); err != nil {
+			return err
+		}
+	}
+
+	if err := logger.Configure(reloaded.LogLevel, reloaded.LogFormat, os.Stdout); err != nil {
+		// Already validated by checkConfig
+		LogError(err.Error())
+	}
+	r.injector.SetOptions(*graceOptions(reloaded))
+	if err := r.watcher.Reload(manager, reloaded); err != nil {
+		LogError("Syncing the pods with the new namespace or pod-selector failed: ", err.Error())
+	}
+	if namespaceChanged {
+		LogInfo("Watching the namespace ", reloaded.Namespace, " instead of ", config.Namespace)
+		r.runner.Replace(manager)
+	}
+	config = reloaded
+	return nil
+}
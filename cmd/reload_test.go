@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificates writes a self-signed certificate, used as the CA too,
+// and its key to dir
+func writeCertificates(dir string) (caPath, certPath, keyPath string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "metron"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	caPath, certPath, keyPath = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	Expect(ioutil.WriteFile(caPath, cert, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(certPath, cert, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+	return
+}
+
+var _ = Describe("configReloader", func() {
+	var (
+		dir      string
+		previous configpkg.ConfigType
+		current  configpkg.ConfigType
+		running  eirinix.Manager
+		reloader *configReloader
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		Expect(err).ToNot(HaveOccurred())
+		current = configpkg.ConfigType{Namespace: "eirini", LoggregatorEndpoint: "127.0.0.1:1"}
+		current.LoggregatorCAPath, current.LoggregatorCertPath, current.LoggregatorKeyPath = writeCertificates(dir)
+		Expect(podwatcher.UpdateSharedCertWatcher(current.GetLoggregatorOptions())).To(Succeed())
+		_, err = podwatcher.SharedCertWatcher(current.GetLoggregatorOptions())
+		Expect(err).ToNot(HaveOccurred())
+
+		previous, config = config, current
+		running = eirinix.NewManager(eirinix.ManagerOptions{Namespace: "eirini"})
+		reloader = &configReloader{manager: running, runner: &managerRunner{current: running}}
+	})
+
+	AfterEach(func() {
+		config = previous
+		os.RemoveAll(dir)
+	})
+
+	endpoint := func() string {
+		w, err := podwatcher.SharedCertWatcher(current.GetLoggregatorOptions())
+		Expect(err).ToNot(HaveOccurred())
+		return w.Endpoint()
+	}
+
+	It("keeps the Loggregator destination when the manager of the new namespace can't be created", func() {
+		reloader.newManager = func(configpkg.ConfigType) (eirinix.Manager, error) {
+			return nil, errors.New("no manager")
+		}
+		reloaded := current
+		reloaded.Namespace = "other"
+		reloaded.LoggregatorEndpoint = "127.0.0.1:2"
+
+		Expect(reloader.apply(reloaded)).To(MatchError("no manager"))
+		Expect(endpoint()).To(Equal("127.0.0.1:1"))
+		Expect(config).To(Equal(current))
+	})
+
+	It("keeps the running manager when the Loggregator destination can't be switched", func() {
+		reloader.newManager = func(conf configpkg.ConfigType) (eirinix.Manager, error) {
+			return eirinix.NewManager(eirinix.ManagerOptions{Namespace: conf.Namespace}), nil
+		}
+		reloaded := current
+		reloaded.Namespace = "other"
+		reloaded.LoggregatorEndpoint = "127.0.0.1:2"
+		reloaded.LoggregatorCertPath = filepath.Join(dir, "missing.crt")
+
+		Expect(reloader.apply(reloaded)).ToNot(Succeed())
+		Expect(endpoint()).To(Equal("127.0.0.1:1"))
+		Expect(reloader.runner.Current()).To(BeIdenticalTo(running))
+		Expect(config).To(Equal(current))
+	})
+})
@@ -4,130 +4,210 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
-	eirinix "code.cloudfoundry.org/eirinix"
-
+	"code.cloudfoundry.org/eirini-loggregator-bridge/cloudcontroller"
 	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/logger"
 	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
 	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var cfgFile string
-var kubeconfig string
 
 var config configpkg.ConfigType
 
 var rootCmd = &cobra.Command{
 	Use:   "eirini-loggregator-bridge",
 	Short: "eirini-loggregator-bridge streams Eirini application logs to CloudFoundry loggregator",
-	PreRun: func(cmd *cobra.Command, args []string) {
-
-		viper.BindPFlag("operator-webhook-host", cmd.Flags().Lookup("operator-webhook-host"))
-		viper.BindPFlag("operator-webhook-port", cmd.Flags().Lookup("operator-webhook-port"))
-		viper.BindPFlag("operator-service-name", cmd.Flags().Lookup("operator-service-name"))
-		viper.BindPFlag("operator-webhook-namespace", cmd.Flags().Lookup("operator-webhook-namespace"))
-		viper.BindPFlag("register", cmd.Flags().Lookup("register"))
-		viper.BindPFlag("graceful-fail-time", cmd.Flags().Lookup("graceful-fail-time"))
-		viper.BindPFlag("graceful-success-time", cmd.Flags().Lookup("graceful-success-time"))
-		viper.BindPFlag("downloader-entrypoint", cmd.Flags().Lookup("downloader-entrypoint"))
-		viper.BindPFlag("executor-entrypoint", cmd.Flags().Lookup("executor-entrypoint"))
-		viper.BindPFlag("uploader-entrypoint", cmd.Flags().Lookup("uploader-entrypoint"))
-		viper.BindPFlag("opi-entrypoint", cmd.Flags().Lookup("opi-entrypoint"))
-		viper.BindPFlag("opi-image-contains", cmd.Flags().Lookup("opi-image-contains"))
-	},
 	Run: func(cmd *cobra.Command, args []string) {
 		var err error
-		webhookHost := viper.GetString("operator-webhook-host")
-		webhookPort := viper.GetInt32("operator-webhook-port")
-		serviceName := viper.GetString("operator-service-name")
-		webhookNamespace := viper.GetString("operator-webhook-namespace")
-		register := viper.GetBool("register")
-		gracefulFailTime := viper.GetString("graceful-fail-time")
-		gracefulSuccessTime := viper.GetString("graceful-success-time")
-		downloaderEntrypoint := viper.GetString("downloader-entrypoint")
-		executorEntrypoint := viper.GetString("executor-entrypoint")
-		uploaderEntrypoint := viper.GetString("uploader-entrypoint")
-		opiEntrypoint := viper.GetString("opi-entrypoint")
-		opiImageString := viper.GetString("opi-image-contains")
+		if err := logger.Configure(config.LogLevel, config.LogFormat, os.Stdout); err != nil {
+			LogError(err.Error())
+			os.Exit(1)
+		}
+		logger.HandleSignals()
 
 		LogDebug("Namespace: ", config.Namespace)
 		LogDebug("Loggregator-endpoint: ", config.LoggregatorEndpoint)
 		LogDebug("Loggregator-ca-path: ", config.LoggregatorCAPath)
 		LogDebug("Loggregator-cert-path: ", config.LoggregatorCertPath)
 		LogDebug("Loggregator-key-path: ", config.LoggregatorKeyPath)
+		LogDebug("HA mode: ", config.HAMode)
+		LogDebug("Log source: ", config.LogSource, config.NodeName)
+		LogDebug("Metrics listening on: ", config.MetricsAddress)
+		LogDebug("Spool directory: ", config.Spool.Dir)
 
-		LogDebug("Webhook listening on: ", webhookHost, webhookPort)
-		LogDebug("Webhook namespace: ", webhookNamespace)
-		LogDebug("Webhook serviceName: ", serviceName)
-		LogDebug("Webhook register: ", register)
+		LogDebug("Webhook listening on: ", config.OperatorWebhookHost, config.OperatorWebhookPort)
+		LogDebug("Webhook namespace: ", config.OperatorWebhookNamespace)
+		LogDebug("Webhook serviceName: ", config.OperatorServiceName)
+		LogDebug("Webhook register: ", config.Register)
 
 		LogDebug("Starting Loggregator")
-		if webhookHost == "" {
+		if config.OperatorWebhookHost == "" {
 			LogWarn("required flag 'operator-webhook-host' not set (env variable: OPERATOR_WEBHOOK_HOST)")
 		}
 
-		registerWebhooks := true
-		if !register {
+		if !config.Register {
 			LogDebug("The extension will start without registering")
-			registerWebhooks = false
 		}
-		err = config.Validate()
-		if err != nil {
+		if err := checkConfig(config); err != nil {
 			LogError(err.Error())
 			os.Exit(1)
 		}
 
-		filter := false
-		ctx := context.Background()
-		x := eirinix.NewManager(eirinix.ManagerOptions{
-			Namespace:           config.Namespace,
-			KubeConfig:          kubeconfig,
-			Context:             &ctx,
-			OperatorFingerprint: "eirini-loggregator-bridge", // Not really used for now, but setting it up for future
-			FilterEiriniApps:    &filter,
-
-			Host:             webhookHost,
-			Port:             webhookPort,
-			ServiceName:      serviceName,
-			WebhookNamespace: webhookNamespace,
-			RegisterWebHook:  &registerWebhooks,
-		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
 		pw := podwatcher.NewPodWatcher(config)
-		// Setup does need the manager to get kubernetes connection
-		if err := pw.EnsureLogStream(ctx, x); err != nil {
+		injector := podwatcher.NewGracePeriodInjector(graceOptions(config))
+		x, err := newManager(&ctx, config, injector, pw)
+		if err != nil {
 			LogError(err.Error())
 			os.Exit(1)
 		}
+		runner := &managerRunner{current: x}
 
-		if err := x.AddExtension(podwatcher.NewGracePeriodInjector(&podwatcher.GraceOptions{
-			FailGracePeriod:    gracefulFailTime,
-			SuccessGracePeriod: gracefulSuccessTime,
+		// The manager returns once stopped, the bridge then shuts down
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			<-signals
+			LogInfo("Shutting down")
+			runner.Stop()
+		}()
 
-			StagingDownloaderEntrypoint: downloaderEntrypoint,
-			StagingExecutorEntrypoint:   executorEntrypoint,
-			StagingUploaderEntrypoint:   uploaderEntrypoint,
-			RuntimeEntrypoint:           opiEntrypoint,
-			GraceImageContainsString:    opiImageString,
-		})); err != nil {
-			LogError(err.Error())
-			os.Exit(1)
+		if config.HAMode == configpkg.HAModeSharding {
+			shard, err := newShard()
+			if err != nil {
+				LogError(err.Error())
+				os.Exit(1)
+			}
+			LogDebug("Sharding: ", shard.Index, "/", shard.Count)
+			pw.Containers.Shard = shard
 		}
-		if err := x.AddExtension(pw); err != nil {
-			LogError(err.Error())
-			os.Exit(1)
+		if config.CloudController.Enabled() {
+			client, err := cloudcontroller.NewClient(config.CloudController)
+			if err != nil {
+				LogError(err.Error())
+				os.Exit(1)
+			}
+			pw.Containers.CloudController = client
+		}
+
+		if config.LogLevelAddress != "" {
+			go func() {
+				if err := logger.ServeLevel(config.LogLevelAddress); err != nil {
+					LogError("Log level server failed: ", err.Error())
+				}
+			}()
+		}
+
+		if config.LogSource == configpkg.LogSourceNode {
+			positions, err := podwatcher.NewLogPositions(config.PodLogPositionsFile)
+			if err != nil {
+				LogError(err.Error())
+				os.Exit(1)
+			}
+			pw.Containers.Positions = positions
+			go positions.Run(ctx, podwatcher.LogPositionsSaveInterval)
+		}
+
+		if config.HealthAddress != "" {
+			go func() {
+				if err := podwatcher.ServeHealth(config.HealthAddress, pw); err != nil {
+					LogError("Health probe server failed: ", err.Error())
+				}
+			}()
+		}
+
+		if config.MetricsAddress != "" {
+			go func() {
+				if err := metrics.Serve(config.MetricsAddress, map[string]http.Handler{
+					"/healthz": pw.LivenessHandler(),
+					"/readyz":  pw.ReadinessHandler(),
+					"/status":  pw.StatusHandler(),
+				}); err != nil {
+					LogError("Metrics server failed: ", err.Error())
+				}
+			}()
+		}
+
+		// The lease is released on shutdown, once the envelopes are flushed
+		electionCtx, stopElection := context.WithCancel(context.Background())
+		electionDone := make(chan struct{})
+		if config.HAMode == configpkg.HAModeLeaderElection {
+			identity, err := os.Hostname()
+			if err != nil {
+				LogError(err.Error())
+				os.Exit(1)
+			}
+			// The webhook is served by all the replicas, only the leader streams logs
+			go func() {
+				defer close(electionDone)
+				if err := pw.RunLeaderElection(electionCtx, runner.Current, identity); err != nil {
+					LogError(err.Error())
+					os.Exit(1)
+				}
+			}()
+		} else {
+			close(electionDone)
+			if err := pw.EnsureLogStream(ctx, x); err != nil {
+				// Setup does need the manager to get kubernetes connection
+				LogError(err.Error())
+				os.Exit(1)
+			}
+		}
+		go pw.RunResync(ctx, x, config.ResyncInterval)
+
+		reloader := &configReloader{
+			manager: x, runner: runner, watcher: pw, injector: injector,
+			newManager: func(conf configpkg.ConfigType) (eirinix.Manager, error) {
+				return newManager(&ctx, conf, injector, pw)
+			},
 		}
+		go watchConfig(ctx, reloader.reload)
 
-		if err = x.Start(); err != nil {
+		err = runner.Run()
+		if err != nil {
 			LogError(err.Error())
+		}
+
+		// Stop the tails and flush their envelopes, to Loggregator or to the
+		// spool which the next run sends, then give up the lease
+		pw.Shutdown()
+		stopElection()
+		<-electionDone
+		if err != nil {
 			os.Exit(1)
 		}
 	},
 }
 
+// newShard returns the shard of this replica. When shard-index is not set it
+// is taken from the StatefulSet ordinal in the hostname.
+func newShard() (*podwatcher.Shard, error) {
+	index := config.ShardIndex
+	if index < 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		index, err = podwatcher.ShardIndexFromHostname(hostname)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return podwatcher.NewShard(index, config.ShardCount)
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		LogError(err.Error())
@@ -141,7 +221,7 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file")
-	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig file path. This is optional, in cluster config will be used if not set")
+	rootCmd.PersistentFlags().String("kubeconfig", "", "kubeconfig file path. This is optional, in cluster config will be used if not set")
 	rootCmd.PersistentFlags().StringP("operator-webhook-host", "w", "", "Hostname/IP under which the webhook server can be reached from the cluster")
 	rootCmd.PersistentFlags().StringP("operator-webhook-port", "p", "2999", "Port the webhook server listens on")
 	rootCmd.PersistentFlags().StringP("operator-service-name", "s", "", "Service name where the webhook runs on (Optional, only needed inside kube)")
@@ -155,47 +235,126 @@ func init() {
 	rootCmd.PersistentFlags().StringP("uploader-entrypoint", "u", podwatcher.DefaultStagingUploaderEntrypoint, "Eirini staging uploader entrypoint")
 	rootCmd.PersistentFlags().StringP("opi-entrypoint", "o", podwatcher.DefaultRuntimeEntrypoint, "Eirini opi entrypoint")
 	rootCmd.PersistentFlags().StringP("opi-image-contains", "", "", "If defined injects graceperiod only if the opi image is containing the given string")
+	rootCmd.PersistentFlags().StringP("grace-wrapper-image", "", "", "Image shipping the grace-wrapper binary, for the containers using the binary grace strategy and the preStop sleeps")
+}
+
+// envVars are the environment variables of the settings
+var envVars = map[string]string{
+	"namespace":                            "NAMESPACE",
+	"pod-selector":                         "POD_SELECTOR",
+	"loggregator-key-path":                 "LOGGREGATOR_KEY_PATH",
+	"loggregator-endpoint":                 "LOGGREGATOR_ENDPOINT",
+	"loggregator-ca-path":                  "LOGGREGATOR_CA_PATH",
+	"loggregator-cert-path":                "LOGGREGATOR_CERT_PATH",
+	"loggregator-preflight-dial":           "LOGGREGATOR_PREFLIGHT_DIAL",
+	"loggregator-batch-size":               "LOGGREGATOR_BATCH_SIZE",
+	"loggregator-flush-interval":           "LOGGREGATOR_FLUSH_INTERVAL",
+	"loggregator-server-name":              "LOGGREGATOR_SERVER_NAME",
+	"loggregator-min-tls-version":          "LOGGREGATOR_MIN_TLS_VERSION",
+	"loggregator-cipher-suites":            "LOGGREGATOR_CIPHER_SUITES",
+	"operator-webhook-host":                "OPERATOR_WEBHOOK_HOST",
+	"operator-webhook-port":                "OPERATOR_WEBHOOK_PORT",
+	"operator-service-name":                "OPERATOR_SERVICE_NAME",
+	"operator-webhook-namespace":           "OPERATOR_WEBHOOK_NAMESPACE",
+	"register":                             "EIRINI_EXTENSION_REGISTER",
+	"graceful-fail-time":                   "GRACEFUL_FAIL_TIME",
+	"graceful-success-time":                "GRACEFUL_SUCCESS_TIME",
+	"downloader-entrypoint":                "DOWNLOADER_ENTRYPOINT",
+	"executor-entrypoint":                  "EXECUTOR_ENTRYPOINT",
+	"uploader-entrypoint":                  "UPLOADER_ENTRYPOINT",
+	"opi-entrypoint":                       "OPI_ENTRYPOINT",
+	"opi-image-contains":                   "OPI_IMAGE_CONTAINS",
+	"grace-wrapper-image":                  "GRACE_WRAPPER_IMAGE",
+	"ha-mode":                              "HA_MODE",
+	"leader-election-namespace":            "LEADER_ELECTION_NAMESPACE",
+	"leader-election-id":                   "LEADER_ELECTION_ID",
+	"shard-count":                          "SHARD_COUNT",
+	"shard-index":                          "SHARD_INDEX",
+	"log-source":                           "LOG_SOURCE",
+	"node-name":                            "NODE_NAME",
+	"pod-log-dir":                          "POD_LOG_DIR",
+	"pod-log-positions-file":               "POD_LOG_POSITIONS_FILE",
+	"multiline.start-pattern":              "MULTILINE_START_PATTERN",
+	"multiline.continuation-pattern":       "MULTILINE_CONTINUATION_PATTERN",
+	"multiline.max-lines":                  "MULTILINE_MAX_LINES",
+	"multiline.flush-timeout":              "MULTILINE_FLUSH_TIMEOUT",
+	"max-line-size":                        "MAX_LINE_SIZE",
+	"rate-limit.app-lines-per-second":      "RATE_LIMIT_APP_LINES_PER_SECOND",
+	"rate-limit.app-burst":                 "RATE_LIMIT_APP_BURST",
+	"rate-limit.instance-lines-per-second": "RATE_LIMIT_INSTANCE_LINES_PER_SECOND",
+	"rate-limit.instance-burst":            "RATE_LIMIT_INSTANCE_BURST",
+	"rate-limit.report-interval":           "RATE_LIMIT_REPORT_INTERVAL",
+	"metrics-address":                      "METRICS_ADDRESS",
+	"health-address":                       "HEALTH_ADDRESS",
+	"log-level-address":                    "LOG_LEVEL_ADDRESS",
+	"resync-interval":                      "RESYNC_INTERVAL",
+	"liveness-window":                      "LIVENESS_WINDOW",
+	"log-level":                            "EIRINI_LOGGREGATOR_BRIDGE_LOGLEVEL",
+	"log-format":                           "EIRINI_LOGGREGATOR_BRIDGE_LOGFORMAT",
+	"spool.dir":                            "SPOOL_DIR",
+	"spool.max-size":                       "SPOOL_MAX_SIZE",
+	"spool.max-age":                        "SPOOL_MAX_AGE",
+	"backpressure.policy":                  "BACKPRESSURE_POLICY",
+	"backpressure.queue-size":              "BACKPRESSURE_QUEUE_SIZE",
+	"backpressure.senders":                 "BACKPRESSURE_SENDERS",
+	"redaction.namespaces":                 "REDACTION_NAMESPACES",
+	"redaction.builtin":                    "REDACTION_BUILTIN",
+	"redaction.replacement":                "REDACTION_REPLACEMENT",
+	"json-logs.enabled":                    "JSON_LOGS_ENABLED",
+	"json-logs.fields":                     "JSON_LOGS_FIELDS",
+	"json-logs.level-field":                "JSON_LOGS_LEVEL_FIELD",
+	"json-logs.message-field":              "JSON_LOGS_MESSAGE_FIELD",
+	"pod-tags.labels":                      "POD_TAGS_LABELS",
+	"pod-tags.annotations":                 "POD_TAGS_ANNOTATIONS",
+	"pod-tags.max-tags":                    "POD_TAGS_MAX_TAGS",
+	"cloud-controller.url":                 "CLOUD_CONTROLLER_URL",
+	"cloud-controller.uaa-url":             "CLOUD_CONTROLLER_UAA_URL",
+	"cloud-controller.client-id":           "CLOUD_CONTROLLER_CLIENT_ID",
+	"cloud-controller.client-secret":       "CLOUD_CONTROLLER_CLIENT_SECRET",
+	"cloud-controller.ca-path":             "CLOUD_CONTROLLER_CA_PATH",
+	"containers.include":                   "CONTAINERS_INCLUDE",
+	"containers.exclude":                   "CONTAINERS_EXCLUDE",
+}
+
+// flagSettings are the settings which can be given as flags
+var flagSettings = []string{
+	"kubeconfig",
+	"operator-webhook-host",
+	"operator-webhook-port",
+	"operator-service-name",
+	"operator-webhook-namespace",
+	"register",
+	"graceful-fail-time",
+	"graceful-success-time",
+	"downloader-entrypoint",
+	"executor-entrypoint",
+	"uploader-entrypoint",
+	"opi-entrypoint",
+	"opi-image-contains",
+	"grace-wrapper-image",
 }
 
+// configFile holds the settings of the config file alone, to tell where the
+// effective settings come from
+var configFile = viper.New()
+
+// configFileContents is the config file as last applied
+var configFileContents []byte
+
 func initConfig() {
 	// As Viper cannot unmarshal and merge configs from yaml automatically,
 	// define inline there the mapping explictly.
 	// See: https://github.com/spf13/viper/issues/761
-	viper.SetDefault("NAMESPACE", "")
-	viper.SetDefault("LOGGREGATOR_KEY_PATH", "")
-	viper.SetDefault("LOGGREGATOR_ENDPOINT", "")
-	viper.SetDefault("LOGGREGATOR_CA_PATH", "")
-	viper.SetDefault("LOGGREGATOR_CERT_PATH", "")
-	viper.SetDefault("OPERATOR_WEBHOOK_HOST", "")
-	viper.SetDefault("OPERATOR_WEBHOOK_PORT", "")
-	viper.SetDefault("OPERATOR_SERVICE_NAME", "")
-	viper.SetDefault("OPERATOR_WEBHOOK_NAMESPACE", "")
-	viper.SetDefault("EIRINI_EXTENSION_REGISTER", "")
-	viper.SetDefault("GRACEFUL_FAIL_TIME", "")
-	viper.SetDefault("GRACEFUL_SUCCESS_TIME", "")
-	viper.SetDefault("DOWNLOADER_ENTRYPOINT", "")
-	viper.SetDefault("EXECUTOR_ENTRYPOINT", "")
-	viper.SetDefault("UPLOADER_ENTRYPOINT", "")
-	viper.SetDefault("OPI_ENTRYPOINT", "")
-	viper.SetDefault("OPI_IMAGE_CONTAINS", "")
-
-	viper.BindEnv("namespace", "NAMESPACE")
-	viper.BindEnv("loggregator-key-path", "LOGGREGATOR_KEY_PATH")
-	viper.BindEnv("loggregator-endpoint", "LOGGREGATOR_ENDPOINT")
-	viper.BindEnv("loggregator-ca-path", "LOGGREGATOR_CA_PATH")
-	viper.BindEnv("loggregator-cert-path", "LOGGREGATOR_CERT_PATH")
-	viper.BindEnv("operator-webhook-host", "OPERATOR_WEBHOOK_HOST")
-	viper.BindEnv("operator-webhook-port", "OPERATOR_WEBHOOK_PORT")
-	viper.BindEnv("operator-service-name", "OPERATOR_SERVICE_NAME")
-	viper.BindEnv("operator-webhook-namespace", "OPERATOR_WEBHOOK_NAMESPACE")
-	viper.BindEnv("register", "EIRINI_EXTENSION_REGISTER")
-	viper.BindEnv("graceful-fail-time", "GRACEFUL_FAIL_TIME")
-	viper.BindEnv("graceful-success-time", "GRACEFUL_SUCCESS_TIME")
-	viper.BindEnv("downloader-entrypoint", "DOWNLOADER_ENTRYPOINT")
-	viper.BindEnv("executor-entrypoint", "EXECUTOR_ENTRYPOINT")
-	viper.BindEnv("uploader-entrypoint", "UPLOADER_ENTRYPOINT")
-	viper.BindEnv("opi-entrypoint", "OPI_ENTRYPOINT")
-	viper.BindEnv("opi-image-contains", "OPI_IMAGE_CONTAINS")
+	viper.SetDefault("leader-election-id", "eirini-loggregator-bridge")
+	viper.SetDefault("shard-index", -1)
+	viper.SetDefault("health-address", configpkg.DefaultHealthAddress)
+
+	for key, env := range envVars {
+		viper.BindEnv(key, env)
+	}
+	for _, key := range flagSettings {
+		viper.BindPFlag(key, rootCmd.PersistentFlags().Lookup(key))
+	}
 
 	if cfgFile != "" {
 		yamlFile, err := ioutil.ReadFile(cfgFile)
@@ -206,6 +365,9 @@ func initConfig() {
 
 		viper.SetConfigType("yaml")
 		viper.ReadConfig(bytes.NewBuffer(yamlFile))
+		configFile.SetConfigType("yaml")
+		configFile.ReadConfig(bytes.NewBuffer(yamlFile))
+		configFileContents = yamlFile
 	}
 
 	// Now this call will take into account the env as well
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"github.com/spf13/cobra"
+)
+
+var statusAddress string
+var statusJSON bool
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the containers tailed by a running bridge",
+	Long: `Shows the containers tailed by a running bridge, as served by the
+/status endpoint of its metrics-address.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		address := statusAddress
+		if address == "" {
+			address = config.MetricsAddress
+		}
+		if address == "" {
+			return fmt.Errorf("the address of the bridge is missing, set --address or metrics-address")
+		}
+		if !strings.Contains(address, "://") {
+			if strings.HasPrefix(address, ":") {
+				address = "localhost" + address
+			}
+			address = "http://" + address
+		}
+
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(strings.TrimSuffix(address, "/") + "/status")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", resp.Request.URL, resp.Status)
+		}
+
+		if statusJSON {
+			_, err := io.Copy(os.Stdout, resp.Body)
+			return err
+		}
+		var status podwatcher.Status
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return err
+		}
+		printStatus(os.Stdout, status)
+		return nil
+	},
+}
+
+func printStatus(out io.Writer, status podwatcher.Status) {
+	if status.Standby {
+		fmt.Fprintln(out, "The bridge is in standby, another replica streams the logs")
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tCONTAINER\tSOURCE ID\tSTREAM START\tLINES\tBYTES\tLAST LINE\tRESTARTS\tLOGGREGATOR RECONNECTS\tLAST ERROR")
+	for _, c := range status.Containers {
+		sourceID := ""
+		if c.AppMeta != nil {
+			sourceID = c.AppMeta.SourceID
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%d\t%d\t%s\n",
+			c.Namespace, c.PodName, c.Name, sourceID,
+			formatTime(c.StreamStart), c.Lines, c.Bytes, formatTime(c.LastLine),
+			c.Restarts, c.LoggregatorReconnects, c.LastError)
+	}
+	w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func init() {
+	statusCmd.Flags().StringVar(&statusAddress, "address", "", "Address of the bridge status endpoint (default: metrics-address)")
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "Print the raw JSON status")
+	rootCmd.AddCommand(statusCmd)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	podwatcher "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var tailNamespace string
+var tailApp string
+var tailOutput string
+
+var tailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Prints the envelopes the bridge would send for an app",
+	Long: `Follows the logs of the running containers of an app and prints the
+envelopes the bridge would send to Loggregator, with their tags, source and
+instance IDs, instead of sending them.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// The envelopes are printed to stdout, keep the logs out of them
+		if err := logger.Configure(config.LogLevel, config.LogFormat, os.Stderr); err != nil {
+			return err
+		}
+
+		namespace := tailNamespace
+		if namespace == "" {
+			namespace = config.Namespace
+		}
+		if namespace == "" {
+			return fmt.Errorf("the namespace is missing, set --namespace or namespace")
+		}
+		if tailApp == "" {
+			return fmt.Errorf("the app guid is missing, set --app")
+		}
+		printer, err := podwatcher.NewEnvelopePrinter(os.Stdout, tailOutput)
+		if err != nil {
+			return err
+		}
+
+		kubeConfig, err := eirinix.NewManager(eirinix.ManagerOptions{Namespace: namespace, KubeConfig: config.KubeConfig}).GetKubeConnection()
+		if err != nil {
+			return err
+		}
+		kubeClient, err := kubernetes.NewForConfig(kubeConfig)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+			<-signals
+			cancel()
+		}()
+
+		pods, err := kubeClient.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", eirinix.LabelAppGUID, tailApp),
+		})
+		if err != nil {
+			return err
+		}
+
+		var tails sync.WaitGroup
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			for _, c := range podwatcher.ExtractContainersFromPod(pod, config.GetLoggregatorOptions()) {
+				if c.State == nil || c.State.Running == nil {
+					fmt.Fprintf(os.Stderr, "Skipping container %s/%s, it is not running\n", c.PodName, c.Name)
+					continue
+				}
+				l := c.NewLoggregator(ctx, kubeClient, config.GetLoggregatorOptions())
+				l.LoggregatorClient = printer
+
+				tails.Add(1)
+				go func(c *podwatcher.Container) {
+					defer tails.Done()
+					if err := l.Tail(c.Namespace, c.PodName, c.Name); err != nil && ctx.Err() == nil {
+						fmt.Fprintf(os.Stderr, "Tail of %s/%s failed: %s\n", c.PodName, c.Name, err.Error())
+					}
+				}(c)
+			}
+		}
+		tails.Wait()
+		return nil
+	},
+}
+
+func init() {
+	tailCmd.Flags().StringVar(&tailNamespace, "namespace", "", "Namespace of the app pods (default: namespace)")
+	tailCmd.Flags().StringVar(&tailApp, "app", "", "Guid of the app")
+	tailCmd.Flags().StringVar(&tailOutput, "output", podwatcher.PrintFormatText, "Output format: text or json")
+	rootCmd.AddCommand(tailCmd)
+}
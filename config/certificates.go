@@ -0,0 +1,107 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ValidateCertificates loads the Loggregator CA, certificate and key, and
+// checks that the certificates are valid at the given time and that the key
+// matches the certificate.
+func (conf ConfigType) ValidateCertificates(now time.Time) error {
+	if _, err := loadCertificates("loggregator-ca-path", conf.LoggregatorCAPath, now); err != nil {
+		return err
+	}
+
+	certPEM, err := loadCertificates("loggregator-cert-path", conf.LoggregatorCertPath, now)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := ioutil.ReadFile(conf.LoggregatorKeyPath)
+	if err != nil {
+		return fmt.Errorf("loggregator-key-path: %s", err.Error())
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		if strings.Contains(err.Error(), "does not match") {
+			return fmt.Errorf("loggregator-key-path %q doesn't match the certificate in loggregator-cert-path %q", conf.LoggregatorKeyPath, conf.LoggregatorCertPath)
+		}
+		return fmt.Errorf("loggregator-key-path %q: %s", conf.LoggregatorKeyPath, err.Error())
+	}
+	return nil
+}
+
+// loadCertificates reads a PEM file, checking that all its certificates are
+// valid at the given time
+func loadCertificates(option, path string, now time.Time) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", option, err.Error())
+	}
+
+	found := false
+	for rest := content; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		found = true
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: invalid certificate: %s", option, path, err.Error())
+		}
+		if now.Before(cert.NotBefore) {
+			return nil, fmt.Errorf("%s %q: certificate %q is not valid before %s", option, path, cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+		}
+		if now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("%s %q: certificate %q expired on %s", option, path, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s %q: no PEM certificate found", option, path)
+	}
+	return content, nil
+}
+
+// TLSVersion returns the TLS version matching "1.2" or "1.3", zero for an
+// empty version
+func TLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid loggregator-min-tls-version %q (allowed: \"1.2\", \"1.3\")", version)
+}
+
+// CipherSuites returns the IDs of the named cipher suites, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+func CipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid loggregator-cipher-suites: unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,108 @@
+package config_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeSelfSigned writes a self-signed certificate and its key in dir
+func writeSelfSigned(dir, name string, notBefore, notAfter time.Time) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	Expect(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return
+}
+
+var _ = Describe("ValidateCertificates", func() {
+	var (
+		dir    string
+		config configpkg.ConfigType
+		now    time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "certs")
+		Expect(err).ToNot(HaveOccurred())
+		now = time.Now()
+
+		caPath, _ := writeSelfSigned(dir, "ca", now.Add(-time.Hour), now.Add(time.Hour))
+		certPath, keyPath := writeSelfSigned(dir, "metron", now.Add(-time.Hour), now.Add(time.Hour))
+		config = configpkg.ConfigType{
+			LoggregatorCAPath:   caPath,
+			LoggregatorCertPath: certPath,
+			LoggregatorKeyPath:  keyPath,
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("accepts valid certificates", func() {
+		Expect(config.ValidateCertificates(now)).To(Succeed())
+	})
+
+	Context("when a file is missing", func() {
+		It("returns an error", func() {
+			config.LoggregatorCAPath = filepath.Join(dir, "missing")
+			err := config.ValidateCertificates(now)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(HavePrefix("loggregator-ca-path:"))
+		})
+	})
+
+	Context("when the file has no certificate", func() {
+		It("returns an error", func() {
+			config.LoggregatorCertPath = config.LoggregatorKeyPath
+			err := config.ValidateCertificates(now)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("no PEM certificate found"))
+		})
+	})
+
+	Context("when the certificate is expired", func() {
+		It("returns an error", func() {
+			err := config.ValidateCertificates(now.Add(2 * time.Hour))
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(`certificate "ca" expired on`))
+		})
+	})
+
+	Context("when the key doesn't match the certificate", func() {
+		It("returns an error", func() {
+			_, otherKey := writeSelfSigned(dir, "other", now.Add(-time.Hour), now.Add(time.Hour))
+			config.LoggregatorKeyPath = otherKey
+			err := config.ValidateCertificates(now)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("doesn't match the certificate"))
+		})
+	})
+})
@@ -2,18 +2,585 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// HA modes to run multiple bridge replicas without duplicating log lines
+const (
+	// HAModeNone lets every replica tail every container (single replica setup)
+	HAModeNone = ""
+	// HAModeLeaderElection lets only the replica holding the lease tail containers
+	HAModeLeaderElection = "leader-election"
+	// HAModeSharding spreads the containers across replicas by pod UID
+	HAModeSharding = "sharding"
+)
+
+// Sources the container logs can be read from
+const (
+	// LogSourceAPI streams the logs through the API server pods/log endpoint
+	LogSourceAPI = "api"
+	// LogSourceNode reads the CRI log files of the node the bridge runs on
+	LogSourceNode = "node"
+)
+
+// DefaultBatchSize is the number of envelopes sent to Loggregator at once
+const DefaultBatchSize = 100
+
+// The running pods are listed again every DefaultResyncInterval, the bridge
+// is considered wedged when no resync succeeded within DefaultLivenessWindow
+const (
+	DefaultResyncInterval = 5 * time.Minute
+	DefaultLivenessWindow = 3 * DefaultResyncInterval
 )
 
+// DefaultHealthAddress is where the health probes are served
+const DefaultHealthAddress = ":8081"
+
+// DefaultMaxLineSize is the biggest log payload sent in a single envelope,
+// it stays below the envelope size accepted by Loggregator.
+const DefaultMaxLineSize = 60 * 1024
+
+// MinMaxLineSize is the smallest max-line-size, so that the lines are not
+// split in tiny envelopes
+const MinMaxLineSize = 1024
+
+// MaxBatchBytes bounds loggregator-batch-size times max-line-size, a batch
+// has to fit in a 64MiB spool record together with the envelope tags
+const MaxBatchBytes = 60 * 1024 * 1024
+
 type LoggregatorOptions struct {
 	CAPath, CertPath, KeyPath, Endpoint string
+
+	// Ingress client options, see ConfigType
+	BatchSize     int
+	FlushInterval time.Duration
+	ServerName    string
+	MinTLSVersion string
+	CipherSuites  []string
+	Tags          map[string]string
+
+	Multiline   MultilineOptions
+	MaxLineSize int
+	RateLimit   RateLimitOptions
+	Spool       SpoolOptions
+
+	Backpressure BackpressureOptions
+	Redaction    RedactionOptions
+	JSONLogs     JSONLogOptions
+	PodTags      PodTagOptions
+	SourceTypes  []SourceTypeRule
+	Containers   ContainerFilterOptions
+}
+
+// ContainerFilterOptions selects the containers tailed by name, exactly or by
+// prefix when ending with "*". When Include is set, only the containers it
+// matches are tailed. The containers matching Exclude are never tailed.
+type ContainerFilterOptions struct {
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+}
+
+// Selected returns true if the container is to be tailed
+func (c ContainerFilterOptions) Selected(container string) bool {
+	included := len(c.Include) == 0
+	for _, pattern := range c.Include {
+		included = included || MatchKey(pattern, container)
+	}
+	for _, pattern := range c.Exclude {
+		if MatchKey(pattern, container) {
+			return false
+		}
+	}
+	return included
+}
+
+func (c ContainerFilterOptions) Validate() error {
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if !validKeyPattern(pattern) {
+			return fmt.Errorf("invalid containers pattern %q: must be a name or a name prefix followed by *", pattern)
+		}
+	}
+	return nil
+}
+
+// Placeholders of the SourceTypeRule results
+const (
+	SourceTypeProcessType = "{process_type}"
+	SourceTypeTaskName    = "{task_name}"
+	SourceTypeContainer   = "{container}"
+	SourceTypeLabel       = "{source_type}"
+)
+
+// SourceTypeRule maps the containers to the source_type of their envelopes.
+// A rule matches the containers of the pods with the SourceType label (any
+// when empty), named Container (any when empty, by prefix when ending with
+// "*") and, when Init is set, which are init containers or not. Result can
+// hold the placeholders of the process type (upper case), task name,
+// container name and source type label.
+type SourceTypeRule struct {
+	SourceType string `mapstructure:"source-type"`
+	Container  string `mapstructure:"container"`
+	Init       *bool  `mapstructure:"init"`
+	Result     string `mapstructure:"result"`
+}
+
+func (s SourceTypeRule) Validate() error {
+	if s.Result == "" {
+		return errors.New("source-types result can't be empty")
+	}
+	unknown := strings.NewReplacer(SourceTypeProcessType, "", SourceTypeTaskName, "", SourceTypeContainer, "", SourceTypeLabel, "").Replace(s.Result)
+	if strings.ContainsAny(unknown, "{}") {
+		return fmt.Errorf("invalid source-types result %q: unknown placeholder", s.Result)
+	}
+	return nil
+}
+
+// Matches returns true if the rule applies to the container of a pod with
+// the source type label
+func (s SourceTypeRule) Matches(sourceType, container string, init bool) bool {
+	if s.SourceType != "" && s.SourceType != sourceType {
+		return false
+	}
+	if s.Init != nil && *s.Init != init {
+		return false
+	}
+	return s.Container == "" || MatchKey(s.Container, container)
+}
+
+// MatchKey returns true if the key is the pattern, or starts with it when the
+// pattern ends with "*"
+func MatchKey(pattern, key string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == pattern
+}
+
+// validKeyPattern checks that a pattern is a key, or a key prefix followed by
+// "*"
+func validKeyPattern(pattern string) bool {
+	return pattern != "" && pattern != "*" && !strings.Contains(strings.TrimSuffix(pattern, "*"), "*")
+}
+
+// String formats the rule for print-config
+func (s SourceTypeRule) String() string {
+	fields := []string{}
+	if s.SourceType != "" {
+		fields = append(fields, "source-type="+s.SourceType)
+	}
+	if s.Container != "" {
+		fields = append(fields, "container="+s.Container)
+	}
+	if s.Init != nil {
+		fields = append(fields, fmt.Sprintf("init=%t", *s.Init))
+	}
+	return strings.Join(append(fields, "result="+s.Result), " ")
+}
+
+// DefaultSourceTypeRules follow the Diego conventions: staging containers
+// are STG, tasks APP/TASK/<name>, app processes APP/PROC/<type> and the
+// other containers of their pods sidecars. The first matching rule applies.
+var DefaultSourceTypeRules = []SourceTypeRule{
+	{SourceType: "STG", Result: "STG"},
+	{SourceType: "TASK", Result: "APP/TASK/" + SourceTypeTaskName},
+	{SourceType: "APP", Container: "opi", Result: "APP/PROC/" + SourceTypeProcessType},
+	{SourceType: "APP", Init: &initContainer, Result: "APP/PROC/" + SourceTypeProcessType},
+	{SourceType: "APP", Result: "APP/PROC/" + SourceTypeProcessType + "/SIDECAR"},
+}
+
+var initContainer = true
+
+// Defaults of the Cloud Controller lookups
+const (
+	DefaultCloudControllerCacheTTL         = 5 * time.Minute
+	DefaultCloudControllerNegativeCacheTTL = time.Minute
+	DefaultCloudControllerMaxConcurrency   = 4
+	DefaultCloudControllerTimeout          = 10 * time.Second
+)
+
+// CloudControllerOptions configures the lookup of the CF metadata missing
+// from the pods (org, space and app names) in the Cloud Controller v3 API,
+// authenticated with the UAA client credentials. The lookup is enabled when
+// URL is set. The found apps are cached for CacheTTL, the failed lookups for
+// NegativeCacheTTL.
+type CloudControllerOptions struct {
+	URL               string        `mapstructure:"url"`
+	UAAURL            string        `mapstructure:"uaa-url"`
+	ClientID          string        `mapstructure:"client-id"`
+	ClientSecret      string        `mapstructure:"client-secret" secret:"true"`
+	CAPath            string        `mapstructure:"ca-path"`
+	SkipSSLValidation bool          `mapstructure:"skip-ssl-validation"`
+	CacheTTL          time.Duration `mapstructure:"cache-ttl"`
+	NegativeCacheTTL  time.Duration `mapstructure:"negative-cache-ttl"`
+	MaxConcurrency    int           `mapstructure:"max-concurrency"`
+	Timeout           time.Duration `mapstructure:"timeout"`
+}
+
+// Enabled returns true if the Cloud Controller is to be looked up
+func (c CloudControllerOptions) Enabled() bool {
+	return c.URL != ""
+}
+
+func (c CloudControllerOptions) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.UAAURL == "" {
+		return errors.New("cloud-controller uaa-url is required with url")
+	}
+	if c.ClientID == "" {
+		return errors.New("cloud-controller client-id is required with url")
+	}
+	if c.CacheTTL < 0 || c.NegativeCacheTTL < 0 || c.Timeout < 0 {
+		return errors.New("cloud-controller durations can't be negative")
+	}
+	if c.MaxConcurrency < 0 {
+		return errors.New("cloud-controller max-concurrency can't be negative")
+	}
+	return nil
+}
+
+// DefaultMaxPodTags is the default limit of the tags copied from the pod
+// labels and annotations
+const DefaultMaxPodTags = 10
+
+// PodTagOptions selects the pod labels and annotations copied into the
+// envelope tags, by exact key or by prefix when the key ends with "*". At most
+// MaxTags of them are copied, in the order of their keys, labels first.
+type PodTagOptions struct {
+	Labels      []string `mapstructure:"labels"`
+	Annotations []string `mapstructure:"annotations"`
+	MaxTags     int      `mapstructure:"max-tags"`
+}
+
+func (p PodTagOptions) Validate() error {
+	for _, key := range append(append([]string{}, p.Labels...), p.Annotations...) {
+		if !validKeyPattern(key) {
+			return fmt.Errorf("invalid pod-tags key %q: must be a key or a key prefix followed by *", key)
+		}
+	}
+	if p.MaxTags < 0 {
+		return errors.New("pod-tags max-tags can't be negative")
+	}
+	return nil
+}
+
+// Defaults of the JSON log parsing
+var (
+	DefaultJSONLogFields     = []string{"level", "logger", "request_id"}
+	DefaultJSONLogLevelField = "level"
+)
+
+// JSONLogOptions configures the parsing of the log lines which are JSON
+// objects. Fields are promoted to envelope tags, the line is sent as an error
+// when LevelField is error or above, and the payload is replaced with the
+// MessageField, when set and found. Parsing is enabled for all the apps with
+// Enabled, or per app with an annotation.
+type JSONLogOptions struct {
+	Enabled      bool     `mapstructure:"enabled"`
+	Fields       []string `mapstructure:"fields"`
+	LevelField   string   `mapstructure:"level-field"`
+	MessageField string   `mapstructure:"message-field"`
+}
+
+func (j JSONLogOptions) Validate() error {
+	for _, field := range j.Fields {
+		if field == "" {
+			return errors.New("json-logs fields can't be empty")
+		}
+	}
+	return nil
+}
+
+// Bundled redaction patterns
+const (
+	RedactBearerTokens = "bearer-tokens"
+	RedactAWSKeys      = "aws-keys"
+	RedactEmails       = "emails"
+)
+
+// DefaultRedactionReplacement replaces the redacted text
+const DefaultRedactionReplacement = "[REDACTED]"
+
+// RedactionOptions configures the redaction of the secrets found in the log
+// lines of the apps of the given namespaces ("*" for all of them). The
+// bundled patterns (all of them when Builtin is empty) are applied together
+// with the operator supplied Patterns.
+type RedactionOptions struct {
+	Namespaces  []string `mapstructure:"namespaces"`
+	Builtin     []string `mapstructure:"builtin"`
+	Patterns    []string `mapstructure:"patterns"`
+	Replacement string   `mapstructure:"replacement"`
+}
+
+// Enabled returns true if the log lines of the namespace are redacted
+func (r RedactionOptions) Enabled(namespace string) bool {
+	for _, ns := range r.Namespaces {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RedactionOptions) Validate() error {
+	for _, name := range r.Builtin {
+		switch name {
+		case RedactBearerTokens, RedactAWSKeys, RedactEmails:
+		default:
+			return fmt.Errorf("invalid redaction builtin %q (allowed: %q, %q, %q)", name, RedactBearerTokens, RedactAWSKeys, RedactEmails)
+		}
+	}
+	for _, pattern := range r.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid redaction pattern %q: %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// Overflow policies applied when the envelope queue of a container is full
+const (
+	// OverflowBlock blocks the tail, the logs are buffered by kubelet
+	OverflowBlock = "block"
+	// OverflowDropOldest drops the oldest queued envelope
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest drops the envelope which doesn't fit in the queue
+	OverflowDropNewest = "drop-newest"
+)
+
+// Defaults of the envelope queues and sender pool
+const (
+	DefaultQueueSize = 1000
+	DefaultSenders   = 4
+)
+
+// BackpressureOptions configures the bounded envelope queue of every
+// container and the pool of senders draining them
+type BackpressureOptions struct {
+	Policy    string `mapstructure:"policy"`
+	QueueSize int    `mapstructure:"queue-size"`
+	Senders   int    `mapstructure:"senders"`
+}
+
+func (b BackpressureOptions) Validate() error {
+	switch b.Policy {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		return fmt.Errorf("invalid backpressure policy %q (allowed: %q, %q, %q)", b.Policy, OverflowBlock, OverflowDropOldest, OverflowDropNewest)
+	}
+	if b.QueueSize < 0 {
+		return errors.New("backpressure queue-size can't be negative")
+	}
+	if b.Senders < 0 {
+		return errors.New("backpressure senders can't be negative")
+	}
+	return nil
+}
+
+// Limits of the spool when they are not configured
+const (
+	DefaultSpoolMaxSize = 100 * 1024 * 1024
+	DefaultSpoolMaxAge  = 24 * time.Hour
+)
+
+// SpoolOptions configures the on-disk spool where envelopes are written while
+// Loggregator is unreachable. The spool is enabled when Dir is set. Once the
+// spool exceeds MaxSize bytes or its envelopes MaxAge, the oldest envelopes
+// are dropped.
+type SpoolOptions struct {
+	Dir     string        `mapstructure:"dir"`
+	MaxSize int64         `mapstructure:"max-size"`
+	MaxAge  time.Duration `mapstructure:"max-age"`
+}
+
+// Enabled returns true if envelopes are spooled
+func (s SpoolOptions) Enabled() bool {
+	return s.Dir != ""
+}
+
+func (s SpoolOptions) Validate() error {
+	if s.MaxSize < 0 {
+		return errors.New("spool max-size can't be negative")
+	}
+	if s.MaxAge < 0 {
+		return errors.New("spool max-age can't be negative")
+	}
+	return nil
+}
+
+// DefaultRateLimitReportInterval is how often the number of log lines dropped
+// by the rate limiting is reported in the app stream
+const DefaultRateLimitReportInterval = 5 * time.Second
+
+// RateLimitOptions configures the token buckets limiting the log lines sent
+// per app (SourceID) and per app instance. A zero rate means no limit, a zero
+// burst defaults to the rate.
+type RateLimitOptions struct {
+	AppLinesPerSecond      float64       `mapstructure:"app-lines-per-second"`
+	AppBurst               int           `mapstructure:"app-burst"`
+	InstanceLinesPerSecond float64       `mapstructure:"instance-lines-per-second"`
+	InstanceBurst          int           `mapstructure:"instance-burst"`
+	ReportInterval         time.Duration `mapstructure:"report-interval"`
+}
+
+// Enabled returns true if any rate limit is set
+func (r RateLimitOptions) Enabled() bool {
+	return r.AppLinesPerSecond > 0 || r.InstanceLinesPerSecond > 0
+}
+
+func (r RateLimitOptions) Validate() error {
+	if r.AppLinesPerSecond < 0 || r.InstanceLinesPerSecond < 0 {
+		return errors.New("rate-limit lines per second can't be negative")
+	}
+	if r.AppBurst < 0 || r.InstanceBurst < 0 {
+		return errors.New("rate-limit burst can't be negative")
+	}
+	if r.ReportInterval < 0 {
+		return errors.New("rate-limit report-interval can't be negative")
+	}
+	return nil
+}
+
+// MultilineOptions configures how consecutive log lines are aggregated into
+// a single envelope (e.g. stack traces). Aggregation is enabled when at least
+// one of the patterns is set: a line belongs to the previous one if it matches
+// ContinuationPattern, or if it doesn't match StartPattern.
+type MultilineOptions struct {
+	StartPattern        string        `mapstructure:"start-pattern"`
+	ContinuationPattern string        `mapstructure:"continuation-pattern"`
+	MaxLines            int           `mapstructure:"max-lines"`
+	FlushTimeout        time.Duration `mapstructure:"flush-timeout"`
+}
+
+// Enabled returns true if lines have to be aggregated
+func (m MultilineOptions) Enabled() bool {
+	return m.StartPattern != "" || m.ContinuationPattern != ""
+}
+
+func (m MultilineOptions) Validate() error {
+	if _, err := regexp.Compile(m.StartPattern); err != nil {
+		return fmt.Errorf("invalid multiline start-pattern: %s", err.Error())
+	}
+	if _, err := regexp.Compile(m.ContinuationPattern); err != nil {
+		return fmt.Errorf("invalid multiline continuation-pattern: %s", err.Error())
+	}
+	if m.MaxLines < 0 {
+		return errors.New("multiline max-lines can't be negative")
+	}
+	if m.FlushTimeout < 0 {
+		return errors.New("multiline flush-timeout can't be negative")
+	}
+	return nil
 }
 
 type ConfigType struct {
-	Namespace           string `mapstructure:"namespace"`
+	Namespace string `mapstructure:"namespace"`
+	// PodSelector is a label selector restricting the tailed pods of the
+	// namespace (e.g. "cloudfoundry.org/source_type=APP")
+	PodSelector string `mapstructure:"pod-selector"`
+
 	LoggregatorEndpoint string `mapstructure:"loggregator-endpoint"`
 	LoggregatorCAPath   string `mapstructure:"loggregator-ca-path"`
 	LoggregatorCertPath string `mapstructure:"loggregator-cert-path"`
 	LoggregatorKeyPath  string `mapstructure:"loggregator-key-path"`
+	// LoggregatorPreflightDial makes the bridge check at startup that the
+	// endpoint accepts a TLS handshake with the certificates
+	LoggregatorPreflightDial bool `mapstructure:"loggregator-preflight-dial"`
+
+	// LoggregatorBatchSize and LoggregatorFlushInterval control how often
+	// envelopes are sent
+	LoggregatorBatchSize     int           `mapstructure:"loggregator-batch-size"`
+	LoggregatorFlushInterval time.Duration `mapstructure:"loggregator-flush-interval"`
+	// LoggregatorServerName overrides the name expected in the Loggregator
+	// certificate (default "metron")
+	LoggregatorServerName    string   `mapstructure:"loggregator-server-name"`
+	LoggregatorMinTLSVersion string   `mapstructure:"loggregator-min-tls-version"`
+	LoggregatorCipherSuites  []string `mapstructure:"loggregator-cipher-suites"`
+	// LoggregatorTags are added to every envelope
+	LoggregatorTags map[string]string `mapstructure:"loggregator-tags"`
+
+	HAMode                  string `mapstructure:"ha-mode"`
+	LeaderElectionNamespace string `mapstructure:"leader-election-namespace"`
+	LeaderElectionID        string `mapstructure:"leader-election-id"`
+	ShardCount              int    `mapstructure:"shard-count"`
+	ShardIndex              int    `mapstructure:"shard-index"`
+
+	LogSource string `mapstructure:"log-source"`
+	NodeName  string `mapstructure:"node-name"`
+	PodLogDir string `mapstructure:"pod-log-dir"`
+	// PodLogPositionsFile is where the node mode saves how far the log files
+	// are read, to resume from there after a restart
+	PodLogPositionsFile string `mapstructure:"pod-log-positions-file"`
+
+	Multiline   MultilineOptions `mapstructure:"multiline"`
+	MaxLineSize int              `mapstructure:"max-line-size"`
+	RateLimit   RateLimitOptions `mapstructure:"rate-limit"`
+	Spool       SpoolOptions     `mapstructure:"spool"`
+
+	Backpressure BackpressureOptions    `mapstructure:"backpressure"`
+	Redaction    RedactionOptions       `mapstructure:"redaction"`
+	JSONLogs     JSONLogOptions         `mapstructure:"json-logs"`
+	PodTags      PodTagOptions          `mapstructure:"pod-tags"`
+	SourceTypes  []SourceTypeRule       `mapstructure:"source-types"`
+	Containers   ContainerFilterOptions `mapstructure:"containers"`
+
+	CloudController CloudControllerOptions `mapstructure:"cloud-controller"`
+
+	// MetricsAddress also serves the /healthz and /readyz probes, which are
+	// always served on HealthAddress
+	MetricsAddress string `mapstructure:"metrics-address"`
+	HealthAddress  string `mapstructure:"health-address"`
+	// LogLevelAddress, when set, serves the /log-level endpoint changing the
+	// log level. It has no authentication, so only loopback addresses are
+	// allowed.
+	LogLevelAddress string `mapstructure:"log-level-address"`
+
+	// ResyncInterval is how often the running pods are listed again,
+	// LivenessWindow how long the bridge can go without a successful resync
+	// before failing the liveness probe
+	ResyncInterval time.Duration `mapstructure:"resync-interval"`
+	LivenessWindow time.Duration `mapstructure:"liveness-window"`
+
+	// LogLevel (DEBUG, INFO, WARN, ERROR) and LogFormat (console, json) of
+	// the bridge own logs
+	LogLevel  string `mapstructure:"log-level"`
+	LogFormat string `mapstructure:"log-format"`
+
+	// KubeConfig is the kubeconfig file, the in cluster config is used when
+	// it is not set
+	KubeConfig string `mapstructure:"kubeconfig"`
+
+	// Webhook injecting the grace periods in the Eirini pods
+	OperatorWebhookHost      string `mapstructure:"operator-webhook-host"`
+	OperatorWebhookPort      int32  `mapstructure:"operator-webhook-port"`
+	OperatorServiceName      string `mapstructure:"operator-service-name"`
+	OperatorWebhookNamespace string `mapstructure:"operator-webhook-namespace"`
+	Register                 bool   `mapstructure:"register"`
+
+	// Grace periods (in seconds) and entrypoints of the mutated containers,
+	// empty values keep the defaults
+	GracefulFailTime     string `mapstructure:"graceful-fail-time"`
+	GracefulSuccessTime  string `mapstructure:"graceful-success-time"`
+	DownloaderEntrypoint string `mapstructure:"downloader-entrypoint"`
+	ExecutorEntrypoint   string `mapstructure:"executor-entrypoint"`
+	UploaderEntrypoint   string `mapstructure:"uploader-entrypoint"`
+	OpiEntrypoint        string `mapstructure:"opi-entrypoint"`
+	OpiImageContains     string `mapstructure:"opi-image-contains"`
+	// GraceStrategies maps the mutated containers to how the grace period
+	// is injected, the wrapper by default. A preStop hook only runs when
+	// kubelet stops the container, not when it exits by itself, so the
+	// containers using it never get graceful-fail-time.
+	GraceStrategies map[string]string `mapstructure:"grace-strategies"`
+	// GraceWrapperImage is the image shipping the grace-wrapper binary, for
+	// the containers using the binary strategy and the preStop sleeps
+	GraceWrapperImage string `mapstructure:"grace-wrapper-image"`
 }
 
 func (conf ConfigType) GetLoggregatorOptions() LoggregatorOptions {
@@ -22,6 +589,25 @@ func (conf ConfigType) GetLoggregatorOptions() LoggregatorOptions {
 		CertPath: conf.LoggregatorCertPath,
 		KeyPath:  conf.LoggregatorKeyPath,
 		Endpoint: conf.LoggregatorEndpoint,
+
+		BatchSize:     conf.LoggregatorBatchSize,
+		FlushInterval: conf.LoggregatorFlushInterval,
+		ServerName:    conf.LoggregatorServerName,
+		MinTLSVersion: conf.LoggregatorMinTLSVersion,
+		CipherSuites:  conf.LoggregatorCipherSuites,
+		Tags:          conf.LoggregatorTags,
+
+		Multiline:   conf.Multiline,
+		MaxLineSize: conf.MaxLineSize,
+		RateLimit:   conf.RateLimit,
+		Spool:       conf.Spool,
+
+		Backpressure: conf.Backpressure,
+		Redaction:    conf.Redaction,
+		JSONLogs:     conf.JSONLogs,
+		PodTags:      conf.PodTags,
+		SourceTypes:  conf.SourceTypes,
+		Containers:   conf.Containers,
 	}
 }
 
@@ -41,5 +627,235 @@ func (conf ConfigType) Validate() error {
 	if conf.LoggregatorKeyPath == "" {
 		return errors.New("loggregator-key-path is missing from configuration")
 	}
+	if _, err := conf.Selector(); err != nil {
+		return err
+	}
+	if err := conf.validateIngress(); err != nil {
+		return err
+	}
+	if err := validateLoopbackAddress("log-level-address", conf.LogLevelAddress); err != nil {
+		return err
+	}
+	if conf.MaxLineSize != 0 && (conf.MaxLineSize < MinMaxLineSize || conf.MaxLineSize > DefaultMaxLineSize) {
+		return fmt.Errorf("max-line-size must be 0 (default) or between %d and %d", MinMaxLineSize, DefaultMaxLineSize)
+	}
+	if err := conf.validateBatchSize(); err != nil {
+		return err
+	}
+	if err := conf.Multiline.Validate(); err != nil {
+		return err
+	}
+	if err := conf.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Spool.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Backpressure.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Redaction.Validate(); err != nil {
+		return err
+	}
+	if err := conf.JSONLogs.Validate(); err != nil {
+		return err
+	}
+	if err := conf.PodTags.Validate(); err != nil {
+		return err
+	}
+	if err := conf.Containers.Validate(); err != nil {
+		return err
+	}
+	for _, rule := range conf.SourceTypes {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := conf.CloudController.Validate(); err != nil {
+		return err
+	}
+	if err := conf.validateHealth(); err != nil {
+		return err
+	}
+	if err := conf.validateWebhook(); err != nil {
+		return err
+	}
+	if err := conf.validateLogSource(); err != nil {
+		return err
+	}
+	return conf.validateHA()
+}
+
+func (conf ConfigType) validateHealth() error {
+	if conf.ResyncInterval < 0 {
+		return errors.New("resync-interval can't be negative")
+	}
+	if conf.LivenessWindow < 0 {
+		return errors.New("liveness-window can't be negative")
+	}
+	interval, window := conf.ResyncInterval, conf.LivenessWindow
+	if interval == 0 {
+		interval = DefaultResyncInterval
+	}
+	if window == 0 {
+		window = DefaultLivenessWindow
+	}
+	if window < interval {
+		return fmt.Errorf("liveness-window %s must not be shorter than resync-interval %s", window, interval)
+	}
+	return nil
+}
+
+// Selector returns the parsed PodSelector, it selects every pod when no
+// selector is set
+func (conf ConfigType) Selector() (labels.Selector, error) {
+	selector, err := labels.Parse(conf.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod-selector %q: %s", conf.PodSelector, err.Error())
+	}
+	return selector, nil
+}
+
+func (conf ConfigType) validateBatchSize() error {
+	maxLineSize := conf.MaxLineSize
+	if maxLineSize == 0 {
+		maxLineSize = DefaultMaxLineSize
+	}
+	if conf.LoggregatorBatchSize > MaxBatchBytes/maxLineSize {
+		return fmt.Errorf("loggregator-batch-size must be at most %d with a max-line-size of %d", MaxBatchBytes/maxLineSize, maxLineSize)
+	}
+	return nil
+}
+
+func (conf ConfigType) validateIngress() error {
+	if conf.LoggregatorBatchSize < 0 {
+		return errors.New("loggregator-batch-size can't be negative")
+	}
+	if conf.LoggregatorFlushInterval < 0 {
+		return errors.New("loggregator-flush-interval can't be negative")
+	}
+	if _, err := TLSVersion(conf.LoggregatorMinTLSVersion); err != nil {
+		return err
+	}
+	_, err := CipherSuites(conf.LoggregatorCipherSuites)
+	return err
+}
+
+// Containers mutated by the webhook
+const (
+	GraceContainerDownloader = "opi-task-downloader"
+	GraceContainerExecutor   = "opi-task-executor"
+	GraceContainerUploader   = "opi-task-uploader"
+	GraceContainerRuntime    = "opi"
+)
+
+// Grace strategies of the webhook: the wrapper runs the entrypoint through a
+// shell waiting for the grace period once it exits, the preStop hook delays
+// the termination of the regular containers without changing their command,
+// the binary runs the entrypoint through the grace-wrapper binary copied into
+// the pod, for the images without a shell
+const (
+	GraceStrategyWrapper = "wrapper"
+	GraceStrategyPreStop = "prestop"
+	GraceStrategyBinary  = "binary"
+)
+
+// graceInitContainers are the mutated init containers, which don't run the
+// preStop hooks
+var graceInitContainers = map[string]bool{
+	GraceContainerDownloader: true,
+	GraceContainerExecutor:   true,
+	GraceContainerUploader:   false,
+	GraceContainerRuntime:    false,
+}
+
+// validateLoopbackAddress checks that the address, when set, listens on the
+// loopback interface only
+func validateLoopbackAddress(key, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err.Error())
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s must be a loopback address (e.g. 127.0.0.1:9091), got %q", key, addr)
+	}
+	return nil
+}
+
+// gracePeriodRegexp matches the grace periods, which are given to sleep in the
+// mutated containers
+var gracePeriodRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+func (conf ConfigType) validateWebhook() error {
+	if conf.OperatorWebhookPort < 0 || conf.OperatorWebhookPort > 65535 {
+		return fmt.Errorf("operator-webhook-port %d is out of range", conf.OperatorWebhookPort)
+	}
+	for key, period := range map[string]string{
+		"graceful-fail-time":    conf.GracefulFailTime,
+		"graceful-success-time": conf.GracefulSuccessTime,
+	} {
+		if period != "" && !gracePeriodRegexp.MatchString(period) {
+			return fmt.Errorf("%s must be a number of seconds, got %q", key, period)
+		}
+	}
+	for container, strategy := range conf.GraceStrategies {
+		init, ok := graceInitContainers[container]
+		if !ok {
+			return fmt.Errorf("grace-strategies: unknown container %q", container)
+		}
+		switch strategy {
+		case GraceStrategyWrapper:
+		case GraceStrategyPreStop:
+			if init {
+				return fmt.Errorf("grace-strategies: %s is an init container, it can't use %q", container, strategy)
+			}
+		case GraceStrategyBinary:
+			if conf.GraceWrapperImage == "" {
+				return fmt.Errorf("grace-strategies: %s uses %q, grace-wrapper-image must be set", container, strategy)
+			}
+		default:
+			return fmt.Errorf("grace-strategies: invalid strategy %q for %s (allowed: %q, %q, %q)", strategy, container, GraceStrategyWrapper, GraceStrategyPreStop, GraceStrategyBinary)
+		}
+	}
+	return nil
+}
+
+func (conf ConfigType) validateLogSource() error {
+	switch conf.LogSource {
+	case "", LogSourceAPI:
+	case LogSourceNode:
+		if conf.NodeName == "" {
+			return errors.New("node-name is missing from configuration")
+		}
+		if conf.HAMode != HAModeNone {
+			return errors.New("ha-mode is not supported with the node log-source, every node runs its own bridge")
+		}
+	default:
+		return fmt.Errorf("invalid log-source %q (allowed: %q, %q)", conf.LogSource, LogSourceAPI, LogSourceNode)
+	}
+	return nil
+}
+
+func (conf ConfigType) validateHA() error {
+	switch conf.HAMode {
+	case HAModeNone:
+	case HAModeLeaderElection:
+		if conf.LeaderElectionID == "" {
+			return errors.New("leader-election-id is missing from configuration")
+		}
+	case HAModeSharding:
+		if conf.ShardCount < 1 {
+			return errors.New("shard-count must be at least 1 in sharding mode")
+		}
+		// A negative index is resolved at runtime from the StatefulSet hostname
+		if conf.ShardIndex >= conf.ShardCount {
+			return fmt.Errorf("shard-index %d is out of range for shard-count %d", conf.ShardIndex, conf.ShardCount)
+		}
+	default:
+		return fmt.Errorf("invalid ha-mode %q (allowed: %q, %q)", conf.HAMode, HAModeLeaderElection, HAModeSharding)
+	}
 	return nil
 }
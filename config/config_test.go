@@ -1,6 +1,8 @@
 package config_test
 
 import (
+	"time"
+
 	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -74,5 +76,346 @@ var _ = Describe("Config", func() {
 				Expect(err.Error()).Should(Equal("loggregator-key-path is missing from configuration"))
 			})
 		})
+		Context("when ha-mode is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.HAMode = "active-active"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid ha-mode"))
+			})
+		})
+		Context("when leader-election-id is missing in leader-election mode", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.HAMode = configpkg.HAModeLeaderElection
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("leader-election-id is missing from configuration"))
+			})
+		})
+		Context("when shard-index is out of range in sharding mode", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.HAMode = configpkg.HAModeSharding
+				config.ShardCount = 2
+				config.ShardIndex = 2
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("shard-index 2 is out of range for shard-count 2"))
+			})
+		})
+		Context("when shard-index is taken from the hostname in sharding mode", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.HAMode = configpkg.HAModeSharding
+				config.ShardCount = 2
+				config.ShardIndex = -1
+			})
+			It("succeeds", func() {
+				Expect(config.Validate()).Should(Succeed())
+			})
+		})
+		Context("when log-source is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LogSource = "syslog"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid log-source"))
+			})
+		})
+		Context("when node-name is missing with the node log-source", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LogSource = configpkg.LogSourceNode
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("node-name is missing from configuration"))
+			})
+		})
+		Context("when the multiline start-pattern is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Multiline.StartPattern = "("
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid multiline start-pattern"))
+			})
+		})
+		Context("when the spool max-size is negative", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Spool = configpkg.SpoolOptions{Dir: "/var/spool/bridge", MaxSize: -1}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("spool max-size can't be negative"))
+			})
+		})
+		Context("when the backpressure policy is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Backpressure.Policy = "drop-all"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid backpressure policy"))
+			})
+		})
+		Context("when a redaction pattern is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Redaction.Patterns = []string{"(unclosed"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid redaction pattern"))
+			})
+		})
+		Context("when a redaction builtin is unknown", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Redaction.Builtin = []string{"passwords"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid redaction builtin"))
+			})
+		})
+		Context("when a json-logs field is empty", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.JSONLogs.Fields = []string{"level", ""}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("json-logs fields can't be empty"))
+			})
+		})
+		Context("when a pod-tags key has a wildcard in the middle", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.PodTags.Labels = []string{"example.*/team"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid pod-tags key"))
+			})
+		})
+		Context("when the cloud controller uaa-url is missing", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.CloudController = configpkg.CloudControllerOptions{URL: "https://api.example.com", ClientID: "bridge"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("cloud-controller uaa-url is required with url"))
+			})
+		})
+		Context("when a source-types result has an unknown placeholder", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.SourceTypes = []configpkg.SourceTypeRule{{SourceType: "APP", Result: "APP/PROC/{process}"}}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("unknown placeholder"))
+			})
+		})
+		Context("when a containers pattern is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.Containers.Exclude = []string{"istio-*-proxy"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid containers pattern"))
+			})
+		})
+		Context("when the loggregator min TLS version is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LoggregatorMinTLSVersion = "1.1"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid loggregator-min-tls-version"))
+			})
+		})
+		Context("when a loggregator cipher suite is unknown", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LoggregatorCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("invalid loggregator-cipher-suites"))
+			})
+		})
+		Context("when the liveness window is shorter than the resync interval", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.ResyncInterval = 10 * time.Minute
+				config.LivenessWindow = time.Minute
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("liveness-window 1m0s must not be shorter than resync-interval 10m0s"))
+			})
+		})
+		Context("when the log level endpoint listens beyond the loopback interface", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LogLevelAddress = ":9091"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal(`log-level-address must be a loopback address (e.g. 127.0.0.1:9091), got ":9091"`))
+			})
+		})
+		Context("when the log level endpoint listens on the loopback interface", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LogLevelAddress = "127.0.0.1:9091"
+			})
+			It("doesn't return an error", func() {
+				Expect(config.Validate()).To(Succeed())
+			})
+		})
+		Context("when the max line size is too large", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.MaxLineSize = 1024 * 1024
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("max-line-size must be 0 (default) or between 1024 and 61440"))
+			})
+		})
+		Context("when the max line size is too small", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.MaxLineSize = 3
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("max-line-size must be 0 (default) or between 1024 and 61440"))
+			})
+		})
+		Context("when the batches of lines of max-line-size are too big", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.LoggregatorBatchSize = 2000
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal("loggregator-batch-size must be at most 1024 with a max-line-size of 61440"))
+			})
+			It("allows more envelopes with a smaller max-line-size", func() {
+				config.MaxLineSize = 4096
+				Expect(config.Validate()).To(Succeed())
+			})
+		})
+		Context("when a grace period is not a number of seconds", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.GracefulFailTime = "5; rm -rf /"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal(`graceful-fail-time must be a number of seconds, got "5; rm -rf /"`))
+			})
+		})
+		Context("when an init container uses the preStop grace strategy", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.GraceStrategies = map[string]string{"opi": "prestop", "opi-task-downloader": "prestop"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal(`grace-strategies: opi-task-downloader is an init container, it can't use "prestop"`))
+			})
+		})
+		Context("when the binary grace strategy is used without the wrapper image", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.GraceStrategies = map[string]string{"opi-task-executor": "binary"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal(`grace-strategies: opi-task-executor uses "binary", grace-wrapper-image must be set`))
+			})
+		})
+		Context("when a grace strategy is unknown", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.GraceStrategies = map[string]string{"opi": "sidecar"}
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(Equal(`grace-strategies: invalid strategy "sidecar" for opi (allowed: "wrapper", "prestop", "binary")`))
+			})
+		})
+		Context("when the pod selector is invalid", func() {
+			BeforeEach(func() {
+				config = validConfig
+				config.PodSelector = "app in (web"
+			})
+			It("returns an error", func() {
+				err := config.Validate()
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring(`invalid pod-selector "app in (web"`))
+			})
+		})
+	})
+
+	Describe("ContainerFilterOptions", func() {
+		It("selects the included containers which are not excluded", func() {
+			filter := configpkg.ContainerFilterOptions{Include: []string{"opi", "opi-task-*"}, Exclude: []string{"opi-task-uploader"}}
+			Expect(filter.Selected("opi")).To(BeTrue())
+			Expect(filter.Selected("opi-task-downloader")).To(BeTrue())
+			Expect(filter.Selected("opi-task-uploader")).To(BeFalse())
+			Expect(filter.Selected("istio-proxy")).To(BeFalse())
+		})
+
+		It("selects all the containers but the excluded ones by default", func() {
+			filter := configpkg.ContainerFilterOptions{Exclude: []string{"istio-proxy", "linkerd-*"}}
+			Expect(filter.Selected("opi")).To(BeTrue())
+			Expect(filter.Selected("istio-proxy")).To(BeFalse())
+			Expect(filter.Selected("linkerd-proxy")).To(BeFalse())
+		})
 	})
 })
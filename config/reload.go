@@ -0,0 +1,69 @@
+package config
+
+import "reflect"
+
+// Reload returns the config to switch to when the settings are reloaded as
+// next. Only the settings which don't change the identity of the bridge are
+// taken from next:
+//   - the namespace and the pod selector
+//   - the grace periods, entrypoints, strategies and wrapper image of the
+//     webhook
+//   - the Loggregator destination (endpoint, certificates and TLS options)
+//   - the log level and format
+//
+// The other ones are kept, their keys are returned if they changed, as they
+// need a restart.
+func (conf ConfigType) Reload(next ConfigType) (ConfigType, []string) {
+	reloaded := conf
+
+	reloaded.Namespace = next.Namespace
+	reloaded.PodSelector = next.PodSelector
+
+	reloaded.GracefulFailTime = next.GracefulFailTime
+	reloaded.GracefulSuccessTime = next.GracefulSuccessTime
+	reloaded.DownloaderEntrypoint = next.DownloaderEntrypoint
+	reloaded.ExecutorEntrypoint = next.ExecutorEntrypoint
+	reloaded.UploaderEntrypoint = next.UploaderEntrypoint
+	reloaded.OpiEntrypoint = next.OpiEntrypoint
+	reloaded.OpiImageContains = next.OpiImageContains
+	reloaded.GraceStrategies = next.GraceStrategies
+	reloaded.GraceWrapperImage = next.GraceWrapperImage
+
+	reloaded.LoggregatorEndpoint = next.LoggregatorEndpoint
+	reloaded.LoggregatorCAPath = next.LoggregatorCAPath
+	reloaded.LoggregatorCertPath = next.LoggregatorCertPath
+	reloaded.LoggregatorKeyPath = next.LoggregatorKeyPath
+	reloaded.LoggregatorServerName = next.LoggregatorServerName
+	reloaded.LoggregatorMinTLSVersion = next.LoggregatorMinTLSVersion
+	reloaded.LoggregatorCipherSuites = next.LoggregatorCipherSuites
+
+	reloaded.LogLevel = next.LogLevel
+	reloaded.LogFormat = next.LogFormat
+
+	restart := []string{}
+	// Secrets are compared too, so they are not redacted
+	nextSettings := sortSettings(flatten("", reflect.ValueOf(next), false))
+	for i, s := range sortSettings(flatten("", reflect.ValueOf(reloaded), false)) {
+		if s != nextSettings[i] {
+			restart = append(restart, s.Key)
+		}
+	}
+	return reloaded, restart
+}
+
+// DestinationChanged returns true if the Loggregator destination differs
+// between conf and other
+func (conf ConfigType) DestinationChanged(other ConfigType) bool {
+	a, b := conf.GetLoggregatorOptions(), other.GetLoggregatorOptions()
+	if a.Endpoint != b.Endpoint || a.CAPath != b.CAPath || a.CertPath != b.CertPath || a.KeyPath != b.KeyPath ||
+		a.ServerName != b.ServerName || a.MinTLSVersion != b.MinTLSVersion ||
+		len(a.CipherSuites) != len(b.CipherSuites) {
+		return true
+	}
+	for i := range a.CipherSuites {
+		if a.CipherSuites[i] != b.CipherSuites[i] {
+			return true
+		}
+	}
+	return false
+}
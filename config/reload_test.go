@@ -0,0 +1,45 @@
+package config_test
+
+import (
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload", func() {
+	current := configpkg.ConfigType{
+		Namespace:           "eirini",
+		LoggregatorEndpoint: "doppler:8082",
+		LogLevel:            "WARN",
+		GracefulFailTime:    "5",
+		MetricsAddress:      ":9090",
+	}
+
+	It("takes the reloadable settings from the new config", func() {
+		next := current
+		next.Namespace = "other"
+		next.PodSelector = "app=web"
+		next.LoggregatorEndpoint = "other-doppler:8082"
+		next.LogLevel = "DEBUG"
+		next.GracefulFailTime = "10"
+
+		reloaded, restart := current.Reload(next)
+		Expect(reloaded).To(Equal(next))
+		Expect(restart).To(BeEmpty())
+		Expect(reloaded.DestinationChanged(current)).To(BeTrue())
+	})
+
+	It("keeps the other settings and reports them", func() {
+		next := current
+		next.HAMode = "leader-election"
+		next.MetricsAddress = ":9091"
+		next.LogLevel = "DEBUG"
+
+		reloaded, restart := current.Reload(next)
+		Expect(reloaded.HAMode).To(BeEmpty())
+		Expect(reloaded.MetricsAddress).To(Equal(":9090"))
+		Expect(reloaded.LogLevel).To(Equal("DEBUG"))
+		Expect(restart).To(ConsistOf("ha-mode", "metrics-address"))
+		Expect(reloaded.DestinationChanged(current)).To(BeFalse())
+	})
+})
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the value of the secret settings
+const Redacted = "<redacted>"
+
+// Setting is a configuration value, keyed like in the config file (e.g.
+// "spool.dir")
+type Setting struct {
+	Key   string
+	Value string
+}
+
+// Settings returns all the settings of conf, sorted by key. The fields tagged
+// with `secret:"true"` are redacted.
+func (conf ConfigType) Settings() []Setting {
+	return SettingsOf(conf)
+}
+
+// Keys returns the keys of all the settings
+func Keys() []string {
+	keys := []string{}
+	for _, s := range SettingsOf(ConfigType{}) {
+		keys = append(keys, s.Key)
+	}
+	return keys
+}
+
+// SettingsOf flattens the struct v along its mapstructure tags
+func SettingsOf(v interface{}) []Setting {
+	return sortSettings(flatten("", reflect.ValueOf(v), true))
+}
+
+func sortSettings(settings []Setting) []Setting {
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+func flatten(prefix string, v reflect.Value, redact bool) []Setting {
+	settings := []Setting{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("mapstructure")
+		if key == "" || key == "-" {
+			continue
+		}
+		key = prefix + key
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Time{}) {
+			settings = append(settings, flatten(key+".", value, redact)...)
+			continue
+		}
+		formatted := formatValue(value)
+		if redact && field.Tag.Get("secret") == "true" && !value.IsZero() {
+			formatted = Redacted
+		}
+		settings = append(settings, Setting{Key: key, Value: formatted})
+	}
+	return settings
+}
+
+func formatValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case time.Duration:
+		return value.String()
+	case []string:
+		return strings.Join(value, ",")
+	case map[string]string:
+		pairs := []string{}
+		for k, val := range value {
+			pairs = append(pairs, k+"="+val)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
@@ -0,0 +1,59 @@
+package config_test
+
+import (
+	"time"
+
+	configpkg "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Settings", func() {
+	It("flattens the nested settings along their keys", func() {
+		conf := configpkg.ConfigType{
+			Namespace:       "eirini",
+			ResyncInterval:  time.Minute,
+			LoggregatorTags: map[string]string{"b": "2", "a": "1"},
+			Spool:           configpkg.SpoolOptions{Dir: "/spool"},
+		}
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "namespace", Value: `"eirini"`}))
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "resync-interval", Value: "1m0s"}))
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "loggregator-tags", Value: "a=1,b=2"}))
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "spool.dir", Value: `"/spool"`}))
+	})
+
+	It("lists all the keys", func() {
+		Expect(configpkg.Keys()).To(ContainElement("operator-webhook-port"))
+		Expect(configpkg.Keys()).To(ContainElement("rate-limit.app-burst"))
+		Expect(configpkg.Keys()).ToNot(ContainElement("spool"))
+	})
+
+	It("redacts the secrets which are set", func() {
+		type credentials struct {
+			User     string `mapstructure:"user"`
+			Password string `mapstructure:"password" secret:"true"`
+			Token    string `mapstructure:"token" secret:"true"`
+		}
+		settings := configpkg.SettingsOf(struct {
+			Credentials credentials `mapstructure:"credentials"`
+		}{credentials{User: "admin", Password: "hunter2"}})
+
+		Expect(settings).To(Equal([]configpkg.Setting{
+			{Key: "credentials.password", Value: configpkg.Redacted},
+			{Key: "credentials.token", Value: `""`},
+			{Key: "credentials.user", Value: `"admin"`},
+		}))
+	})
+	It("redacts the Cloud Controller client secret", func() {
+		conf := configpkg.ConfigType{CloudController: configpkg.CloudControllerOptions{ClientID: "bridge", ClientSecret: "s3cret"}}
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "cloud-controller.client-secret", Value: configpkg.Redacted}))
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{Key: "cloud-controller.client-id", Value: `"bridge"`}))
+	})
+	It("formats the source type rules", func() {
+		conf := configpkg.ConfigType{SourceTypes: configpkg.DefaultSourceTypeRules[2:4]}
+		Expect(conf.Settings()).To(ContainElement(configpkg.Setting{
+			Key:   "source-types",
+			Value: "[source-type=APP container=opi result=APP/PROC/{process_type} source-type=APP init=true result=APP/PROC/{process_type}]",
+		}))
+	})
+})
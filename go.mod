@@ -3,12 +3,18 @@ module code.cloudfoundry.org/eirini-loggregator-bridge
 require (
 	code.cloudfoundry.org/eirinix v0.3.1-0.20200908072226-2c03042398ea
 	code.cloudfoundry.org/go-loggregator/v8 v8.0.3
+	github.com/evanphx/json-patch v4.5.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/protobuf v1.4.2
 	github.com/mitchellh/mapstructure v1.2.2 // indirect
 	github.com/onsi/ginkgo v1.12.1
 	github.com/onsi/gomega v1.10.1
+	github.com/prometheus/client_golang v1.0.0
 	github.com/spf13/cobra v0.0.7
 	github.com/spf13/viper v1.6.3
 	go.uber.org/zap v1.15.0
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	google.golang.org/grpc v1.26.0
 	k8s.io/api v0.18.6
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
@@ -0,0 +1,13 @@
+package gracewrapper_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestGraceWrapper(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Grace wrapper test Suite")
+}
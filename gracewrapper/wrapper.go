@@ -0,0 +1,166 @@
+// Package gracewrapper runs the entrypoint of the containers mutated by the
+// webhook, and waits for the grace period once it exits, so that the bridge
+// has time to stream its logs. Unlike the shell wrapper, it doesn't need
+// anything in the image: it is copied into the pod by an init container.
+package gracewrapper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the wrapper when the process can't be started, like the
+// shells
+const (
+	ExitCannotExecute = 126
+	ExitNotFound      = 127
+)
+
+// Options are the grace periods to wait for once the process exited,
+// depending on its exit code
+type Options struct {
+	SuccessGracePeriod time.Duration
+	FailGracePeriod    time.Duration
+
+	// Stdin, Stdout and Stderr of the process, the wrapper's when not set
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+}
+
+// Run runs the command, forwarding it the signals received on signals, and
+// returns its exit code once the grace period is over. A process killed by a
+// signal exits with 128 + the signal number. The grace period is skipped when
+// the wrapper was asked to terminate (SIGTERM or SIGINT), as the container is
+// being stopped anyway.
+func Run(command []string, opts Options, signals <-chan os.Signal) int {
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	code, terminated := run(command, opts, stderr, signals)
+
+	gracePeriod := opts.SuccessGracePeriod
+	if code != 0 {
+		gracePeriod = opts.FailGracePeriod
+	}
+	if terminated || gracePeriod <= 0 {
+		return code
+	}
+
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return code
+		case sig := <-signals:
+			if isTermination(sig) {
+				return code
+			}
+		}
+	}
+}
+
+func run(command []string, opts Options, stderr io.Writer, signals <-chan os.Signal) (code int, terminated bool) {
+	if len(command) == 0 {
+		fmt.Fprintln(stderr, "grace-wrapper: no command given")
+		return ExitNotFound, false
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = opts.Stdin, opts.Stdout, stderr
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(stderr, "grace-wrapper: %s\n", err.Error())
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound) {
+			return ExitNotFound, false
+		}
+		return ExitCannotExecute, false
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case sig := <-signals:
+			if !forwarded(sig) {
+				continue
+			}
+			terminated = terminated || isTermination(sig)
+			// The process may have exited meanwhile, Wait reports it
+			_ = cmd.Process.Signal(sig)
+		case <-done:
+			return exitCode(cmd.ProcessState), terminated
+		}
+	}
+}
+
+func exitCode(state *os.ProcessState) int {
+	if state == nil {
+		return ExitCannotExecute
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// forwarded tells whether the signal is for the process. SIGCHLD is about the
+// wrapper's own child, SIGURG is used by the Go runtime.
+func forwarded(sig os.Signal) bool {
+	return sig != syscall.SIGCHLD && sig != syscall.SIGURG
+}
+
+func isTermination(sig os.Signal) bool {
+	return sig == syscall.SIGTERM || sig == os.Interrupt
+}
+
+// Install copies the running binary to dest, which is usually in a volume
+// shared with the wrapped containers
+func Install(dest string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return copyExecutable(self, dest)
+}
+
+func copyExecutable(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Written aside and renamed, so that a container never runs a partial copy
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
@@ -0,0 +1,96 @@
+package gracewrapper_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/gracewrapper"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Grace wrapper", func() {
+	var (
+		opts    Options
+		stdout  *bytes.Buffer
+		stderr  *bytes.Buffer
+		signals chan os.Signal
+	)
+
+	BeforeEach(func() {
+		stdout, stderr = &bytes.Buffer{}, &bytes.Buffer{}
+		opts = Options{Stdout: stdout, Stderr: stderr}
+		signals = make(chan os.Signal, 1)
+	})
+
+	Describe("Run", func() {
+		It("runs the command and keeps its exit code", func() {
+			Expect(Run([]string{"/bin/sh", "-c", "echo out; exit 3"}, opts, signals)).To(Equal(3))
+			Expect(stdout.String()).To(Equal("out\n"))
+		})
+
+		It("waits for the success grace period once the command succeeded", func() {
+			opts.SuccessGracePeriod = 300 * time.Millisecond
+			opts.FailGracePeriod = time.Hour
+			start := time.Now()
+			Expect(Run([]string{"true"}, opts, signals)).To(Equal(0))
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+
+		It("waits for the fail grace period once the command failed", func() {
+			opts.SuccessGracePeriod = time.Hour
+			opts.FailGracePeriod = 300 * time.Millisecond
+			start := time.Now()
+			Expect(Run([]string{"false"}, opts, signals)).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+
+		It("forwards the signals and skips the grace period when terminated", func() {
+			opts.FailGracePeriod = time.Hour
+			code := make(chan int)
+			go func() { code <- Run([]string{"sleep", "60"}, opts, signals) }()
+
+			signals <- syscall.SIGTERM
+			Eventually(code, 5*time.Second).Should(Receive(Equal(128 + int(syscall.SIGTERM))))
+		})
+
+		It("ends the grace period when terminated", func() {
+			opts.SuccessGracePeriod = time.Hour
+			code := make(chan int)
+			go func() { code <- Run([]string{"true"}, opts, signals) }()
+
+			Consistently(code, 200*time.Millisecond).ShouldNot(Receive())
+			signals <- syscall.SIGTERM
+			Eventually(code, 5*time.Second).Should(Receive(Equal(0)))
+		})
+
+		It("fails like a shell when the command doesn't exist", func() {
+			Expect(Run([]string{"/does/not/exist"}, opts, signals)).To(Equal(ExitNotFound))
+			Expect(stderr.String()).To(ContainSubstring("grace-wrapper: "))
+		})
+	})
+
+	Describe("Install", func() {
+		It("copies the running binary as an executable", func() {
+			dir, err := ioutil.TempDir("", "grace-wrapper")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			dest := filepath.Join(dir, "grace-wrapper")
+			Expect(Install(dest)).To(Succeed())
+
+			info, err := os.Stat(dest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+			self, err := os.Executable()
+			Expect(err).ToNot(HaveOccurred())
+			selfInfo, err := os.Stat(self)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Size()).To(Equal(selfInfo.Size()))
+		})
+	})
+})
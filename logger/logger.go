@@ -2,43 +2,192 @@ package logger
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
-var LogLevels = map[string]int{
-	"DEBUG": 1,
-	"INFO":  2,
-	"WARN":  3,
-	"ERROR": 4,
-}
+// Output formats of the logs
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// Keys of the contextual fields attached to the logs of a container
+const (
+	FieldNamespace = "namespace"
+	FieldPod       = "pod"
+	FieldContainer = "container"
+	FieldSourceID  = "source_id"
+)
+
+// DefaultLevel is used when no level is configured
+const DefaultLevel = "WARN"
 
+// LogLevel is the level set through the environment
 var LogLevel = os.Getenv("EIRINI_LOGGREGATOR_BRIDGE_LOGLEVEL")
 
+// LogFormat is the format set through the environment
+var LogFormat = os.Getenv("EIRINI_LOGGREGATOR_BRIDGE_LOGFORMAT")
+
+var (
+	// level is shared by all the loggers, so that it can be changed at runtime
+	level = zap.NewAtomicLevel()
+	// configuredLevel is the level restored after a debug toggle
+	configuredLevel = zap.NewAtomicLevel()
+	// output is the zapcore.Core currently writing the logs
+	output atomic.Value
+	root   *zap.Logger
+)
+
+func init() {
+	root = zap.New(dynamicCore{})
+	if err := Configure(LogLevel, LogFormat, os.Stdout); err != nil {
+		Configure(DefaultLevel, FormatConsole, os.Stdout)
+		LogError(err.Error())
+	}
+}
+
+// Configure sets the level and the format of all the loggers, including the
+// ones which were already created. Empty values keep the defaults.
+func Configure(logLevel, format string, w io.Writer) error {
+	if logLevel == "" {
+		logLevel = DefaultLevel
+	}
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level %q (allowed: %q, %q, %q, %q)", logLevel, "DEBUG", "INFO", "WARN", "ERROR")
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	switch format {
+	case "", FormatConsole:
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	case FormatJSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	default:
+		return fmt.Errorf("invalid log format %q (allowed: %q, %q)", format, FormatConsole, FormatJSON)
+	}
+
+	output.Store(zapcore.NewCore(encoder, zapcore.Lock(zapcore.AddSync(w)), zapcore.DebugLevel))
+	configuredLevel.SetLevel(l)
+	level.SetLevel(l)
+	return nil
+}
+
+// SetLevel changes the level of all the loggers
+func SetLevel(logLevel string) error {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(logLevel)); err != nil {
+		return err
+	}
+	level.SetLevel(l)
+	return nil
+}
+
+// Level returns the current level of the loggers
+func Level() string {
+	return level.Level().CapitalString()
+}
+
+// LevelHandler serves the current level on GET and changes it on PUT, with a
+// JSON body like {"level":"debug"}
+func LevelHandler() http.Handler {
+	return level
+}
+
+// ServeLevel serves LevelHandler on addr under /log-level. It blocks until
+// the server fails.
+func ServeLevel(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/log-level", LevelHandler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// HandleSignals toggles the debug level on SIGUSR1: the first signal enables
+// it, the next one restores the configured level
+func HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if level.Level() == zapcore.DebugLevel {
+				level.SetLevel(configuredLevel.Level())
+			} else {
+				level.SetLevel(zapcore.DebugLevel)
+			}
+			root.Warn("Log level changed by signal", zap.String("level", Level()))
+		}
+	}()
+}
+
+// Named returns the logger of a subsystem, contextual fields can be added with
+// With, e.g. Named("tail").With(FieldPod, pod)
+func Named(name string) *zap.SugaredLogger {
+	return root.Named(name).Sugar()
+}
+
 func LogWarn(args ...interface{}) {
-	log(LogLevels["WARN"], args...)
+	log(zapcore.WarnLevel, args...)
 }
 func LogError(args ...interface{}) {
-	log(LogLevels["ERROR"], args...)
+	log(zapcore.ErrorLevel, args...)
 }
 func LogInfo(args ...interface{}) {
-	log(LogLevels["INFO"], args...)
+	log(zapcore.InfoLevel, args...)
 }
 func LogDebug(args ...interface{}) {
-	log(LogLevels["DEBUG"], args...)
+	log(zapcore.DebugLevel, args...)
 }
 
 // Wrapper method that should be used to print output. Using this instead of fmt
 // let's you implement verbosity levels or disable output completely.
-func log(targetLogLevel int, args ...interface{}) {
-	var logLevel int
-
-	if LogLevel == "" {
-		logLevel = LogLevels["WARN"]
-	} else {
-		logLevel = LogLevels[LogLevel]
+func log(targetLogLevel zapcore.Level, args ...interface{}) {
+	if !level.Enabled(targetLogLevel) {
+		return
+	}
+	// Operands are joined with spaces, as they always were
+	message := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	if ce := root.Check(targetLogLevel, message); ce != nil {
+		ce.Write()
 	}
+}
+
+// dynamicCore writes to the current output, so that the loggers created
+// before Configure follow the new format
+type dynamicCore struct {
+	fields []zapcore.Field
+}
 
-	if targetLogLevel >= logLevel {
-		fmt.Println(args...)
+func (c dynamicCore) Enabled(l zapcore.Level) bool {
+	return level.Enabled(l)
+}
+
+func (c dynamicCore) With(fields []zapcore.Field) zapcore.Core {
+	return dynamicCore{fields: append(append([]zapcore.Field{}, c.fields...), fields...)}
+}
+
+func (c dynamicCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
 	}
+	return checked
+}
+
+func (c dynamicCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return output.Load().(zapcore.Core).Write(entry, append(append([]zapcore.Field{}, c.fields...), fields...))
+}
+
+func (c dynamicCore) Sync() error {
+	return output.Load().(zapcore.Core).Sync()
 }
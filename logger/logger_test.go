@@ -0,0 +1,83 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	var out *bytes.Buffer
+
+	entries := func() []map[string]interface{} {
+		r := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			entry := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed())
+			r = append(r, entry)
+		}
+		return r
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		Expect(Configure("INFO", FormatJSON, out)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(Configure("", "", os.Stdout)).To(Succeed())
+	})
+
+	It("filters the logs below the level", func() {
+		LogDebug("hidden")
+		LogInfo("shown", 1, 2)
+		Expect(entries()).To(HaveLen(1))
+		Expect(entries()[0]).To(HaveKeyWithValue("msg", "shown 1 2"))
+		Expect(entries()[0]).To(HaveKeyWithValue("level", "info"))
+		Expect(entries()[0]).To(HaveKey("ts"))
+	})
+
+	It("names the subsystem loggers and adds the contextual fields", func() {
+		Named("tail").With(FieldPod, "app-0", FieldSourceID, "app-guid").Warn("hello")
+		Expect(entries()).To(HaveLen(1))
+		Expect(entries()[0]).To(HaveKeyWithValue("logger", "tail"))
+		Expect(entries()[0]).To(HaveKeyWithValue("pod", "app-0"))
+		Expect(entries()[0]).To(HaveKeyWithValue("source_id", "app-guid"))
+	})
+
+	It("applies the configuration to the existing loggers", func() {
+		l := Named("spool")
+		console := &bytes.Buffer{}
+		Expect(Configure("DEBUG", FormatConsole, console)).To(Succeed())
+		l.Debug("replaying")
+		Expect(console.String()).To(ContainSubstring("DEBUG\tspool\treplaying"))
+	})
+
+	It("changes the level at runtime", func() {
+		Expect(SetLevel("error")).To(Succeed())
+		LogWarn("hidden")
+		Expect(out.String()).To(BeEmpty())
+		Expect(Level()).To(Equal("ERROR"))
+
+		req := httptest.NewRequest(http.MethodPut, "/log-level", strings.NewReader(`{"level":"debug"}`))
+		rec := httptest.NewRecorder()
+		LevelHandler().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(Level()).To(Equal("DEBUG"))
+	})
+
+	It("rejects invalid levels and formats", func() {
+		Expect(Configure("VERBOSE", "", out)).ToNot(Succeed())
+		Expect(Configure("", "xml", out)).ToNot(Succeed())
+	})
+})
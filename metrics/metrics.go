@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "eirini_loggregator_bridge"
+
+// Registry holds the bridge metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// SplitLines counts the log lines which were longer than the max line size
+	// and got split in multiple envelopes
+	SplitLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "split_lines_total",
+		Help:      "Number of log lines split in multiple envelopes because exceeding the max line size",
+	})
+
+	// RateLimitedLines counts the log lines dropped by the rate limiting
+	RateLimitedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_lines_total",
+		Help:      "Number of log lines dropped because exceeding the app or app instance rate limit",
+	})
+
+	// SpoolEnvelopes is the number of envelopes waiting in the spool
+	SpoolEnvelopes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_envelopes",
+		Help:      "Number of envelopes spooled on disk while Loggregator is unreachable",
+	})
+
+	// SpoolBytes is the disk space used by the spool
+	SpoolBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_bytes",
+		Help:      "Disk space used by the spool",
+	})
+
+	// SpoolOldestEnvelopeAge is the age of the oldest envelope in the spool
+	SpoolOldestEnvelopeAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_oldest_envelope_age_seconds",
+		Help:      "Age of the oldest envelope waiting in the spool",
+	})
+
+	// SpoolDroppedEnvelopes counts the envelopes dropped because exceeding the
+	// spool limits
+	SpoolDroppedEnvelopes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spool_dropped_envelopes_total",
+		Help:      "Number of spooled envelopes dropped because exceeding the spool max-size or max-age",
+	})
+
+	// QueueOverflows counts, by overflow policy, the envelopes which didn't
+	// fit in the queue of their container: they were blocked (block) or
+	// dropped (drop-oldest, drop-newest)
+	QueueOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_overflows_total",
+		Help:      "Number of envelopes which found their container queue full, by overflow policy",
+	}, []string{"policy"})
+
+	// Redactions counts, by pattern, the secrets redacted from the log lines:
+	// the name of the bundled pattern, or custom for the operator supplied ones
+	Redactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redactions_total",
+		Help:      "Number of secrets redacted from the log lines, by pattern",
+	}, []string{"pattern"})
+)
+
+// RedactionCustom labels the redactions of the operator supplied patterns
+const RedactionCustom = "custom"
+
+func init() {
+	Registry.MustRegister(
+		SplitLines,
+		RateLimitedLines,
+		SpoolEnvelopes,
+		SpoolBytes,
+		SpoolOldestEnvelopeAge,
+		SpoolDroppedEnvelopes,
+		QueueOverflows,
+		Redactions,
+	)
+
+	// Expose the counters of all the policies, even before any overflow
+	for _, policy := range []string{config.OverflowBlock, config.OverflowDropOldest, config.OverflowDropNewest} {
+		QueueOverflows.WithLabelValues(policy)
+	}
+	for _, pattern := range []string{config.RedactBearerTokens, config.RedactAWSKeys, config.RedactEmails, RedactionCustom} {
+		Redactions.WithLabelValues(pattern)
+	}
+}
+
+// Handler returns the HTTP handler exposing the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Serve exposes the metrics on addr under /metrics, together with the given
+// handlers (e.g. the health probes). It blocks until the server fails.
+func Serve(addr string, handlers map[string]http.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,236 @@
+package podwatcher
+
+import (
+	"sync"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+)
+
+var sendersLog = Named("senders")
+
+// senderBatchSize is the max number of envelopes a sender takes from a queue
+// at once, so that a busy container doesn't starve the others
+const senderBatchSize = 100
+
+// SenderPool is a fixed set of goroutines emitting the envelopes of the
+// container queues. A queue is handed to one sender at a time, so the
+// envelopes of a container keep their order.
+type SenderPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   []*EnvelopeQueue
+	stopped bool
+	// active is the number of the queues which are not empty, or being sent
+	active  int
+	drained *sync.Cond
+}
+
+var (
+	sharedSenderPool     *SenderPool
+	sharedSenderPoolOnce sync.Once
+)
+
+// SharedSenderPool returns the pool used by all the tails, it is started
+// with the given number of senders on first use
+func SharedSenderPool(senders int) *SenderPool {
+	sharedSenderPoolOnce.Do(func() {
+		sharedSenderPool = NewSenderPool(senders)
+	})
+	return sharedSenderPool
+}
+
+// NewSenderPool starts a SenderPool, zero senders means the default number
+func NewSenderPool(senders int) *SenderPool {
+	if senders == 0 {
+		senders = config.DefaultSenders
+	}
+	p := &SenderPool{}
+	p.cond = sync.NewCond(&p.mu)
+	p.drained = sync.NewCond(&p.mu)
+	for i := 0; i < senders; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// Stop stops the senders once they are done with their current batch
+func (p *SenderPool) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.drained.Broadcast()
+}
+
+// Drain waits for the senders to empty all the queues, or to be stopped. The
+// tails have to be stopped first, so that nothing is queued anymore.
+func (p *SenderPool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.active > 0 && !p.stopped {
+		p.drained.Wait()
+	}
+}
+
+// activate schedules a queue which was empty
+func (p *SenderPool) activate(q *EnvelopeQueue) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+	p.ready = append(p.ready, q)
+	p.cond.Signal()
+}
+
+// deactivate records that a queue was emptied
+func (p *SenderPool) deactivate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	if p.active == 0 {
+		p.drained.Broadcast()
+	}
+}
+
+func (p *SenderPool) schedule(q *EnvelopeQueue) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ready = append(p.ready, q)
+	p.cond.Signal()
+}
+
+func (p *SenderPool) next() *EnvelopeQueue {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.ready) == 0 && !p.stopped {
+		p.cond.Wait()
+	}
+	if p.stopped {
+		return nil
+	}
+	q := p.ready[0]
+	p.ready = p.ready[1:]
+	return q
+}
+
+func (p *SenderPool) run() {
+	for {
+		q := p.next()
+		if q == nil {
+			return
+		}
+		q.send()
+	}
+}
+
+// EnvelopeQueue is the bounded queue between a container tail and its sink.
+// When the queue is full, the overflow policy decides whether the tail
+// blocks or which envelope is dropped.
+type EnvelopeQueue struct {
+	pool   *SenderPool
+	policy string
+	size   int
+
+	// sendMu is held while emitting to sink
+	sendMu sync.Mutex
+	sink   Emitter
+
+	mu        sync.Mutex
+	space     *sync.Cond
+	envelopes []*loggregator_v2.Envelope
+	// scheduled is true while the queue waits for a sender or is being sent
+	scheduled bool
+}
+
+// NewQueue returns a queue emitting its envelopes to sink through the pool
+func (p *SenderPool) NewQueue(sink Emitter, opts config.BackpressureOptions) *EnvelopeQueue {
+	q := &EnvelopeQueue{pool: p, sink: sink, policy: opts.Policy, size: opts.QueueSize}
+	if q.policy == "" {
+		q.policy = config.OverflowBlock
+	}
+	if q.size == 0 {
+		q.size = config.DefaultQueueSize
+	}
+	q.space = sync.NewCond(&q.mu)
+	return q
+}
+
+// Emit queues the envelope, applying the overflow policy if the queue is full
+func (q *EnvelopeQueue) Emit(e *loggregator_v2.Envelope) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.envelopes) >= q.size {
+		metrics.QueueOverflows.WithLabelValues(q.policy).Inc()
+		switch q.policy {
+		case config.OverflowDropNewest:
+			return
+		case config.OverflowDropOldest:
+			q.envelopes[0] = nil
+			q.envelopes = q.envelopes[1:]
+		default:
+			for len(q.envelopes) >= q.size {
+				q.space.Wait()
+			}
+		}
+	}
+
+	q.envelopes = append(q.envelopes, e)
+	if !q.scheduled {
+		q.scheduled = true
+		q.pool.activate(q)
+	}
+}
+
+// Len returns the number of queued envelopes
+func (q *EnvelopeQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.envelopes)
+}
+
+// send emits a batch of envelopes, the queue is scheduled again if there are
+// more of them
+func (q *EnvelopeQueue) send() {
+	q.mu.Lock()
+	n := len(q.envelopes)
+	if n > senderBatchSize {
+		n = senderBatchSize
+	}
+	batch := q.envelopes[:n:n]
+	q.envelopes = q.envelopes[n:]
+	q.space.Broadcast()
+	q.mu.Unlock()
+
+	q.sendMu.Lock()
+	for _, e := range batch {
+		q.sink.Emit(e)
+	}
+	q.sendMu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.envelopes) > 0 {
+		q.pool.schedule(q)
+	} else {
+		q.scheduled = false
+		q.pool.deactivate()
+	}
+}
+
+// SetSink replaces the sink, e.g. to reconnect with new certificates. The
+// envelopes buffered by the old sink are flushed before the new sink gets
+// any, so that they stay in order.
+func (q *EnvelopeQueue) SetSink(sink Emitter) {
+	q.sendMu.Lock()
+	defer q.sendMu.Unlock()
+
+	if c, ok := q.sink.(interface{ CloseSend() error }); ok {
+		if err := c.CloseSend(); err != nil {
+			sendersLog.Warn("Closing the previous Loggregator connection: ", err.Error())
+		}
+	}
+	q.sink = sink
+}
@@ -0,0 +1,121 @@
+package podwatcher_test
+
+import (
+	"strconv"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// gatedEmitter blocks every Emit until the gate is closed
+type gatedEmitter struct {
+	fakeEmitter
+	gate chan struct{}
+}
+
+func (g *gatedEmitter) Emit(e *loggregator_v2.Envelope) {
+	<-g.gate
+	g.fakeEmitter.Emit(e)
+}
+
+func logEnvelope(payload string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		Message: &loggregator_v2.Envelope_Log{Log: &loggregator_v2.Log{Payload: []byte(payload)}},
+	}
+}
+
+var defaultBackpressure = config.BackpressureOptions{}
+
+var _ = Describe("EnvelopeQueue", func() {
+	var (
+		pool *SenderPool
+		sink *gatedEmitter
+	)
+
+	BeforeEach(func() {
+		pool = NewSenderPool(2)
+		sink = &gatedEmitter{gate: make(chan struct{})}
+	})
+
+	AfterEach(func() {
+		pool.Stop()
+	})
+
+	// fill blocks the sink with the first envelope and queues the next ones
+	fill := func(q *EnvelopeQueue, payloads ...string) {
+		q.Emit(logEnvelope(payloads[0]))
+		Eventually(q.Len).Should(BeZero())
+		for _, p := range payloads[1:] {
+			q.Emit(logEnvelope(p))
+		}
+	}
+
+	overflows := func(policy string) float64 {
+		return testutil.ToFloat64(metrics.QueueOverflows.WithLabelValues(policy))
+	}
+
+	It("keeps the order of the envelopes of each container", func() {
+		close(sink.gate)
+		other := &fakeEmitter{}
+		q1 := pool.NewQueue(sink, config.BackpressureOptions{QueueSize: 10})
+		q2 := pool.NewQueue(other, config.BackpressureOptions{QueueSize: 10})
+
+		expected := []string{}
+		for i := 0; i < 500; i++ {
+			expected = append(expected, strconv.Itoa(i))
+			q1.Emit(logEnvelope(strconv.Itoa(i)))
+			q2.Emit(logEnvelope(strconv.Itoa(i)))
+		}
+		Eventually(sink.payloads).Should(Equal(expected))
+		Eventually(other.payloads).Should(Equal(expected))
+	})
+
+	Context("with the drop-newest policy", func() {
+		It("drops the envelopes which don't fit in the queue", func() {
+			before := overflows(config.OverflowDropNewest)
+			q := pool.NewQueue(sink, config.BackpressureOptions{Policy: config.OverflowDropNewest, QueueSize: 2})
+			fill(q, "1", "2", "3", "4")
+			Expect(overflows(config.OverflowDropNewest)).To(Equal(before + 1))
+
+			close(sink.gate)
+			Eventually(sink.payloads).Should(Equal([]string{"1", "2", "3"}))
+		})
+	})
+
+	Context("with the drop-oldest policy", func() {
+		It("drops the oldest queued envelopes", func() {
+			before := overflows(config.OverflowDropOldest)
+			q := pool.NewQueue(sink, config.BackpressureOptions{Policy: config.OverflowDropOldest, QueueSize: 2})
+			fill(q, "1", "2", "3", "4")
+			Expect(overflows(config.OverflowDropOldest)).To(Equal(before + 1))
+
+			close(sink.gate)
+			Eventually(sink.payloads).Should(Equal([]string{"1", "3", "4"}))
+		})
+	})
+
+	Context("with the block policy", func() {
+		It("blocks the tail until there is room in the queue", func() {
+			before := overflows(config.OverflowBlock)
+			q := pool.NewQueue(sink, config.BackpressureOptions{QueueSize: 2})
+			fill(q, "1", "2", "3")
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				q.Emit(logEnvelope("4"))
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			Expect(overflows(config.OverflowBlock)).To(Equal(before + 1))
+
+			close(sink.gate)
+			Eventually(done).Should(BeClosed())
+			Eventually(sink.payloads).Should(Equal([]string{"1", "2", "3", "4"}))
+		})
+	})
+})
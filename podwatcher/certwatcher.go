@@ -0,0 +1,303 @@
+package podwatcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	"code.cloudfoundry.org/go-loggregator/v8"
+	"github.com/fsnotify/fsnotify"
+)
+
+var certsLog = Named("certs")
+
+// CertReloadDelay is how long the CertWatcher waits after a change before
+// reloading, as the cert and key files are usually not written at once
+var CertReloadDelay = time.Second
+
+// CertWatcher rebuilds the Loggregator TLS config when the CA, cert or key
+// files change, e.g. when the secret they are mounted from is rotated.
+// Subscribers are handed the new TLS config to reconnect with.
+type CertWatcher struct {
+	mu          sync.Mutex
+	options     config.LoggregatorOptions
+	tlsConfig   *tls.Config
+	contents    [][]byte
+	subscribers map[int]func(*tls.Config)
+	nextID      int
+	watcher     *fsnotify.Watcher
+	dirs        map[string]bool
+}
+
+var (
+	sharedCertWatcher   *CertWatcher
+	sharedCertWatcherMu sync.Mutex
+)
+
+// SharedCertWatcher returns the CertWatcher of the Loggregator certificates,
+// it is started on first use
+func SharedCertWatcher(opts config.LoggregatorOptions) (*CertWatcher, error) {
+	sharedCertWatcherMu.Lock()
+	defer sharedCertWatcherMu.Unlock()
+
+	if sharedCertWatcher == nil {
+		w, err := NewCertWatcher(opts)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			if err := w.Run(context.Background()); err != nil {
+				certsLog.Error("Not watching the Loggregator certificates: ", err.Error())
+			}
+		}()
+		sharedCertWatcher = w
+	}
+	return sharedCertWatcher, nil
+}
+
+// UpdateSharedCertWatcher switches the shared CertWatcher, if it was started,
+// to new Loggregator destination settings. The tails started afterwards use
+// them anyway.
+func UpdateSharedCertWatcher(opts config.LoggregatorOptions) error {
+	sharedCertWatcherMu.Lock()
+	w := sharedCertWatcher
+	sharedCertWatcherMu.Unlock()
+
+	if w == nil {
+		return nil
+	}
+	return w.Update(opts)
+}
+
+// LoggregatorTLSConfig builds the TLS config of the Loggregator ingress
+// client from the certificate files and the TLS options
+func LoggregatorTLSConfig(opts config.LoggregatorOptions) (*tls.Config, error) {
+	tlsConfig, err := loggregator.NewIngressTLSConfig(opts.CAPath, opts.CertPath, opts.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ServerName != "" {
+		tlsConfig.ServerName = opts.ServerName
+	}
+	minVersion, err := config.TLSVersion(opts.MinTLSVersion)
+	if err != nil {
+		return nil, err
+	}
+	if minVersion != 0 {
+		// The defaults pin TLS 1.2, allow anything above the min instead
+		tlsConfig.MinVersion, tlsConfig.MaxVersion = minVersion, 0
+	}
+	if len(opts.CipherSuites) > 0 {
+		if tlsConfig.CipherSuites, err = config.CipherSuites(opts.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// NewCertWatcher returns a CertWatcher holding the TLS config built from the
+// current files
+func NewCertWatcher(opts config.LoggregatorOptions) (*CertWatcher, error) {
+	w := &CertWatcher{
+		options:     opts,
+		subscribers: map[int]func(*tls.Config){},
+		dirs:        map[string]bool{},
+	}
+	if _, err := w.Reload(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// TLSConfig returns the TLS config built from the latest valid files
+func (w *CertWatcher) TLSConfig() *tls.Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.tlsConfig
+}
+
+// Options returns the current Loggregator destination settings
+func (w *CertWatcher) Options() config.LoggregatorOptions {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.options
+}
+
+// Endpoint returns the current Loggregator endpoint
+func (w *CertWatcher) Endpoint() string {
+	return w.Options().Endpoint
+}
+
+// Subscribe calls f with every new TLS config, until unsubscribed
+func (w *CertWatcher) Subscribe(f func(*tls.Config)) (unsubscribe func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextID
+	w.nextID++
+	w.subscribers[id] = f
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subscribers, id)
+	}
+}
+
+// Reload rebuilds the TLS config if the files changed. It returns true if
+// the subscribers were handed a new config. On error, the current config is
+// kept.
+func (w *CertWatcher) Reload() (bool, error) {
+	opts := w.Options()
+	contents, err := readCertificates(opts)
+	if err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	unchanged := w.contents != nil
+	for i := range w.contents {
+		unchanged = unchanged && bytes.Equal(w.contents[i], contents[i])
+	}
+	w.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	tlsConfig, err := LoggregatorTLSConfig(opts)
+	if err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	initial := w.contents == nil
+	w.tlsConfig, w.contents = tlsConfig, contents
+	subscribers := w.subscriberList()
+	w.mu.Unlock()
+
+	if initial {
+		return false, nil
+	}
+	certsLog.Info("Loggregator certificates changed, reconnecting")
+	for _, f := range subscribers {
+		f(tlsConfig)
+	}
+	return true, nil
+}
+
+// Update switches to new Loggregator destination settings (endpoint,
+// certificates and TLS options). The subscribers are handed the new TLS
+// config, as the endpoint may have changed even if the files didn't. On
+// error, the current settings are kept.
+func (w *CertWatcher) Update(opts config.LoggregatorOptions) error {
+	contents, err := readCertificates(opts)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := LoggregatorTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.options, w.tlsConfig, w.contents = opts, tlsConfig, contents
+	subscribers := w.subscriberList()
+	watcher := w.watcher
+	w.mu.Unlock()
+
+	if watcher != nil {
+		if err := w.watch(watcher, opts); err != nil {
+			certsLog.Warn("Watching the Loggregator certificates: ", err.Error())
+		}
+	}
+	certsLog.Info("Loggregator destination changed, reconnecting to ", opts.Endpoint)
+	for _, f := range subscribers {
+		f(tlsConfig)
+	}
+	return nil
+}
+
+func (w *CertWatcher) subscriberList() []func(*tls.Config) {
+	subscribers := make([]func(*tls.Config), 0, len(w.subscribers))
+	for _, f := range w.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	return subscribers
+}
+
+func readCertificates(opts config.LoggregatorOptions) ([][]byte, error) {
+	contents := [][]byte{}
+	for _, path := range []string{opts.CAPath, opts.CertPath, opts.KeyPath} {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, b)
+	}
+	return contents, nil
+}
+
+// watch adds the directories of the files which are not watched yet
+func (w *CertWatcher) watch(watcher *fsnotify.Watcher, opts config.LoggregatorOptions) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, path := range []string{opts.CAPath, opts.CertPath, opts.KeyPath} {
+		dir := filepath.Dir(path)
+		if w.dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+		w.dirs[dir] = true
+	}
+	return nil
+}
+
+// Run watches the directories of the files until ctx is done. Directories
+// are watched rather than files, as mounted secrets are updated by swapping
+// symlinks.
+func (w *CertWatcher) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := w.watch(watcher, w.Options()); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.watcher = watcher
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.watcher, w.dirs = nil, map[string]bool{}
+		w.mu.Unlock()
+	}()
+
+	// Catch up with the changes made before the directories were watched
+	reload := time.NewTimer(0)
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Events:
+			reload.Reset(CertReloadDelay)
+		case err := <-watcher.Errors:
+			certsLog.Warn("Watching the Loggregator certificates: ", err.Error())
+		case <-reload.C:
+			if _, err := w.Reload(); err != nil {
+				certsLog.Error("Keeping the current Loggregator certificates: ", err.Error())
+			}
+		}
+	}
+}
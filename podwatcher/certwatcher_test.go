@@ -0,0 +1,258 @@
+package podwatcher_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// testCA signs the certificates of the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA() *testCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key signed by the CA
+func (ca *testCA) issue(serial int64, notAfter time.Time) (certPEM, keyPEM, der []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "metron"},
+		DNSNames:     []string{"metron", "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err = x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).ToNot(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		der
+}
+
+// writeAtomically replaces the file the way kubelet updates mounted secrets
+func writeAtomically(path string, content []byte) {
+	tmp := path + ".tmp"
+	Expect(ioutil.WriteFile(tmp, content, 0600)).To(Succeed())
+	Expect(os.Rename(tmp, path)).To(Succeed())
+}
+
+type closingEmitter struct {
+	fakeEmitter
+	closed bool
+}
+
+func (c *closingEmitter) CloseSend() error {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closingEmitter) isClosed() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.closed
+}
+
+var _ = Describe("CertWatcher", func() {
+	CertReloadDelay = 10 * time.Millisecond
+
+	var (
+		dir                       string
+		ca                        *testCA
+		caPath, certPath, keyPath string
+		watcher                   *CertWatcher
+		cancel                    context.CancelFunc
+		done                      chan struct{}
+		mu                        sync.Mutex
+		reloaded                  []*tls.Config
+	)
+
+	reloads := func() []*tls.Config {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*tls.Config{}, reloaded...)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "certs")
+		Expect(err).ToNot(HaveOccurred())
+		caPath = filepath.Join(dir, "ca.crt")
+		certPath = filepath.Join(dir, "tls.crt")
+		keyPath = filepath.Join(dir, "tls.key")
+
+		ca = newTestCA()
+		cert, key, _ := ca.issue(2, time.Now().Add(time.Hour))
+		Expect(ioutil.WriteFile(caPath, ca.pem, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(certPath, cert, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(keyPath, key, 0600)).To(Succeed())
+
+		watcher, err = NewCertWatcher(config.LoggregatorOptions{CAPath: caPath, CertPath: certPath, KeyPath: keyPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		reloaded = nil
+		watcher.Subscribe(func(c *tls.Config) {
+			mu.Lock()
+			defer mu.Unlock()
+			reloaded = append(reloaded, c)
+		})
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan struct{})
+		go func(w *CertWatcher, done chan struct{}) {
+			defer close(done)
+			Expect(w.Run(ctx)).To(Succeed())
+		}(watcher, done)
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(BeClosed())
+		os.RemoveAll(dir)
+	})
+
+	It("builds the TLS config from the files", func() {
+		Expect(watcher.TLSConfig()).ToNot(BeNil())
+		Expect(watcher.TLSConfig().Certificates).To(HaveLen(1))
+	})
+
+	It("rebuilds the TLS config when the certificates are rotated", func() {
+		cert, key, der := ca.issue(3, time.Now().Add(2*time.Hour))
+		writeAtomically(keyPath, key)
+		writeAtomically(certPath, cert)
+
+		Eventually(reloads).Should(HaveLen(1))
+		Expect(reloads()[0].Certificates[0].Certificate[0]).To(Equal(der))
+		Expect(watcher.TLSConfig()).To(Equal(reloads()[0]))
+	})
+
+	It("keeps the current TLS config when the new files are invalid", func() {
+		previous := watcher.TLSConfig()
+		_, otherKey, _ := ca.issue(4, time.Now().Add(time.Hour))
+		writeAtomically(keyPath, otherKey)
+
+		Consistently(reloads, 200*time.Millisecond).Should(BeEmpty())
+		Expect(watcher.TLSConfig()).To(Equal(previous))
+	})
+
+	Describe("Update", func() {
+		It("switches to the new destination and notifies the subscribers", func() {
+			otherDir, err := ioutil.TempDir("", "certs")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(otherDir)
+			cert, key, der := ca.issue(5, time.Now().Add(time.Hour))
+			opts := config.LoggregatorOptions{
+				Endpoint:   "other-doppler:8082",
+				CAPath:     caPath,
+				CertPath:   filepath.Join(otherDir, "tls.crt"),
+				KeyPath:    filepath.Join(otherDir, "tls.key"),
+				ServerName: "other",
+			}
+			Expect(ioutil.WriteFile(opts.CertPath, cert, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(opts.KeyPath, key, 0600)).To(Succeed())
+
+			Expect(watcher.Update(opts)).To(Succeed())
+			Expect(reloads()).To(HaveLen(1))
+			Expect(reloads()[0].ServerName).To(Equal("other"))
+			Expect(reloads()[0].Certificates[0].Certificate[0]).To(Equal(der))
+			Expect(watcher.Endpoint()).To(Equal("other-doppler:8082"))
+
+			By("watching the new certificates")
+			cert, key, der = ca.issue(6, time.Now().Add(2*time.Hour))
+			writeAtomically(opts.KeyPath, key)
+			writeAtomically(opts.CertPath, cert)
+			Eventually(reloads).Should(HaveLen(2))
+			Expect(reloads()[1].Certificates[0].Certificate[0]).To(Equal(der))
+		})
+
+		It("keeps the current destination when the new one is invalid", func() {
+			previous := watcher.TLSConfig()
+			err := watcher.Update(config.LoggregatorOptions{Endpoint: "other-doppler:8082", CAPath: caPath, CertPath: certPath, KeyPath: caPath})
+			Expect(err).To(HaveOccurred())
+			Expect(reloads()).To(BeEmpty())
+			Expect(watcher.TLSConfig()).To(Equal(previous))
+			Expect(watcher.Endpoint()).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("EnvelopeQueue.SetSink", func() {
+	It("flushes the previous sink and keeps the queued envelopes", func() {
+		pool := NewSenderPool(1)
+		defer pool.Stop()
+
+		gated := &gatedEmitter{gate: make(chan struct{})}
+		q := pool.NewQueue(gated, defaultBackpressure)
+		q.Emit(logEnvelope("1"))
+		Eventually(q.Len).Should(BeZero())
+		q.Emit(logEnvelope("2"))
+
+		next := &closingEmitter{}
+		swapped := make(chan struct{})
+		go func() {
+			defer close(swapped)
+			q.SetSink(next)
+		}()
+		close(gated.gate)
+		Eventually(swapped).Should(BeClosed())
+		q.Emit(logEnvelope("3"))
+
+		Eventually(func() []string {
+			return append(gated.payloads(), next.payloads()...)
+		}).Should(Equal([]string{"1", "2", "3"}))
+		Expect(next.payloads()).To(ContainElement("3"))
+	})
+
+	It("closes the previous sink", func() {
+		pool := NewSenderPool(1)
+		defer pool.Stop()
+
+		previous := &closingEmitter{}
+		q := pool.NewQueue(previous, defaultBackpressure)
+		q.SetSink(&fakeEmitter{})
+		Expect(previous.isClosed()).To(BeTrue())
+
+		q.Emit(&loggregator_v2.Envelope{})
+	})
+})
@@ -0,0 +1,122 @@
+package podwatcher
+
+import (
+	"context"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/cloudcontroller"
+	eirinix "code.cloudfoundry.org/eirinix"
+)
+
+// Pod labels and annotations of the CF metadata set by Eirini. Each of them
+// is looked up in the labels first, then in the annotations.
+const (
+	LabelOrgGUID   = "cloudfoundry.org/org_guid"
+	LabelOrgName   = "cloudfoundry.org/org_name"
+	LabelSpaceGUID = "cloudfoundry.org/space_guid"
+	LabelSpaceName = "cloudfoundry.org/space_name"
+	LabelAppID     = "cloudfoundry.org/application_id"
+	LabelAppName   = "cloudfoundry.org/application_name"
+)
+
+// CF tags of the envelopes, as set by Diego
+const (
+	TagOrganizationID   = "organization_id"
+	TagOrganizationName = "organization_name"
+	TagSpaceID          = "space_id"
+	TagSpaceName        = "space_name"
+	TagAppID            = "app_id"
+	TagAppName          = "app_name"
+	TagProcessType      = "process_type"
+)
+
+// CFMetadata is the CF org, space, app and process of a pod
+type CFMetadata struct {
+	OrganizationID, OrganizationName string
+	SpaceID, SpaceName               string
+	AppID, AppName                   string
+	ProcessType                      string
+}
+
+// CFMetadataFromPod returns the CF metadata found in the pod labels and
+// annotations. The app id defaults to the app guid label.
+func CFMetadataFromPod(labels, annotations map[string]string) CFMetadata {
+	lookup := func(key string) string { return podValue(labels, annotations, key) }
+	m := CFMetadata{
+		OrganizationID:   lookup(LabelOrgGUID),
+		OrganizationName: lookup(LabelOrgName),
+		SpaceID:          lookup(LabelSpaceGUID),
+		SpaceName:        lookup(LabelSpaceName),
+		AppID:            lookup(LabelAppID),
+		AppName:          lookup(LabelAppName),
+		ProcessType:      lookup(eirinix.LabelProcessType),
+	}
+	if m.AppID == "" {
+		m.AppID = labels[eirinix.LabelAppGUID]
+	}
+	return m
+}
+
+// podValue returns the value of the label, or else of the annotation
+func podValue(labels, annotations map[string]string, key string) string {
+	if v, ok := labels[key]; ok {
+		return v
+	}
+	return annotations[key]
+}
+
+// Tags returns the envelope tags of the metadata which is known
+func (m CFMetadata) Tags() map[string]string {
+	tags := map[string]string{}
+	for name, value := range map[string]string{
+		TagOrganizationID:   m.OrganizationID,
+		TagOrganizationName: m.OrganizationName,
+		TagSpaceID:          m.SpaceID,
+		TagSpaceName:        m.SpaceName,
+		TagAppID:            m.AppID,
+		TagAppName:          m.AppName,
+		TagProcessType:      m.ProcessType,
+	} {
+		if value != "" {
+			tags[name] = value
+		}
+	}
+	return tags
+}
+
+// complete returns true if nothing is left to look up
+func (m CFMetadata) complete() bool {
+	return m.OrganizationID != "" && m.OrganizationName != "" &&
+		m.SpaceID != "" && m.SpaceName != "" &&
+		m.AppID != "" && m.AppName != ""
+}
+
+// ResolveCFMetadata fills the CF metadata missing from the pod with the app
+// found in the Cloud Controller. The metadata is left as is when the client
+// is nil or the lookup fails. It is safe to call while the container is
+// tailed: the envelopes get the new tags once the lookup returns.
+func (c *Container) ResolveCFMetadata(ctx context.Context, client *cloudcontroller.Client) {
+	m := c.AppMeta.CFMeta()
+	if client == nil || m.complete() {
+		return
+	}
+	app, err := client.App(ctx, c.AppMeta.SourceID)
+	if err != nil {
+		return
+	}
+	for _, field := range []struct {
+		value *string
+		found string
+	}{
+		{&m.OrganizationID, app.OrganizationID},
+		{&m.OrganizationName, app.OrganizationName},
+		{&m.SpaceID, app.SpaceID},
+		{&m.SpaceName, app.SpaceName},
+		{&m.AppID, app.ID},
+		{&m.AppName, app.Name},
+	} {
+		if *field.value == "" {
+			*field.value = field.found
+		}
+	}
+	c.AppMeta.SetCFMeta(m)
+}
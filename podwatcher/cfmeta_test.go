@@ -0,0 +1,97 @@
+package podwatcher_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/cloudcontroller"
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CFMetadata", func() {
+	It("reads the metadata from the labels, then the annotations", func() {
+		m := CFMetadataFromPod(map[string]string{
+			eirinix.LabelAppGUID:     "app-guid",
+			eirinix.LabelProcessType: "web",
+			LabelOrgGUID:             "org-guid",
+		}, map[string]string{
+			LabelOrgGUID:   "ignored",
+			LabelOrgName:   "org",
+			LabelSpaceGUID: "space-guid",
+			LabelSpaceName: "space",
+			LabelAppID:     "app-id",
+			LabelAppName:   "app",
+		})
+		Expect(m).To(Equal(CFMetadata{
+			OrganizationID: "org-guid", OrganizationName: "org",
+			SpaceID: "space-guid", SpaceName: "space",
+			AppID: "app-id", AppName: "app",
+			ProcessType: "web",
+		}))
+	})
+
+	It("defaults the app id to the app guid", func() {
+		m := CFMetadataFromPod(map[string]string{eirinix.LabelAppGUID: "app-guid"}, nil)
+		Expect(m.AppID).To(Equal("app-guid"))
+		Expect(m.Tags()).To(Equal(map[string]string{TagAppID: "app-guid"}))
+	})
+
+	It("sets the tags of the envelopes", func() {
+		meta := &LoggregatorAppMeta{SourceID: "app-guid", CF: CFMetadata{OrganizationName: "org", SpaceName: "space", AppName: "app", ProcessType: "web"}}
+		meta.Tags = map[string]string{TagAppName: "from-label"}
+		e := NewLoggregator(nil, meta, nil, config.LoggregatorOptions{}).Envelope([]byte("hello"), loggregator_v2.Log_OUT)
+		Expect(e.Tags).To(HaveKeyWithValue(TagOrganizationName, "org"))
+		Expect(e.Tags).To(HaveKeyWithValue(TagSpaceName, "space"))
+		Expect(e.Tags).To(HaveKeyWithValue(TagAppName, "app"))
+		Expect(e.Tags).To(HaveKeyWithValue(TagProcessType, "web"))
+		Expect(e.Tags).ToNot(HaveKey(TagOrganizationID))
+	})
+
+	Describe("ResolveCFMetadata", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/oauth/token" {
+					fmt.Fprint(w, `{"access_token":"token","expires_in":3600}`)
+					return
+				}
+				fmt.Fprint(w, `{
+					"guid": "app-guid", "name": "cc-app",
+					"relationships": {"space": {"data": {"guid": "space-guid"}}},
+					"included": {
+						"spaces": [{"guid": "space-guid", "name": "cc-space", "relationships": {"organization": {"data": {"guid": "org-guid"}}}}],
+						"organizations": [{"guid": "org-guid", "name": "cc-org"}]
+					}
+				}`)
+			}))
+		})
+		AfterEach(func() { server.Close() })
+
+		It("fills the metadata missing from the pod", func() {
+			client, err := cloudcontroller.NewClient(config.CloudControllerOptions{URL: server.URL, UAAURL: server.URL, ClientID: "bridge"})
+			Expect(err).ToNot(HaveOccurred())
+			c := &Container{AppMeta: &LoggregatorAppMeta{SourceID: "app-guid", CF: CFMetadata{AppID: "app-guid", AppName: "pod-app", ProcessType: "web"}}}
+			c.ResolveCFMetadata(context.Background(), client)
+			Expect(c.AppMeta.CF).To(Equal(CFMetadata{
+				OrganizationID: "org-guid", OrganizationName: "cc-org",
+				SpaceID: "space-guid", SpaceName: "cc-space",
+				AppID: "app-guid", AppName: "pod-app",
+				ProcessType: "web",
+			}))
+		})
+
+		It("leaves the metadata as is without a client", func() {
+			c := &Container{AppMeta: &LoggregatorAppMeta{SourceID: "app-guid"}}
+			c.ResolveCFMetadata(context.Background(), nil)
+			Expect(c.AppMeta.CF).To(Equal(CFMetadata{}))
+		})
+	})
+})
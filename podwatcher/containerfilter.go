@@ -0,0 +1,41 @@
+package podwatcher
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// Pod annotations overriding the global container lists for a pod, the
+// names are comma separated
+const (
+	AnnotationIncludeContainers = AnnotationPrefix + "include-containers"
+	AnnotationExcludeContainers = AnnotationPrefix + "exclude-containers"
+)
+
+// ContainerFilterFromAnnotations returns the container lists of a pod, the
+// annotations which are set replace the global lists.
+func ContainerFilterFromAnnotations(global config.ContainerFilterOptions, annotations map[string]string) (config.ContainerFilterOptions, error) {
+	opts := global
+	if v, ok := annotations[AnnotationIncludeContainers]; ok {
+		opts.Include = splitNames(v)
+	}
+	if v, ok := annotations[AnnotationExcludeContainers]; ok {
+		opts.Exclude = splitNames(v)
+	}
+
+	if err := opts.Validate(); err != nil {
+		return global, err
+	}
+	return opts, nil
+}
+
+func splitNames(v string) []string {
+	names := []string{}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,27 @@
+package podwatcher_test
+
+import (
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ContainerFilterFromAnnotations", func() {
+	global := config.ContainerFilterOptions{Exclude: []string{"istio-proxy"}}
+
+	It("replaces the global lists", func() {
+		opts, err := ContainerFilterFromAnnotations(global, map[string]string{
+			AnnotationIncludeContainers: "opi, opi-task-*",
+			AnnotationExcludeContainers: "",
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts).To(Equal(config.ContainerFilterOptions{Include: []string{"opi", "opi-task-*"}, Exclude: []string{}}))
+	})
+
+	It("keeps the global lists when an annotation is invalid", func() {
+		opts, err := ContainerFilterFromAnnotations(global, map[string]string{AnnotationExcludeContainers: "*"})
+		Expect(err).To(HaveOccurred())
+		Expect(opts).To(Equal(global))
+	})
+})
@@ -0,0 +1,361 @@
+package podwatcher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+)
+
+// DefaultPodLogDir is where kubelet stores the container logs on the node
+const DefaultPodLogDir = "/var/log/pods"
+
+// CRIPollInterval is how often a CRI log file is checked for new lines,
+// rotation or a container restart once its end is reached.
+var CRIPollInterval = 250 * time.Millisecond
+
+// CRI log tags, see https://github.com/kubernetes/kubernetes/blob/master/pkg/kubelet/kuberuntime/logs/logs.go
+const (
+	criTagPartial = "P"
+	criTagFull    = "F"
+)
+
+var criLogFileRegexp = regexp.MustCompile(`^(\d+)\.log$`)
+
+// CRILine is a parsed line of a CRI log file, e.g.
+// 2016-10-06T00:17:09.669794202Z stdout F log content
+type CRILine struct {
+	Timestamp time.Time
+	Stream    string
+	Partial   bool
+	Content   []byte
+	// Continuation is true if the line continues the previous one, which
+	// was handed over before its end because exceeding the max line size
+	Continuation bool
+}
+
+// ParseCRILine parses a single line (without the trailing newline) of a CRI log file
+func ParseCRILine(line []byte) (*CRILine, error) {
+	fields := bytes.SplitN(line, []byte(" "), 4)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid CRI log line: %q", line)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, string(fields[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRI log timestamp: %s", err.Error())
+	}
+
+	l := &CRILine{Timestamp: timestamp, Stream: string(fields[1])}
+	switch string(fields[2]) {
+	case criTagPartial:
+		l.Partial = true
+	case criTagFull:
+	default:
+		return nil, fmt.Errorf("invalid CRI log tag: %q", fields[2])
+	}
+	if len(fields) == 4 {
+		l.Content = fields[3]
+	}
+
+	return l, nil
+}
+
+// PodLogDir returns the directory where kubelet writes the logs of a container
+// e.g. /var/log/pods/<namespace>_<pod>_<uid>/<container>
+func PodLogDir(root, namespace, pod, podUID, container string) string {
+	return filepath.Join(root, fmt.Sprintf("%s_%s_%s", namespace, pod, podUID), container)
+}
+
+// latestCRILogFile returns the log file of the latest container run in dir,
+// kubelet names them after the restart count (0.log, 1.log, ...)
+func latestCRILogFile(dir string) (string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	latest, latestRun := "", -1
+	for _, f := range files {
+		m := criLogFileRegexp.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		run, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		if run > latestRun {
+			latest, latestRun = filepath.Join(dir, f.Name()), run
+		}
+	}
+	if latest == "" {
+		return "", os.ErrNotExist
+	}
+	return latest, nil
+}
+
+// CRIFileTailer follows the CRI log files of a container, handling rotations
+// (by tracking the inode of the open file), truncations and restarts of the
+// container. Partial lines are reassembled before being handed to the
+// handler.
+type CRIFileTailer struct {
+	Dir     string
+	Handler func(*CRILine) error
+	// MaxLineSize limits the size of the reassembled partial lines, longer
+	// ones are handed over in pieces. Zero means no limit.
+	MaxLineSize int
+	// Positions, when set, records how far the files are read, and the
+	// reading resumes from there
+	Positions *LogPositions
+
+	path    string
+	head    []byte
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	reader  *bufio.Reader
+	pending []byte
+	partial *CRILine
+}
+
+// NewCRIFileTailer returns a CRIFileTailer for the container log directory dir
+func NewCRIFileTailer(dir string, handler func(*CRILine) error) *CRIFileTailer {
+	return &CRIFileTailer{Dir: dir, Handler: handler}
+}
+
+// Run follows the log files until ctx is done. When that happens, the lines
+// which are already written are still read before returning.
+func (t *CRIFileTailer) Run(ctx context.Context) error {
+	defer t.close()
+
+	for {
+		stopping := ctx.Err() != nil
+
+		if t.file == nil {
+			if err := t.openLatest(); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if t.file != nil {
+			if err := t.drain(); err != nil {
+				return err
+			}
+			switched, err := t.checkRotation()
+			if err != nil {
+				return err
+			}
+			if switched {
+				continue
+			}
+		}
+
+		if stopping {
+			return t.flushPartial()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(CRIPollInterval):
+		}
+	}
+}
+
+func (t *CRIFileTailer) openLatest() error {
+	path, err := latestCRILogFile(t.Dir)
+	if err != nil {
+		return err
+	}
+	return t.open(path)
+}
+
+func (t *CRIFileTailer) open(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	t.close()
+	t.path, t.file, t.info, t.offset = path, f, info, 0
+	t.head = nil
+	t.reader = bufio.NewReader(f)
+	t.pending = nil
+	t.resume()
+	return nil
+}
+
+// resume skips the part of the file which was already read, unless the file
+// was replaced or truncated since
+func (t *CRIFileTailer) resume() {
+	if t.Positions == nil {
+		return
+	}
+	pos, ok := t.Positions.Get(t.path)
+	if !ok || pos.Inode != fileInode(t.info) || pos.Offset > t.info.Size() || !bytes.Equal(t.readHead(len(pos.Head)), pos.Head) {
+		return
+	}
+	if _, err := t.file.Seek(pos.Offset, io.SeekStart); err != nil {
+		LogWarn(t.path, ": reading from the start: ", err.Error())
+		return
+	}
+	t.offset = pos.Offset
+	t.reader.Reset(t.file)
+}
+
+// readHead returns the first n bytes of the file, less if it is shorter
+func (t *CRIFileTailer) readHead(n int) []byte {
+	head := make([]byte, n)
+	read, _ := t.file.ReadAt(head, 0)
+	return head[:read]
+}
+
+func (t *CRIFileTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// drain reads the open file until its current end
+func (t *CRIFileTailer) drain() error {
+	for {
+		data, err := t.reader.ReadBytes('\n')
+		t.offset += int64(len(data))
+		if err == io.EOF {
+			// Keep the incomplete line until the rest of it is written
+			t.pending = append(t.pending, data...)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line := append(t.pending, data[:len(data)-1]...)
+		t.pending = nil
+		if err := t.handle(line); err != nil {
+			return err
+		}
+		// A partial line is read again on resume, as it isn't sent yet
+		if t.Positions != nil && t.partial == nil {
+			if len(t.head) < logPositionHeadSize && int64(len(t.head)) < t.offset {
+				t.head = t.readHead(logPositionHeadSize)
+			}
+			t.Positions.Set(t.path, LogPosition{Inode: fileInode(t.info), Head: t.head, Offset: t.offset})
+		}
+	}
+}
+
+// checkRotation switches to a new log file if the one we follow was rotated
+// or the container restarted, and rewinds it if it was truncated.
+// It returns true if the file was switched.
+func (t *CRIFileTailer) checkRotation() (bool, error) {
+	path, err := latestCRILogFile(t.Dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !os.SameFile(t.info, info) {
+		// Lines could have been written between the last drain and the
+		// rotation, read them before leaving the old file
+		if err := t.drain(); err != nil {
+			return false, err
+		}
+		if err := t.flushPending(); err != nil {
+			return false, err
+		}
+		return true, t.open(path)
+	}
+
+	if info.Size() < t.offset {
+		if err := t.flushPending(); err != nil {
+			return false, err
+		}
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		t.offset = 0
+		t.reader.Reset(t.file)
+		t.head = nil
+	}
+	return false, nil
+}
+
+func (t *CRIFileTailer) handle(raw []byte) error {
+	line, err := ParseCRILine(raw)
+	if err != nil {
+		LogWarn(t.Dir, ": skipping line: ", err.Error())
+		return nil
+	}
+
+	if t.partial != nil {
+		if t.partial.Stream == line.Stream {
+			line.Content = append(t.partial.Content, line.Content...)
+			line.Timestamp = t.partial.Timestamp
+			line.Continuation = t.partial.Continuation
+		} else if len(t.partial.Content) > 0 {
+			// A different stream can't continue the partial line
+			if err := t.Handler(t.partial); err != nil {
+				return err
+			}
+		}
+		t.partial = nil
+	}
+
+	if line.Partial {
+		t.partial = line
+		if t.MaxLineSize > 0 && len(line.Content) >= t.MaxLineSize {
+			t.partial = &CRILine{Stream: line.Stream, Timestamp: line.Timestamp, Partial: true, Continuation: true}
+			return t.Handler(line)
+		}
+		return nil
+	}
+	return t.Handler(line)
+}
+
+// flushPending hands over the incomplete last line of a file which won't be
+// written anymore, as it was rotated or truncated. A partial line is then
+// continued by the next file.
+func (t *CRIFileTailer) flushPending() error {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	line := t.pending
+	t.pending = nil
+	return t.handle(line)
+}
+
+// flushPartial hands over a partial line which will never be completed
+func (t *CRIFileTailer) flushPartial() error {
+	if t.partial == nil || len(t.partial.Content) == 0 {
+		return nil
+	}
+	line := t.partial
+	t.partial = nil
+	return t.Handler(line)
+}
@@ -0,0 +1,280 @@
+package podwatcher_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type criLines struct {
+	sync.Mutex
+	lines []CRILine
+}
+
+func (c *criLines) handle(l *CRILine) error {
+	c.Lock()
+	defer c.Unlock()
+	c.lines = append(c.lines, *l)
+	return nil
+}
+
+func (c *criLines) contents() []string {
+	c.Lock()
+	defer c.Unlock()
+	r := []string{}
+	for _, l := range c.lines {
+		r = append(r, string(l.Content))
+	}
+	return r
+}
+
+func appendFile(path, content string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+	_, err = f.WriteString(content)
+	Expect(err).ToNot(HaveOccurred())
+}
+
+var _ = Describe("CRI log files", func() {
+	Describe("ParseCRILine", func() {
+		It("parses a full line", func() {
+			l, err := ParseCRILine([]byte("2016-10-06T00:17:09.669794202Z stdout F log content"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l.Stream).To(Equal("stdout"))
+			Expect(l.Partial).To(BeFalse())
+			Expect(string(l.Content)).To(Equal("log content"))
+			Expect(l.Timestamp.UnixNano()).To(Equal(int64(1475713029669794202)))
+		})
+
+		It("parses a partial line", func() {
+			l, err := ParseCRILine([]byte("2016-10-06T00:17:09.669794202Z stderr P log "))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l.Stream).To(Equal("stderr"))
+			Expect(l.Partial).To(BeTrue())
+			Expect(string(l.Content)).To(Equal("log "))
+		})
+
+		It("parses an empty line", func() {
+			l, err := ParseCRILine([]byte("2016-10-06T00:17:09.669794202Z stdout F"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l.Content).To(BeEmpty())
+		})
+
+		It("fails on invalid lines", func() {
+			_, err := ParseCRILine([]byte("not a cri line"))
+			Expect(err).To(HaveOccurred())
+			_, err = ParseCRILine([]byte("2016-10-06T00:17:09.669794202Z stdout X log"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("PodLogDir", func() {
+		It("returns the kubelet log directory of the container", func() {
+			Expect(PodLogDir("/var/log/pods", "eirini", "app-0", "poduid", "opi")).To(Equal("/var/log/pods/eirini_app-0_poduid/opi"))
+		})
+	})
+
+	Describe("CRIFileTailer", func() {
+		var (
+			lines  *criLines
+			ctx    context.Context
+			cancel context.CancelFunc
+			done   chan error
+		)
+
+		CRIPollInterval = 10 * time.Millisecond
+
+		BeforeEach(func() {
+			lines = &criLines{}
+			ctx, cancel = context.WithCancel(context.Background())
+			done = make(chan error, 1)
+		})
+
+		AfterEach(func() { cancel() })
+
+		run := func(dir string) {
+			tailer, ctx, done := NewCRIFileTailer(dir, lines.handle), ctx, done
+			go func() { done <- tailer.Run(ctx) }()
+		}
+
+		Context("when reading the fixture log directory", func() {
+			It("reads the lines of the current log file and reassembles the partial ones", func() {
+				cancel()
+				err := NewCRIFileTailer(PodLogDir("fixtures/pods", "eirini", "ruby-app-tmp-c6858e2e56-0", "poduid", "opi"), lines.handle).Run(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(lines.contents()).To(Equal([]string{
+					"Starting app",
+					"this line was split by the runtime",
+					"something failed",
+					"",
+					"done",
+				}))
+				Expect(lines.lines[1].Timestamp.Nanosecond()).To(Equal(2))
+				Expect(lines.lines[2].Stream).To(Equal("stderr"))
+			})
+		})
+
+		Context("when partial lines exceed the max line size", func() {
+			It("hands them over in pieces", func() {
+				cancel()
+				dir, err := ioutil.TempDir("", "crilog")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.RemoveAll(dir)
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout P 0123456789\n"+
+					"2020-10-19T10:00:00Z stdout P 0123456789\n"+
+					"2020-10-19T10:00:00Z stdout F 01234\n")
+
+				tailer := NewCRIFileTailer(dir, lines.handle)
+				tailer.MaxLineSize = 16
+				Expect(tailer.Run(ctx)).To(Succeed())
+				Expect(lines.contents()).To(Equal([]string{"01234567890123456789", "01234"}))
+				Expect(lines.lines[1].Continuation).To(BeTrue())
+			})
+		})
+
+		Context("when the log positions are recorded", func() {
+			var dir string
+
+			BeforeEach(func() {
+				cancel()
+				var err error
+				dir, err = ioutil.TempDir("", "crilog")
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() { os.RemoveAll(dir) })
+
+			It("resumes where the previous tail stopped", func() {
+				positions, err := NewLogPositions(filepath.Join(dir, "positions.json"))
+				Expect(err).ToNot(HaveOccurred())
+				logDir := filepath.Join(dir, "opi")
+				Expect(os.Mkdir(logDir, 0755)).To(Succeed())
+				appendFile(filepath.Join(logDir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n"+
+					"2020-10-19T10:00:00Z stdout P sec")
+
+				tailer := NewCRIFileTailer(logDir, lines.handle)
+				tailer.Positions = positions
+				Expect(tailer.Run(ctx)).To(Succeed())
+				Expect(positions.Save()).To(Succeed())
+
+				appendFile(filepath.Join(logDir, "0.log"), "\n2020-10-19T10:00:01Z stdout F ond\n")
+				// As after a restart of the bridge
+				positions, err = NewLogPositions(filepath.Join(dir, "positions.json"))
+				Expect(err).ToNot(HaveOccurred())
+				tailer = NewCRIFileTailer(logDir, lines.handle)
+				tailer.Positions = positions
+				Expect(tailer.Run(ctx)).To(Succeed())
+
+				Expect(lines.contents()).To(Equal([]string{"first", "second"}))
+			})
+
+			It("reads a replaced log file from the start", func() {
+				positions, err := NewLogPositions("")
+				Expect(err).ToNot(HaveOccurred())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				tailer := NewCRIFileTailer(dir, lines.handle)
+				tailer.Positions = positions
+				Expect(tailer.Run(ctx)).To(Succeed())
+
+				Expect(os.Remove(filepath.Join(dir, "0.log"))).To(Succeed())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:01Z stdout F again\n")
+				tailer = NewCRIFileTailer(dir, lines.handle)
+				tailer.Positions = positions
+				Expect(tailer.Run(ctx)).To(Succeed())
+
+				Expect(lines.contents()).To(Equal([]string{"first", "again"}))
+			})
+		})
+
+		Context("when following a log file", func() {
+			var dir string
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "crilog")
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() { os.RemoveAll(dir) })
+
+			It("waits for the log file to be created", func() {
+				run(dir)
+				Consistently(lines.contents, "50ms").Should(BeEmpty())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+			})
+
+			It("waits for incomplete lines to be written", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F fir")
+				run(dir)
+				Consistently(lines.contents, "50ms").Should(BeEmpty())
+				appendFile(filepath.Join(dir, "0.log"), "st\n")
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+			})
+
+			It("follows the rotated log file", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				run(dir)
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:01Z stdout F second\n")
+				Expect(os.Rename(filepath.Join(dir, "0.log"), filepath.Join(dir, "0.log.20201019-100001"))).To(Succeed())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:02Z stdout F third\n")
+
+				Eventually(lines.contents).Should(Equal([]string{"first", "second", "third"}))
+			})
+
+			It("keeps the unterminated last line of the rotated log file", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				run(dir)
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:01Z stdout F second\n2020-10-19T10:00:01Z stdout P thi")
+				Eventually(lines.contents).Should(Equal([]string{"first", "second"}))
+				Expect(os.Rename(filepath.Join(dir, "0.log"), filepath.Join(dir, "0.log.20201019-100001"))).To(Succeed())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:02Z stdout F rd\n")
+
+				Eventually(lines.contents).Should(Equal([]string{"first", "second", "third"}))
+			})
+
+			It("rewinds a truncated log file", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				run(dir)
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+
+				Expect(os.Truncate(filepath.Join(dir, "0.log"), 0)).To(Succeed())
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:01Z stdout F 2nd\n")
+
+				Eventually(lines.contents).Should(Equal([]string{"first", "2nd"}))
+			})
+
+			It("switches to the log file of the restarted container", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first run\n")
+				run(dir)
+				Eventually(lines.contents).Should(Equal([]string{"first run"}))
+
+				appendFile(filepath.Join(dir, "1.log"), "2020-10-19T10:00:01Z stdout F second run\n")
+				Eventually(lines.contents).Should(Equal([]string{"first run", "second run"}))
+			})
+
+			It("reads the remaining lines when stopped", func() {
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:00Z stdout F first\n")
+				run(dir)
+				Eventually(lines.contents).Should(Equal([]string{"first"}))
+
+				appendFile(filepath.Join(dir, "0.log"), "2020-10-19T10:00:01Z stdout F last \n2020-10-19T10:00:01Z stdout P unterminated\n")
+				cancel()
+				Eventually(done).Should(Receive(BeNil()))
+				Expect(lines.contents()).To(Equal([]string{"first", "last ", "unterminated"}))
+			})
+		})
+	})
+})
@@ -5,8 +5,11 @@ import (
 	"errors"
 	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
 	eirinix "code.cloudfoundry.org/eirinix"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
@@ -23,6 +26,22 @@ const (
 	DefaultSuccessGracePeriod          = "5"
 )
 
+// defaultTerminationGracePeriod is the termination grace period of the pods
+// which don't set it
+const defaultTerminationGracePeriod = 30
+
+// The grace-wrapper binary of the binary strategy is copied by an init
+// container into a volume shared with the wrapped containers
+const (
+	// GraceWrapperImagePath is where the binary is in the wrapper image
+	GraceWrapperImagePath = "/bin/grace-wrapper"
+
+	graceWrapperVolume    = "eirini-grace-wrapper"
+	graceWrapperDir       = "/eirini-grace-wrapper"
+	graceWrapperPath      = graceWrapperDir + "/grace-wrapper"
+	graceWrapperInstaller = "eirini-grace-wrapper-install"
+)
+
 // GraceOptions lets customize the graceful periods and
 // the entrypoint of the images which are mutated to inject
 // the grace period logic
@@ -35,16 +54,41 @@ type GraceOptions struct {
 	RuntimeEntrypoint           string
 
 	GraceImageContainsString string
+
+	// Strategies maps the containers to config.GraceStrategyPreStop (regular
+	// containers only), config.GraceStrategyBinary or
+	// config.GraceStrategyWrapper (the default)
+	Strategies map[string]string
+	// WrapperImage is the image shipping the grace-wrapper binary at
+	// GraceWrapperImagePath, for the binary strategy. When set, the preStop
+	// sleeps are run by the binary too.
+	WrapperImage string
 }
 
 // Extension changes pod definitions
 type Extension struct {
 	Logger  *zap.SugaredLogger
 	Options GraceOptions
+
+	// mu guards Options, which can be changed by SetOptions while serving
+	mu sync.RWMutex
 }
 
 // NewGracePeriodInjector returns the podwatcher extension which injects a grace Period on Eirini generated pods
 func NewGracePeriodInjector(opts *GraceOptions) *Extension {
+	setGraceDefaults(opts)
+	return &Extension{Options: *opts}
+}
+
+// SetOptions changes the grace periods and entrypoints of the next mutated pods
+func (ext *Extension) SetOptions(opts GraceOptions) {
+	setGraceDefaults(&opts)
+	ext.mu.Lock()
+	defer ext.mu.Unlock()
+	ext.Options = opts
+}
+
+func setGraceDefaults(opts *GraceOptions) {
 	if len(opts.StagingExecutorEntrypoint) == 0 {
 		opts.StagingExecutorEntrypoint = DefaultStagingExecutorEntrypoint
 	}
@@ -68,8 +112,6 @@ func NewGracePeriodInjector(opts *GraceOptions) *Extension {
 	if len(opts.SuccessGracePeriod) == 0 {
 		opts.SuccessGracePeriod = DefaultSuccessGracePeriod
 	}
-
-	return &Extension{Options: *opts}
 }
 
 // Handle injects gracefulPeriod in opi containers:
@@ -88,31 +130,150 @@ func (ext *Extension) Handle(ctx context.Context, eiriniManager eirinix.Manager,
 	log := eiriniManager.GetLogger().Named(file)
 
 	ext.Logger = log
+	ext.mu.RLock()
+	opts := ext.Options
+	ext.mu.RUnlock()
 	podCopy := pod.DeepCopy()
 	log.Debugf("Handling webhook request for POD: %s (%s)", podCopy.Name, podCopy.Namespace)
+	// The grace-wrapper binary is installed for the binary strategy, and for
+	// the preStop sleep when its image is set
+	installWrapper := false
 	for i := range podCopy.Spec.InitContainers {
 		c := &podCopy.Spec.InitContainers[i]
+		var entrypoint string
 		switch c.Name {
-		case "opi-task-downloader":
-			c.Command = []string{"/bin/sh", "-c", "( " + ext.Options.StagingDownloaderEntrypoint + " && sleep " + ext.Options.SuccessGracePeriod + " ) || sleep " + ext.Options.FailGracePeriod + ""}
-		case "opi-task-executor":
-			c.Command = []string{"/bin/sh", "-c", "( " + ext.Options.StagingExecutorEntrypoint + " && sleep " + ext.Options.SuccessGracePeriod + " ) || sleep " + ext.Options.FailGracePeriod + ""}
+		case config.GraceContainerDownloader:
+			entrypoint = opts.StagingDownloaderEntrypoint
+		case config.GraceContainerExecutor:
+			entrypoint = opts.StagingExecutorEntrypoint
+		default:
+			continue
 		}
+
+		if opts.Strategies[c.Name] == config.GraceStrategyBinary {
+			useGraceWrapper(c, entrypoint, opts)
+			installWrapper = true
+			continue
+		}
+		c.Command = []string{"/bin/sh", "-c", "( " + entrypoint + " && sleep " + opts.SuccessGracePeriod + " ) || sleep " + opts.FailGracePeriod + ""}
 	}
 
+	preStop := false
 	for i := range podCopy.Spec.Containers {
 		c := &podCopy.Spec.Containers[i]
+		var entrypoint string
+		var command []string
 		switch c.Name {
-		case "opi":
-			if len(ext.Options.GraceImageContainsString) > 0 &&
-				!strings.Contains(c.Image, ext.Options.GraceImageContainsString) {
+		case config.GraceContainerRuntime:
+			if len(opts.GraceImageContainsString) > 0 &&
+				!strings.Contains(c.Image, opts.GraceImageContainsString) {
 				continue
 			}
-			c.Command = []string{"dumb-init", "--", "/bin/sh", "-c", "(  " + ext.Options.RuntimeEntrypoint + " && sleep " + ext.Options.SuccessGracePeriod + " ) || sleep " + ext.Options.FailGracePeriod}
-		case "opi-task-uploader":
-			c.Command = []string{"/bin/sh", "-c", "( " + ext.Options.StagingUploaderEntrypoint + " && sleep " + ext.Options.SuccessGracePeriod + " ) || sleep " + ext.Options.FailGracePeriod}
+			entrypoint = opts.RuntimeEntrypoint
+			command = []string{"dumb-init", "--", "/bin/sh", "-c", "(  " + entrypoint + " && sleep " + opts.SuccessGracePeriod + " ) || sleep " + opts.FailGracePeriod}
+		case config.GraceContainerUploader:
+			entrypoint = opts.StagingUploaderEntrypoint
+			command = []string{"/bin/sh", "-c", "( " + entrypoint + " && sleep " + opts.SuccessGracePeriod + " ) || sleep " + opts.FailGracePeriod}
+		default:
+			continue
+		}
+
+		switch opts.Strategies[c.Name] {
+		case config.GraceStrategyPreStop:
+			if addPreStopSleep(c, opts) {
+				preStop = true
+				installWrapper = installWrapper || opts.WrapperImage != ""
+			}
+		case config.GraceStrategyBinary:
+			useGraceWrapper(c, entrypoint, opts)
+			installWrapper = true
+		default:
+			c.Command = command
 		}
 	}
+	if preStop {
+		extendTerminationGracePeriod(podCopy, opts.SuccessGracePeriod)
+	}
+	if installWrapper {
+		addGraceWrapperInstaller(podCopy, opts.WrapperImage)
+	}
 
 	return eiriniManager.PatchFromPod(req, podCopy)
 }
+
+// useGraceWrapper runs the original process of the container through the
+// grace-wrapper binary, which needs nothing from the image. The process is the
+// container command and arguments, or the entrypoint followed by the arguments
+// when the container has no command. The entrypoint arguments are space
+// separated.
+func useGraceWrapper(c *corev1.Container, entrypoint string, opts GraceOptions) {
+	command := c.Command
+	if len(command) == 0 {
+		command = strings.Fields(entrypoint)
+	}
+	wrapped := []string{graceWrapperPath,
+		"--success-grace", opts.SuccessGracePeriod,
+		"--fail-grace", opts.FailGracePeriod,
+		"--"}
+	wrapped = append(wrapped, command...)
+	c.Command = append(wrapped, c.Args...)
+	c.Args = nil
+	mountGraceWrapper(c)
+}
+
+// mountGraceWrapper mounts the volume the grace-wrapper binary is installed in
+func mountGraceWrapper(c *corev1.Container) {
+	c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: graceWrapperVolume, MountPath: graceWrapperDir, ReadOnly: true})
+}
+
+// addGraceWrapperInstaller adds the volume of the grace-wrapper binary and the
+// init container copying it there, which runs first
+func addGraceWrapperInstaller(pod *corev1.Pod, image string) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name:         graceWrapperVolume,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	installer := corev1.Container{
+		Name:         graceWrapperInstaller,
+		Image:        image,
+		Command:      []string{GraceWrapperImagePath, "install", graceWrapperPath},
+		VolumeMounts: []corev1.VolumeMount{{Name: graceWrapperVolume, MountPath: graceWrapperDir}},
+	}
+	pod.Spec.InitContainers = append([]corev1.Container{installer}, pod.Spec.InitContainers...)
+}
+
+// addPreStopSleep delays the termination of the container by the success
+// grace period, as the container is stopped rather than failing, leaving its
+// command untouched. kubelet doesn't run the hook when the container exits by
+// itself, there is no failure grace period with it. The sleep is run by the grace-wrapper binary when its
+// image is set, which needs nothing from the image, otherwise by the sleep of
+// the image. It returns false when the container already has a preStop hook,
+// which is kept.
+func addPreStopSleep(c *corev1.Container, opts GraceOptions) bool {
+	if c.Lifecycle != nil && c.Lifecycle.PreStop != nil {
+		return false
+	}
+	if c.Lifecycle == nil {
+		c.Lifecycle = &corev1.Lifecycle{}
+	}
+	command := []string{"sleep", opts.SuccessGracePeriod}
+	if opts.WrapperImage != "" {
+		command = []string{graceWrapperPath, "sleep", opts.SuccessGracePeriod}
+		mountGraceWrapper(c)
+	}
+	c.Lifecycle.PreStop = &corev1.Handler{Exec: &corev1.ExecAction{Command: command}}
+	return true
+}
+
+// extendTerminationGracePeriod adds the preStop sleep to the termination
+// grace period of the pod, so that the containers keep the time they had to
+// stop. The preStop hooks of the containers run in parallel.
+func extendTerminationGracePeriod(pod *corev1.Pod, gracePeriod string) {
+	seconds, _ := strconv.ParseInt(gracePeriod, 10, 64)
+	terminationGracePeriod := int64(defaultTerminationGracePeriod)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		terminationGracePeriod = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	terminationGracePeriod += seconds
+	pod.Spec.TerminationGracePeriodSeconds = &terminationGracePeriod
+}
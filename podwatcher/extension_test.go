@@ -7,6 +7,7 @@ import (
 
 	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
 	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	jsonpatch "github.com/evanphx/json-patch"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
@@ -27,6 +28,21 @@ func decodePatches(resp admission.Response) string {
 	return strings.Join(jsonifyPatches(resp), "")
 }
 
+// applyPatches returns the pod mutated by the patches of the response
+func applyPatches(pod *corev1.Pod, resp admission.Response) *corev1.Pod {
+	raw, err := json.Marshal(pod)
+	Expect(err).ToNot(HaveOccurred())
+	patch, err := json.Marshal(resp.Patches)
+	Expect(err).ToNot(HaveOccurred())
+	decoded, err := jsonpatch.DecodePatch(patch)
+	Expect(err).ToNot(HaveOccurred())
+	raw, err = decoded.Apply(raw)
+	Expect(err).ToNot(HaveOccurred())
+	patched := &corev1.Pod{}
+	Expect(json.Unmarshal(raw, patched)).To(Succeed())
+	return patched
+}
+
 const (
 	addOpiPatch                = `{"op":"add","path":"/spec/containers/0/command","value":["dumb-init","--","/bin/sh","-c","(  /lifecycle/launch \u0026\u0026 sleep 5 ) || sleep 5"]}`
 	addUploaderPatch           = `{"op":"add","path":"/spec/containers/0/command","value":["/bin/sh","-c","( /packs/uploader \u0026\u0026 sleep 5 ) || sleep 5"]}`
@@ -86,6 +102,16 @@ var _ = Describe("Eirini extension", func() {
 				Expect(gracefulInjector.Options.RuntimeEntrypoint).To(Equal("42"))
 			})
 		})
+
+		Context("when the options are changed", func() {
+			It("applies the defaults to the options which are not set", func() {
+				gracefulInjector.SetOptions(GraceOptions{FailGracePeriod: "30"})
+
+				Expect(gracefulInjector.Options.FailGracePeriod).To(Equal("30"))
+				Expect(gracefulInjector.Options.SuccessGracePeriod).To(Equal("5"))
+				Expect(gracefulInjector.Options.RuntimeEntrypoint).To(Equal("/lifecycle/launch"))
+			})
+		})
 	})
 
 	Describe("GracePeriod Injector", func() {
@@ -273,5 +299,108 @@ var _ = Describe("Eirini extension", func() {
 				Expect(decodePatches(gracefulInjector.Handle(context.TODO(), eiriniManager, pod, request))).To(Equal(addOpiPatch))
 			})
 		})
+
+		Context("when a runtime app uses the preStop strategy", func() {
+			var gracePeriod int64 = 60
+			BeforeEach(func() {
+				pod = &corev1.Pod{
+					Spec: corev1.PodSpec{
+						TerminationGracePeriodSeconds: &gracePeriod,
+						InitContainers: []corev1.Container{
+							{Name: "opi-task-downloader"},
+						},
+						Containers: []corev1.Container{
+							{Name: "opi", Command: []string{"/app/server"}},
+							{Name: "opi-task-uploader", Lifecycle: &corev1.Lifecycle{PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"/drain"}}}}},
+						},
+					},
+				}
+			})
+
+			It("adds a preStop sleep and extends the termination grace period", func() {
+				gracefulInjector.SetOptions(GraceOptions{
+					SuccessGracePeriod: "10",
+					Strategies:         map[string]string{"opi": "prestop", "opi-task-uploader": "prestop"},
+				})
+				patches := jsonifyPatches(gracefulInjector.Handle(context.TODO(), eiriniManager, pod, request))
+				Expect(patches).To(ConsistOf(
+					`{"op":"add","path":"/spec/initContainers/0/command","value":["/bin/sh","-c","( /packs/downloader \u0026\u0026 sleep 10 ) || sleep 5"]}`,
+					`{"op":"add","path":"/spec/containers/0/lifecycle","value":{"preStop":{"exec":{"command":["sleep","10"]}}}}`,
+					`{"op":"replace","path":"/spec/terminationGracePeriodSeconds","value":70}`,
+				))
+			})
+
+			It("sleeps with the grace-wrapper when its image is set, for the images without sleep", func() {
+				gracefulInjector.SetOptions(GraceOptions{
+					SuccessGracePeriod: "10",
+					Strategies:         map[string]string{"opi": "prestop", "opi-task-uploader": "prestop"},
+					WrapperImage:       "registry/bridge:1",
+				})
+				patched := applyPatches(pod, gracefulInjector.Handle(context.TODO(), eiriniManager, pod, request))
+				opi := patched.Spec.Containers[0]
+				Expect(opi.Command).To(Equal([]string{"/app/server"}))
+				Expect(opi.Lifecycle.PreStop.Exec.Command).To(Equal([]string{"/eirini-grace-wrapper/grace-wrapper", "sleep", "10"}))
+				Expect(opi.VolumeMounts).To(ConsistOf(corev1.VolumeMount{Name: "eirini-grace-wrapper", MountPath: "/eirini-grace-wrapper", ReadOnly: true}))
+				Expect(patched.Spec.Containers[1].VolumeMounts).To(BeEmpty())
+				Expect(patched.Spec.InitContainers[0].Name).To(Equal("eirini-grace-wrapper-install"))
+				Expect(patched.Spec.Volumes).To(ConsistOf(corev1.Volume{
+					Name:         "eirini-grace-wrapper",
+					VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+				}))
+				Expect(*patched.Spec.TerminationGracePeriodSeconds).To(Equal(int64(70)))
+			})
+		})
+
+		Context("when an app uses the binary strategy", func() {
+			BeforeEach(func() {
+				pod = &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "opi", Image: "distroless/app"},
+						},
+					},
+				}
+			})
+
+			It("runs the entrypoint through the grace-wrapper copied by an init container", func() {
+				gracefulInjector.SetOptions(GraceOptions{
+					RuntimeEntrypoint: "/app/server --port 8080",
+					Strategies:        map[string]string{"opi": "binary"},
+					WrapperImage:      "registry/bridge:1",
+				})
+				patches := jsonifyPatches(gracefulInjector.Handle(context.TODO(), eiriniManager, pod, request))
+				Expect(patches).To(ConsistOf(
+					`{"op":"add","path":"/spec/volumes","value":[{"emptyDir":{},"name":"eirini-grace-wrapper"}]}`,
+					`{"op":"add","path":"/spec/initContainers","value":[{"command":["/bin/grace-wrapper","install","/eirini-grace-wrapper/grace-wrapper"],"image":"registry/bridge:1","name":"eirini-grace-wrapper-install","resources":{},"volumeMounts":[{"mountPath":"/eirini-grace-wrapper","name":"eirini-grace-wrapper"}]}]}`,
+					`{"op":"add","path":"/spec/containers/0/command","value":["/eirini-grace-wrapper/grace-wrapper","--success-grace","5","--fail-grace","5","--","/app/server","--port","8080"]}`,
+					`{"op":"add","path":"/spec/containers/0/volumeMounts","value":[{"mountPath":"/eirini-grace-wrapper","name":"eirini-grace-wrapper","readOnly":true}]}`,
+				))
+			})
+		})
+
+		Context("when a Docker app with its own command uses the binary strategy", func() {
+			BeforeEach(func() {
+				pod = &corev1.Pod{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{Name: "opi", Image: "distroless/app", Command: []string{"/server"}, Args: []string{"--port", "8080"}},
+						},
+					},
+				}
+			})
+
+			It("wraps the command and arguments of the container instead of the entrypoint", func() {
+				gracefulInjector.SetOptions(GraceOptions{
+					Strategies:   map[string]string{"opi": "binary"},
+					WrapperImage: "registry/bridge:1",
+				})
+				patched := applyPatches(pod, gracefulInjector.Handle(context.TODO(), eiriniManager, pod, request))
+				Expect(patched.Spec.Containers[0].Command).To(Equal([]string{
+					"/eirini-grace-wrapper/grace-wrapper", "--success-grace", "5", "--fail-grace", "5", "--",
+					"/server", "--port", "8080",
+				}))
+				Expect(patched.Spec.Containers[0].Args).To(BeEmpty())
+			})
+		})
 	})
 })
@@ -0,0 +1,177 @@
+package podwatcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// SinkErrorWindow is how long a Loggregator send error makes the bridge not
+// ready, unless a send succeeds in the meantime. The go-loggregator ingress
+// client only reports errors, so the sink is considered healthy again once
+// it stops reporting them.
+var SinkErrorWindow = 30 * time.Second
+
+// SinkHealth tracks the outcome of the sends to Loggregator
+type SinkHealth struct {
+	mu          sync.Mutex
+	lastError   error
+	lastFailure time.Time
+	lastSuccess time.Time
+}
+
+// SharedSinkHealth is fed by all the Loggregator clients
+var SharedSinkHealth = &SinkHealth{}
+
+// Report records the outcome of a send
+func (h *SinkHealth) Report(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastError, h.lastFailure = err, time.Now()
+	} else {
+		h.lastSuccess = time.Now()
+	}
+}
+
+// Check returns an error if the last send failed recently
+func (h *SinkHealth) Check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastFailure.IsZero() || h.lastSuccess.After(h.lastFailure) || time.Since(h.lastFailure) > SinkErrorWindow {
+		return nil
+	}
+	return fmt.Errorf("sending to Loggregator failed: %s", h.lastError.Error())
+}
+
+// Health tracks whether the pods were synced, the resyncs keep succeeding
+// and the watch is still running. The watch is quiet while no pod changes,
+// its events are recorded apart from the resyncs.
+type Health struct {
+	// Window is how long the bridge can go without a successful resync
+	// before being considered wedged
+	Window time.Duration
+
+	mu             sync.Mutex
+	synced         bool
+	lastSync       time.Time
+	lastWatchEvent time.Time
+	watchErr       error
+}
+
+// NewHealth returns a Health with the given window, zero means the default
+func NewHealth(window time.Duration) *Health {
+	if window == 0 {
+		window = config.DefaultLivenessWindow
+	}
+	return &Health{Window: window}
+}
+
+// Synced records a successful sync of the running pods
+func (h *Health) Synced() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.synced = true
+	h.lastSync = time.Now()
+}
+
+// WatchEvent records a pod event of the watch
+func (h *Health) WatchEvent() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastWatchEvent = time.Now()
+}
+
+// WatchStopped records that the watch ended with err, it isn't restarted
+func (h *Health) WatchStopped(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.watchErr = err
+}
+
+// CheckLive returns an error if the watch stopped, or if no resync succeeded
+// within the window
+func (h *Health) CheckLive() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchErr != nil {
+		last := "no event received"
+		if !h.lastWatchEvent.IsZero() {
+			last = fmt.Sprintf("last event %s ago", time.Since(h.lastWatchEvent).Round(time.Second))
+		}
+		return fmt.Errorf("the pod watch stopped (%s): %s", last, h.watchErr.Error())
+	}
+	if !h.synced {
+		return nil
+	}
+	if since := time.Since(h.lastSync); since > h.Window {
+		return fmt.Errorf("no resync of the running pods succeeded for %s", since.Round(time.Second))
+	}
+	return nil
+}
+
+// CheckReady returns an error until the pods are synced, or if the watch
+// stopped
+func (h *Health) CheckReady() error {
+	h.mu.Lock()
+	synced := h.synced
+	h.mu.Unlock()
+	if !synced {
+		return errors.New("the running pods are not synced yet")
+	}
+	return h.CheckLive()
+}
+
+// CheckLive returns an error if the PodWatcher is wedged. Replicas in
+// standby are always alive.
+func (pw *PodWatcher) CheckLive() error {
+	if pw.Standby() {
+		return nil
+	}
+	return pw.Health.CheckLive()
+}
+
+// CheckReady returns an error if the PodWatcher can't stream logs. Replicas
+// in standby are ready, as they serve the webhook.
+func (pw *PodWatcher) CheckReady() error {
+	if pw.Standby() {
+		return nil
+	}
+	if err := pw.Health.CheckReady(); err != nil {
+		return err
+	}
+	return SharedSinkHealth.Check()
+}
+
+// LivenessHandler serves the liveness probe
+func (pw *PodWatcher) LivenessHandler() http.Handler {
+	return probeHandler(pw.CheckLive)
+}
+
+// ReadinessHandler serves the readiness probe
+func (pw *PodWatcher) ReadinessHandler() http.Handler {
+	return probeHandler(pw.CheckReady)
+}
+
+// ServeHealth serves the probes of the PodWatcher on addr under /healthz and
+// /readyz. It blocks until the server fails.
+func ServeHealth(addr string, pw *PodWatcher) error {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", pw.LivenessHandler())
+	mux.Handle("/readyz", pw.ReadinessHandler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func probeHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
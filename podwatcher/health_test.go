@@ -0,0 +1,168 @@
+package podwatcher_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+var _ = Describe("Health", func() {
+	probe := func(h http.Handler) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	Describe("PodWatcher probes", func() {
+		var pw *PodWatcher
+
+		BeforeEach(func() {
+			pw = NewPodWatcher(config.ConfigType{Namespace: "test", LivenessWindow: 50 * time.Millisecond})
+		})
+
+		It("is live but not ready before the first sync", func() {
+			code, _ := probe(pw.LivenessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			code, body := probe(pw.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(ContainSubstring("not synced yet"))
+		})
+
+		It("is ready once synced", func() {
+			pw.Health.Synced()
+			code, body := probe(pw.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(Equal("ok\n"))
+		})
+
+		It("fails both probes when no resync succeeds within the window", func() {
+			pw.Health.Synced()
+			Eventually(func() int {
+				code, _ := probe(pw.LivenessHandler())
+				return code
+			}).Should(Equal(http.StatusServiceUnavailable))
+			code, body := probe(pw.ReadinessHandler())
+			Expect(code).To(Equal(http.StatusServiceUnavailable))
+			Expect(body).To(ContainSubstring("no resync of the running pods succeeded"))
+		})
+
+		It("doesn't count the watch events as resyncs", func() {
+			pw.Health.Synced()
+			eirinixcat := eirinixcatalog.NewCatalog()
+			manager := eirinixcat.SimpleManager()
+			deleted := watch.Event{Type: watch.Deleted, Object: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "poduid"}}}
+			Eventually(func() error {
+				pw.Handle(manager, deleted)
+				return pw.CheckLive()
+			}).Should(MatchError(ContainSubstring("no resync of the running pods succeeded")))
+		})
+
+		Context("when the watch stops", func() {
+			var manager eirinix.Manager
+
+			BeforeEach(func() {
+				pw = NewPodWatcher(config.ConfigType{Namespace: "test", LivenessWindow: time.Hour})
+				pw.Health.Synced()
+				eirinixcat := eirinixcatalog.NewCatalog()
+				manager = eirinixcat.SimpleManager()
+			})
+
+			It("fails both probes when the watch channel is closed", func() {
+				pw.Handle(manager, watch.Event{})
+				code, body := probe(pw.LivenessHandler())
+				Expect(code).To(Equal(http.StatusServiceUnavailable))
+				Expect(body).To(ContainSubstring("the pod watch stopped (no event received): watch channel closed"))
+				code, _ = probe(pw.ReadinessHandler())
+				Expect(code).To(Equal(http.StatusServiceUnavailable))
+			})
+
+			It("fails both probes on a watch error, even after a resync", func() {
+				pw.Handle(manager, watch.Event{Type: watch.Added, Object: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "poduid"}}})
+				pw.Handle(manager, watch.Event{Type: watch.Error, Object: &metav1.Status{Status: metav1.StatusFailure, Message: "too old resource version"}})
+				pw.Health.Synced()
+				Expect(pw.CheckLive()).To(MatchError(And(
+					ContainSubstring("last event"),
+					ContainSubstring("too old resource version"),
+				)))
+				Expect(pw.CheckReady()).NotTo(Succeed())
+			})
+		})
+
+		It("is live and ready in standby", func() {
+			pw = NewPodWatcher(config.ConfigType{Namespace: "test", HAMode: config.HAModeLeaderElection})
+			Expect(pw.CheckReady()).To(Succeed())
+			Expect(pw.CheckLive()).To(Succeed())
+		})
+
+		It("answers while the leader syncs the running pods", func() {
+			gate := make(chan struct{})
+			var release sync.Once
+			api := newKubeAPI(3, gate)
+			defer api.Close()
+			defer release.Do(func() { close(gate) })
+			ctx, cancel := context.WithCancel(context.Background())
+			pw = NewPodWatcher(config.ConfigType{Namespace: "test", HAMode: config.HAModeLeaderElection})
+			defer func() {
+				cancel()
+				pw.Finish()
+			}()
+
+			led := make(chan error, 1)
+			go func() { led <- pw.StartLeading(ctx, api.manager()) }()
+			Eventually(api.listing).Should(Receive())
+			codes := make(chan int, 2)
+			go func() {
+				code, _ := probe(pw.LivenessHandler())
+				codes <- code
+				code, _ = probe(pw.ReadinessHandler())
+				codes <- code
+			}()
+			Eventually(codes).Should(Receive(Equal(http.StatusOK)))
+			Eventually(codes).Should(Receive(Equal(http.StatusOK)))
+
+			release.Do(func() { close(gate) })
+			Eventually(led).Should(Receive(BeNil()))
+		})
+	})
+
+	Describe("SinkHealth", func() {
+		var sink *SinkHealth
+
+		BeforeEach(func() {
+			sink = &SinkHealth{}
+		})
+
+		It("is healthy until a send fails", func() {
+			Expect(sink.Check()).To(Succeed())
+			sink.Report(errors.New("connection refused"))
+			Expect(sink.Check()).To(MatchError("sending to Loggregator failed: connection refused"))
+		})
+
+		It("recovers after a successful send", func() {
+			sink.Report(errors.New("connection refused"))
+			sink.Report(nil)
+			Expect(sink.Check()).To(Succeed())
+		})
+
+		It("recovers once no error was reported within the window", func() {
+			defer func(window time.Duration) { SinkErrorWindow = window }(SinkErrorWindow)
+			SinkErrorWindow = 10 * time.Millisecond
+
+			sink.Report(errors.New("connection refused"))
+			Eventually(sink.Check).Should(Succeed())
+		})
+	})
+})
@@ -0,0 +1,133 @@
+package podwatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// Pod annotations enabling and customizing the JSON log parsing for an app
+const (
+	AnnotationJSONLogs             = AnnotationPrefix + "json-logs"
+	AnnotationJSONLogsFields       = AnnotationPrefix + "json-logs-fields"
+	AnnotationJSONLogsLevelField   = AnnotationPrefix + "json-logs-level-field"
+	AnnotationJSONLogsMessageField = AnnotationPrefix + "json-logs-message-field"
+)
+
+// errorLevels are the (lower case) level names of error and above
+var errorLevels = map[string]bool{
+	"error": true, "err": true, "severe": true,
+	"critical": true, "crit": true, "alert": true, "emerg": true, "emergency": true,
+	"fatal": true, "panic": true, "dpanic": true,
+}
+
+// numericErrorLevel is the error level of the loggers using numbers (bunyan,
+// pino), the levels above are fatal ones
+const numericErrorLevel = 50
+
+// JSONLogOptionsFromAnnotations returns the JSON log options of an app, the
+// annotations which are set override the global ones. Fields are comma
+// separated.
+func JSONLogOptionsFromAnnotations(global config.JSONLogOptions, annotations map[string]string) (config.JSONLogOptions, error) {
+	opts := global
+	if v, ok := annotations[AnnotationJSONLogs]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return global, err
+		}
+		opts.Enabled = enabled
+	}
+	if v, ok := annotations[AnnotationJSONLogsFields]; ok {
+		opts.Fields = []string{}
+		for _, field := range strings.Split(v, ",") {
+			opts.Fields = append(opts.Fields, strings.TrimSpace(field))
+		}
+	}
+	if v, ok := annotations[AnnotationJSONLogsLevelField]; ok {
+		opts.LevelField = v
+	}
+	if v, ok := annotations[AnnotationJSONLogsMessageField]; ok {
+		opts.MessageField = v
+	}
+
+	if err := opts.Validate(); err != nil {
+		return global, err
+	}
+	return opts, nil
+}
+
+// JSONLogParser extracts the tags, the severity and the message of the log
+// lines which are JSON objects
+type JSONLogParser struct {
+	fields       []string
+	levelField   string
+	messageField string
+}
+
+// NewJSONLogParser returns the JSONLogParser of the options, the default
+// fields and level field are used when not set
+func NewJSONLogParser(opts config.JSONLogOptions) *JSONLogParser {
+	p := &JSONLogParser{fields: opts.Fields, levelField: opts.LevelField, messageField: opts.MessageField}
+	if p.fields == nil {
+		p.fields = config.DefaultJSONLogFields
+	}
+	if p.levelField == "" {
+		p.levelField = config.DefaultJSONLogLevelField
+	}
+	return p
+}
+
+// Parse returns the payload, the promoted tags and whether the line is an
+// error. ok is false when the line isn't a JSON object, in which case it is
+// to be sent as is.
+func (p *JSONLogParser) Parse(b []byte) (payload []byte, tags map[string]string, isError bool, ok bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return b, nil, false, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	fields := map[string]interface{}{}
+	if err := decoder.Decode(&fields); err != nil {
+		return b, nil, false, false
+	}
+
+	tags = map[string]string{}
+	for _, name := range p.fields {
+		if value, found := fields[name]; found && value != nil {
+			tags[name] = tagValue(value)
+		}
+	}
+
+	payload = b
+	if message, found := fields[p.messageField].(string); found && p.messageField != "" {
+		payload = []byte(message)
+	}
+	return payload, tags, isErrorLevel(fields[p.levelField]), true
+}
+
+func isErrorLevel(level interface{}) bool {
+	switch l := level.(type) {
+	case string:
+		return errorLevels[strings.ToLower(l)]
+	case json.Number:
+		n, err := l.Float64()
+		return err == nil && n >= numericErrorLevel
+	}
+	return false
+}
+
+func tagValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
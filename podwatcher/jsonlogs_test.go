@@ -0,0 +1,91 @@
+package podwatcher_test
+
+import (
+	"strings"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JSON logs", func() {
+	Describe("JSONLogOptionsFromAnnotations", func() {
+		It("enables the parsing and overrides the global options", func() {
+			opts, err := JSONLogOptionsFromAnnotations(config.JSONLogOptions{MessageField: "message"}, map[string]string{
+				AnnotationJSONLogs:             "true",
+				AnnotationJSONLogsFields:       "severity, trace_id",
+				AnnotationJSONLogsMessageField: "msg",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(Equal(config.JSONLogOptions{Enabled: true, Fields: []string{"severity", "trace_id"}, MessageField: "msg"}))
+		})
+
+		It("keeps the global options when an annotation is invalid", func() {
+			global := config.JSONLogOptions{Enabled: true}
+			_, err := JSONLogOptionsFromAnnotations(global, map[string]string{AnnotationJSONLogs: "maybe"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("JSONLogParser", func() {
+		var p *JSONLogParser
+
+		BeforeEach(func() {
+			p = NewJSONLogParser(config.JSONLogOptions{MessageField: "msg"})
+		})
+
+		It("promotes the fields and rewrites the payload", func() {
+			payload, tags, isError, ok := p.Parse([]byte(`{"level":"info","logger":"web","request_id":42,"msg":"hello","other":"x"}`))
+			Expect(ok).To(BeTrue())
+			Expect(string(payload)).To(Equal("hello"))
+			Expect(tags).To(Equal(map[string]string{"level": "info", "logger": "web", "request_id": "42"}))
+			Expect(isError).To(BeFalse())
+		})
+
+		It("keeps the line when the message field is missing", func() {
+			payload, _, _, ok := p.Parse([]byte(`{"level":"info"}`))
+			Expect(ok).To(BeTrue())
+			Expect(string(payload)).To(Equal(`{"level":"info"}`))
+		})
+
+		It("detects the error levels", func() {
+			for _, line := range []string{`{"level":"ERROR"}`, `{"level":"fatal"}`, `{"level":50}`, `{"level":60}`} {
+				_, _, isError, _ := p.Parse([]byte(line))
+				Expect(isError).To(BeTrue(), line)
+			}
+			for _, line := range []string{`{"level":"warn"}`, `{"level":40}`, `{}`} {
+				_, _, isError, _ := p.Parse([]byte(line))
+				Expect(isError).To(BeFalse(), line)
+			}
+		})
+
+		It("ignores the lines which aren't JSON objects", func() {
+			for _, line := range []string{"plain text", `{"unterminated"`, `["array"]`} {
+				payload, tags, _, ok := p.Parse([]byte(line))
+				Expect(ok).To(BeFalse(), line)
+				Expect(string(payload)).To(Equal(line))
+				Expect(tags).To(BeNil())
+			}
+		})
+	})
+
+	Describe("Loggregator", func() {
+		It("sends the parsed lines", func() {
+			emitter := &fakeEmitter{}
+			l := NewLoggregator(nil, &LoggregatorAppMeta{SourceID: "app-guid", InstanceID: "0", Container: "opi"}, nil, config.LoggregatorOptions{
+				JSONLogs: config.JSONLogOptions{Enabled: true, Fields: []string{"logger", "container"}, MessageField: "msg"},
+			})
+			l.LoggregatorClient = emitter
+			Expect(l.Forward(strings.NewReader(`{"level":"error","logger":"db","container":"other","msg":"failed"}` + "\nplain\n"))).To(Succeed())
+
+			Expect(emitter.payloads()).To(Equal([]string{"failed", "plain"}))
+			Expect(emitter.envelopes[0].GetLog().GetType()).To(Equal(loggregator_v2.Log_ERR))
+			Expect(emitter.envelopes[0].Tags).To(HaveKeyWithValue("logger", "db"))
+			Expect(emitter.envelopes[0].Tags).To(HaveKeyWithValue("container", "opi"))
+			Expect(emitter.envelopes[1].GetLog().GetType()).To(Equal(loggregator_v2.Log_OUT))
+			Expect(emitter.envelopes[1].Tags).ToNot(HaveKey("logger"))
+		})
+	})
+})
@@ -0,0 +1,134 @@
+package podwatcher
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	eirinix "code.cloudfoundry.org/eirinix"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var leaderElectionLog = Named("leader-election")
+
+// Lease timings used by the leader election, same defaults as controller-runtime
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// RunLeaderElection blocks until ctx is done, competing for the lease named
+// after the configured leader-election-id. Only the replica holding the lease
+// streams logs, the others stay in standby (while still serving the webhook)
+// and take over as soon as the lease is not renewed anymore. manager returns
+// the current eirinix manager, which changes when the namespace is reloaded.
+// The lease stays where it was when the PodWatcher was created.
+func (pw *PodWatcher) RunLeaderElection(ctx context.Context, manager func() eirinix.Manager, identity string) error {
+	kubeConfig, err := manager().GetKubeConnection()
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: pw.leaseNamespace,
+			Name:      pw.leaseName,
+		},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	for ctx.Err() == nil {
+		runCtx, cancel := context.WithCancel(ctx)
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   DefaultLeaseDuration,
+			RenewDeadline:   DefaultRenewDeadline,
+			RetryPeriod:     DefaultRetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            pw.leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					if err := pw.StartLeading(leaderCtx, manager()); err != nil {
+						// Give up the lease, so that another replica can try
+						leaderElectionLog.Error("Failed streaming logs as leader: ", err.Error())
+						cancel()
+					}
+				},
+				OnStoppedLeading: pw.StopLeading,
+				OnNewLeader: func(leader string) {
+					leaderElectionLog.Info("Current leader: ", leader)
+				},
+			},
+		})
+		if err != nil {
+			cancel()
+			return err
+		}
+		elector.Run(runCtx)
+		cancel()
+	}
+
+	return nil
+}
+
+// StartLeading takes over the log streaming. It tails all the running pods
+// and starts handling the watcher events, the watch of a manager not started
+// yet starts at the resource version of the sync. All the tails are stopped
+// when ctx is done.
+func (pw *PodWatcher) StartLeading(ctx context.Context, manager eirinix.Manager) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.stopped {
+		return nil
+	}
+	leaderElectionLog.Info("Acquired leadership, starting to stream logs")
+	startResourceVersion, err := pw.syncPods(ctx, manager)
+	if err != nil {
+		return err
+	}
+	pw.Health.Synced()
+	pw.setStandby(false)
+
+	managerOptions := manager.GetManagerOptions()
+	managerOptions.WatcherStartRV = startResourceVersion
+	manager.SetManagerOptions(managerOptions)
+	return nil
+}
+
+// StopLeading puts the PodWatcher in standby. The tails are stopped by the
+// cancellation of the leader context, here we only forget about them.
+func (pw *PodWatcher) StopLeading() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	leaderElectionLog.Info("Lost leadership, going in standby")
+	pw.setStandby(true)
+	pw.Containers.Containers = map[string]*Container{}
+}
+
+// Standby returns true if the PodWatcher is not streaming logs because
+// another replica is the leader. It doesn't wait for a running sync.
+func (pw *PodWatcher) Standby() bool {
+	return atomic.LoadInt32(&pw.standby) == 1
+}
+
+// setStandby is called with pw.mu held once the PodWatcher is created, so that
+// the standby doesn't change while an event or a sync is handled
+func (pw *PodWatcher) setStandby(standby bool) {
+	var value int32
+	if standby {
+		value = 1
+	}
+	atomic.StoreInt32(&pw.standby, value)
+}
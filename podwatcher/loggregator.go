@@ -2,53 +2,175 @@ package podwatcher
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
 	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/spool"
 	"code.cloudfoundry.org/go-loggregator/v8"
 	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"k8s.io/client-go/kubernetes"
 )
 
+// ContinuationTag marks the envelopes carrying the continuation of a log line
+// which was too long to fit in a single envelope
+const ContinuationTag = "continuation"
+
 type LoggregatorAppMeta struct {
 	SourceID, InstanceID                               string
 	SourceType, PodName, Namespace, Container, Cluster string // Custom tags
+	// CF is completed by the Cloud Controller lookup while the container is
+	// tailed, it is read and written with CFMeta and SetCFMeta from then on
+	CF CFMetadata
+	// Tags copied from the pod labels and annotations
+	Tags map[string]string
+
+	mu sync.Mutex
+}
+
+// CFMeta returns the CF metadata
+func (m *LoggregatorAppMeta) CFMeta() CFMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.CF
+}
+
+// SetCFMeta replaces the CF metadata, the next envelopes get its tags
+func (m *LoggregatorAppMeta) SetCFMeta(cf CFMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.CF = cf
+}
+
+// snapshot returns a copy of the metadata which isn't updated anymore
+func (m *LoggregatorAppMeta) snapshot() *LoggregatorAppMeta {
+	if m == nil {
+		return nil
+	}
+	return &LoggregatorAppMeta{
+		SourceID:   m.SourceID,
+		InstanceID: m.InstanceID,
+		SourceType: m.SourceType,
+		PodName:    m.PodName,
+		Namespace:  m.Namespace,
+		Container:  m.Container,
+		Cluster:    m.Cluster,
+		CF:         m.CFMeta(),
+		Tags:       m.Tags,
+	}
+}
+
+// logger returns the logger of the container tail, with the app instance
+// as context
+func (m *LoggregatorAppMeta) logger() *zap.SugaredLogger {
+	log := Named("tail")
+	if m == nil {
+		return log
+	}
+	return log.With(
+		FieldNamespace, m.Namespace,
+		FieldPod, m.PodName,
+		FieldContainer, m.Container,
+		FieldSourceID, m.SourceID,
+	)
+}
+
+// Emitter sends envelopes to Loggregator, it is implemented by the
+// go-loggregator IngressClient
+type Emitter interface {
+	Emit(*loggregator_v2.Envelope)
 }
 
 type Loggregator struct {
 	Meta              *LoggregatorAppMeta
 	ConnectionOptions config.LoggregatorOptions
 	KubeClient        *kubernetes.Clientset
-	LoggregatorClient *loggregator.IngressClient
+	LoggregatorClient Emitter
 	Context           context.Context
+	// Stats, when set, count the envelopes sent by the tail
+	Stats *TailStats
+	// Positions, when set, records how far the CRI log files are read
+	Positions *LogPositions
+
+	aggregators      map[loggregator_v2.Log_Type]*MultilineAggregator
+	rateLimiter      *RateLimiter
+	redactor         *Redactor
+	jsonParser       *JSONLogParser
+	unsubscribeCerts func()
+	log              *zap.SugaredLogger
+	// readTails are the end of what was read of the lines split at the max
+	// line size, by log type. The redaction of the next chunk looks back at
+	// them for the secrets crossing the split.
+	readTails map[loggregator_v2.Log_Type][]byte
 }
 
 type LoggregatorLogger struct{}
 
+var ingressLog = Named("go-loggregator")
+
 func (LoggregatorLogger) Printf(message string, args ...interface{}) {
-	LogDebug(append([]interface{}{message}, args...))
+	ingressLog.Debugf(message, args...)
+	// Failed sends are only reported through the logger
+	if strings.HasPrefix(message, "Error while flushing") {
+		SharedSinkHealth.Report(fmt.Errorf(message, args...))
+	}
 }
 func (LoggregatorLogger) Panicf(message string, args ...interface{}) {
-	panic(message)
+	ingressLog.Panicf(message, args...)
 }
 
 func NewLoggregator(ctx context.Context, m *LoggregatorAppMeta, kubeClient *kubernetes.Clientset, connectionOptions config.LoggregatorOptions) *Loggregator {
-	return &Loggregator{Meta: m, KubeClient: kubeClient, ConnectionOptions: connectionOptions, Context: ctx}
+	l := &Loggregator{Meta: m, KubeClient: kubeClient, ConnectionOptions: connectionOptions, Context: ctx}
+	l.log = m.logger()
+	if connectionOptions.RateLimit.Enabled() {
+		l.rateLimiter = SharedRateLimiters.NewRateLimiter(m, connectionOptions.RateLimit, l.reportDropped)
+	}
+	if connectionOptions.Redaction.Enabled(m.Namespace) {
+		redactor, err := NewRedactor(connectionOptions.Redaction)
+		if err != nil {
+			l.log.Error("Not redacting the log lines: ", err.Error())
+		} else {
+			l.redactor = redactor
+		}
+	}
+	if connectionOptions.JSONLogs.Enabled {
+		l.jsonParser = NewJSONLogParser(connectionOptions.JSONLogs)
+	}
+	return l
 }
 
-func (l *Loggregator) Envelope(message []byte) *loggregator_v2.Envelope {
-	LogDebug("Creating envelope for string: ", string(message))
+// reportDropped tells the app stream that log lines were dropped, as Diego
+// does when an app exceeds its log rate limit
+func (l *Loggregator) reportDropped(dropped uint64) {
+	l.log.Info(dropped, " log lines dropped due to rate limit")
+	l.emitChunk([]byte(fmt.Sprintf("%d log lines dropped due to rate limit", dropped)), loggregator_v2.Log_ERR, nil, false)
+}
+
+// Envelope returns the envelope of a log line. The configured default tags are
+// set here, as the go-loggregator ingress client only adds its tags to the
+// envelopes it creates itself.
+func (l *Loggregator) Envelope(message []byte, logType loggregator_v2.Log_Type) *loggregator_v2.Envelope {
+	l.log.Debug("Creating envelope for string: ", string(message))
 
-	return &loggregator_v2.Envelope{
+	envelope := &loggregator_v2.Envelope{
 		Message: &loggregator_v2.Envelope_Log{
 			Log: &loggregator_v2.Log{
 				Payload: message,
-				Type:    loggregator_v2.Log_OUT,
+				Type:    logType,
 			},
 		},
 		SourceId:   l.Meta.SourceID,
@@ -62,42 +184,373 @@ func (l *Loggregator) Envelope(message []byte) *loggregator_v2.Envelope {
 		},
 		Timestamp: time.Now().Unix() * 1000000000,
 	}
+	for name, value := range l.Meta.CFMeta().Tags() {
+		envelope.Tags[name] = value
+	}
+	for name, value := range l.Meta.Tags {
+		if _, ok := envelope.Tags[name]; !ok {
+			envelope.Tags[name] = value
+		}
+	}
+	for name, value := range l.ConnectionOptions.Tags {
+		if _, ok := envelope.Tags[name]; !ok {
+			envelope.Tags[name] = value
+		}
+	}
+	return envelope
 }
 
+// The spool is shared by all the tails, as they share the same directory
+var (
+	sharedSpool     *spool.Spool
+	sharedSpoolConn *grpc.ClientConn
+	sharedSpoolMu   sync.Mutex
+)
+
+// SetupLoggregatorClient connects the tail to Loggregator. Envelopes go
+// through the bounded queue of the container, drained by the shared sender
+// pool. The connection is swapped when the certificates change.
 func (l *Loggregator) SetupLoggregatorClient() error {
-	tlsConfig, err := loggregator.NewIngressTLSConfig(
-		l.ConnectionOptions.CAPath,
-		l.ConnectionOptions.CertPath,
-		l.ConnectionOptions.KeyPath,
-	)
+	certs, err := SharedCertWatcher(l.ConnectionOptions)
 	if err != nil {
 		return err
 	}
 
-	logger := LoggregatorLogger{}
-
-	loggregatorClient, err := loggregator.NewIngressClient(
-		tlsConfig,
-		// Temporary make flushing more frequent to be able to debug
-		loggregator.WithBatchMaxSize(uint(100)),
-		loggregator.WithLogger(logger),
-		loggregator.WithAddr(l.ConnectionOptions.Endpoint),
-	)
+	if l.ConnectionOptions.Spool.Enabled() {
+		sink, err := l.spool(certs)
+		if err != nil {
+			return err
+		}
+		l.LoggregatorClient = l.queue(sink)
+		return nil
+	}
 
+	sink, err := l.ingressClient(certs.TLSConfig(), certs.Endpoint())
 	if err != nil {
 		return err
 	}
-
-	l.LoggregatorClient = loggregatorClient
+	q := l.queue(sink)
+	l.unsubscribeCerts = certs.Subscribe(func(tlsConfig *tls.Config) {
+		sink, err := l.ingressClient(tlsConfig, certs.Endpoint())
+		if err != nil {
+			l.log.Error("Keeping the previous Loggregator connection: ", err.Error())
+			return
+		}
+		q.SetSink(sink)
+		l.Stats.LoggregatorReconnected()
+	})
+	l.LoggregatorClient = q
 	return nil
 }
 
+func (l *Loggregator) queue(sink Emitter) *EnvelopeQueue {
+	backpressure := l.ConnectionOptions.Backpressure
+	return SharedSenderPool(backpressure.Senders).NewQueue(sink, backpressure)
+}
+
+func (l *Loggregator) ingressClient(tlsConfig *tls.Config, endpoint string) (*loggregator.IngressClient, error) {
+	opts := []loggregator.IngressOption{
+		loggregator.WithBatchMaxSize(uint(l.batchSize())),
+		loggregator.WithLogger(LoggregatorLogger{}),
+		loggregator.WithAddr(endpoint),
+	}
+	if l.ConnectionOptions.FlushInterval > 0 {
+		opts = append(opts, loggregator.WithBatchFlushInterval(l.ConnectionOptions.FlushInterval))
+	}
+	return loggregator.NewIngressClient(tlsConfig, opts...)
+}
+
+func (l *Loggregator) batchSize() int {
+	if l.ConnectionOptions.BatchSize > 0 {
+		return l.ConnectionOptions.BatchSize
+	}
+	return config.DefaultBatchSize
+}
+
+// spool returns the shared spool. The spool sends the batches with the unary
+// Send RPC instead of the IngressClient stream, so that it knows when they
+// don't reach Loggregator.
+func (l *Loggregator) spool(certs *CertWatcher) (Emitter, error) {
+	sharedSpoolMu.Lock()
+	defer sharedSpoolMu.Unlock()
+
+	if sharedSpool != nil {
+		return sharedSpool, nil
+	}
+
+	conn, err := dial(certs.TLSConfig(), certs.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	s, err := spool.New(
+		spool.IngressSender{Client: loggregator_v2.NewIngressClient(conn)},
+		spool.Options{
+			SpoolOptions:  l.ConnectionOptions.Spool,
+			BatchMaxSize:  l.batchSize(),
+			FlushInterval: l.ConnectionOptions.FlushInterval,
+			OnSend:        SharedSinkHealth.Report,
+		},
+	)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sharedSpool, sharedSpoolConn = s, conn
+
+	certs.Subscribe(func(tlsConfig *tls.Config) {
+		conn, err := dial(tlsConfig, certs.Endpoint())
+		if err != nil {
+			LogError("Keeping the previous Loggregator connection: ", err.Error())
+			return
+		}
+		sharedSpoolMu.Lock()
+		defer sharedSpoolMu.Unlock()
+		s.SetSender(spool.IngressSender{Client: loggregator_v2.NewIngressClient(conn)})
+		sharedSpoolConn.Close()
+		sharedSpoolConn = conn
+	})
+	return sharedSpool, nil
+}
+
+func dial(tlsConfig *tls.Config, endpoint string) (*grpc.ClientConn, error) {
+	return grpc.Dial(endpoint, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+}
+
+// CloseSpool writes the envelopes which are still queued to the spool, so
+// that they are sent by the next run
+func CloseSpool() {
+	sharedSpoolMu.Lock()
+	defer sharedSpoolMu.Unlock()
+
+	if sharedSpool != nil {
+		sharedSpool.Close()
+		sharedSpool = nil
+	}
+}
+
 func (l *Loggregator) Write(b []byte) (int, error) {
-	l.LoggregatorClient.Emit(l.Envelope(b))
+	l.writeLine(b, loggregator_v2.Log_OUT)
 
 	return len(b), nil
 }
 
+// WriteCRILine emits a line read from a CRI log file, stderr lines are
+// sent as errors.
+func (l *Loggregator) WriteCRILine(line *CRILine) error {
+	logType := loggregator_v2.Log_OUT
+	if line.Stream == "stderr" {
+		logType = loggregator_v2.Log_ERR
+	}
+	if line.Continuation {
+		l.writeContinuation(line.Content, logType)
+		return nil
+	}
+	if line.Partial {
+		l.writeLineStart(line.Content, logType)
+		return nil
+	}
+	l.writeLine(line.Content, logType)
+
+	return nil
+}
+
+// writeLine emits the line, or buffers it if lines are aggregated.
+// The leading whitespace is kept for aggregated lines, as it usually tells
+// if a line continues the previous one.
+func (l *Loggregator) writeLine(b []byte, logType loggregator_v2.Log_Type) {
+	if a := l.aggregator(logType); a != nil {
+		a.Add(bytes.TrimRightFunc(b, unicode.IsSpace))
+		return
+	}
+	l.emit(bytes.TrimSpace(b), logType)
+}
+
+// writeLineStart emits the beginning of a line which exceeded the max line
+// size. It isn't trimmed, so that the envelopes of the line concatenate back
+// to it.
+func (l *Loggregator) writeLineStart(b []byte, logType loggregator_v2.Log_Type) {
+	l.keepReadTail(b, logType, true)
+	if a := l.aggregator(logType); a != nil {
+		a.Add(b)
+		return
+	}
+	l.emit(b, logType)
+}
+
+// writeContinuation emits the rest of a line which exceeded the max line size
+func (l *Loggregator) writeContinuation(b []byte, logType loggregator_v2.Log_Type) {
+	// The beginning of the line might still be buffered
+	if a, ok := l.aggregators[logType]; ok {
+		a.Flush()
+	}
+	previous := l.readTails[logType]
+	l.keepReadTail(b, logType, false)
+	if l.rateLimiter != nil && !l.rateLimiter.Allow(true) {
+		return
+	}
+	if l.redactor != nil {
+		b = l.redactor.RedactContinuation(previous, b)
+	}
+	for _, chunk := range splitLine(b, l.maxLineSize()) {
+		l.emitChunk(chunk, logType, nil, true)
+	}
+}
+
+// keepReadTail remembers the last redactionLookBehind bytes read of a split
+// line, before their redaction. start tells whether b starts the line.
+func (l *Loggregator) keepReadTail(b []byte, logType loggregator_v2.Log_Type, start bool) {
+	if l.redactor == nil {
+		return
+	}
+	if l.readTails == nil {
+		l.readTails = map[loggregator_v2.Log_Type][]byte{}
+	}
+	tail := []byte{}
+	if !start {
+		tail = append(tail, l.readTails[logType]...)
+	}
+	tail = append(tail, b...)
+	if len(tail) > redactionLookBehind {
+		tail = append([]byte{}, tail[len(tail)-redactionLookBehind:]...)
+	}
+	l.readTails[logType] = tail
+}
+
+func (l *Loggregator) emit(b []byte, logType loggregator_v2.Log_Type) {
+	if l.rateLimiter != nil && !l.rateLimiter.Allow(false) {
+		return
+	}
+	b = l.redact(b)
+	var tags map[string]string
+	b, tags, logType = l.parseJSON(b, logType)
+	for i, chunk := range splitLine(b, l.maxLineSize()) {
+		l.emitChunk(chunk, logType, tags, i > 0)
+	}
+}
+
+// redact replaces the secrets of the line, before it gets split in
+// envelopes. The lines longer than the max line size are read in chunks, see
+// writeContinuation for the secrets crossing them.
+func (l *Loggregator) redact(b []byte) []byte {
+	if l.redactor == nil {
+		return b
+	}
+	return l.redactor.Redact(b)
+}
+
+// parseJSON returns the payload, the promoted tags and the log type of a
+// JSON line, when parsing is enabled. The continuations of the lines longer
+// than the max line size can't be parsed, they are sent as they are.
+func (l *Loggregator) parseJSON(b []byte, logType loggregator_v2.Log_Type) ([]byte, map[string]string, loggregator_v2.Log_Type) {
+	if l.jsonParser == nil {
+		return b, nil, logType
+	}
+	payload, tags, isError, ok := l.jsonParser.Parse(b)
+	if !ok {
+		return b, nil, logType
+	}
+	if isError {
+		logType = loggregator_v2.Log_ERR
+	}
+	return payload, tags, logType
+}
+
+// emitChunk sends an envelope, with the given tags unless they are already
+// set
+func (l *Loggregator) emitChunk(b []byte, logType loggregator_v2.Log_Type, tags map[string]string, continuation bool) {
+	envelope := l.Envelope(b, logType)
+	for name, value := range tags {
+		if _, ok := envelope.Tags[name]; !ok {
+			envelope.Tags[name] = value
+		}
+	}
+	if continuation {
+		envelope.Tags[ContinuationTag] = "true"
+	}
+	l.LoggregatorClient.Emit(envelope)
+	l.Stats.Emitted(len(b), continuation)
+}
+
+func (l *Loggregator) maxLineSize() int {
+	if l.ConnectionOptions.MaxLineSize > 0 {
+		return l.ConnectionOptions.MaxLineSize
+	}
+	return config.DefaultMaxLineSize
+}
+
+// splitLine splits b in chunks of at most max bytes, without breaking
+// UTF-8 encoded characters. A character longer than max gets a chunk of its
+// own.
+func splitLine(b []byte, max int) [][]byte {
+	if len(b) <= max {
+		return [][]byte{b}
+	}
+	metrics.SplitLines.Inc()
+
+	chunks := [][]byte{}
+	for len(b) > max {
+		end := max
+		for end > max-utf8.UTFMax && end > 0 && !utf8.RuneStart(b[end]) {
+			end--
+		}
+		if !utf8.RuneStart(b[end]) {
+			end = max
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRune(b)
+		}
+		chunks = append(chunks, b[:end])
+		b = b[end:]
+	}
+	if len(b) == 0 {
+		return chunks
+	}
+	return append(chunks, b)
+}
+
+// aggregator returns the MultilineAggregator of the given stream, nil if
+// lines are not aggregated. Streams are aggregated separately, so that
+// stderr lines don't end up in the middle of stdout ones.
+func (l *Loggregator) aggregator(logType loggregator_v2.Log_Type) *MultilineAggregator {
+	if !l.ConnectionOptions.Multiline.Enabled() {
+		return nil
+	}
+	if a, ok := l.aggregators[logType]; ok {
+		return a
+	}
+
+	a, err := NewMultilineAggregator(l.ConnectionOptions.Multiline, func(b []byte) { l.emit(b, logType) })
+	if err != nil {
+		l.log.Error("Disabling multiline aggregation: ", err.Error())
+		l.ConnectionOptions.Multiline = config.MultilineOptions{}
+		return nil
+	}
+	if l.aggregators == nil {
+		l.aggregators = map[loggregator_v2.Log_Type]*MultilineAggregator{}
+	}
+	l.aggregators[logType] = a
+	return a
+}
+
+// Flush emits the lines which are still buffered
+func (l *Loggregator) Flush() {
+	for _, a := range l.aggregators {
+		a.Flush()
+	}
+}
+
+// Close flushes the buffered lines and releases the rate limits, it has to
+// be called once the tail is over.
+func (l *Loggregator) Close() {
+	l.Flush()
+	if l.rateLimiter != nil {
+		l.rateLimiter.Close()
+	}
+	if l.unsubscribeCerts != nil {
+		l.unsubscribeCerts()
+	}
+}
+
 func (l *Loggregator) Tail(namespace, pod, container string) error {
 	req := l.KubeClient.CoreV1().RESTClient().Get().
 		Namespace(namespace).
@@ -114,9 +567,29 @@ func (l *Loggregator) Tail(namespace, pod, container string) error {
 	}
 
 	defer stream.Close()
-	reader := bufio.NewReader(stream)
+	defer l.Close()
+	return l.Forward(stream)
+}
+
+// Forward writes the lines read from r. Lines longer than the max line size
+// are never buffered entirely, they are sent in chunks as they are read.
+func (l *Loggregator) Forward(r io.Reader) error {
+	reader := bufio.NewReaderSize(r, l.maxLineSize())
+	split := false
 	for {
-		line, err := reader.ReadBytes('\n')
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			chunk := append([]byte{}, line...)
+			if split {
+				l.writeContinuation(chunk, loggregator_v2.Log_OUT)
+			} else {
+				metrics.SplitLines.Inc()
+				l.writeLineStart(chunk, loggregator_v2.Log_OUT)
+			}
+			split = true
+			continue
+		}
+
 		if err == io.EOF {
 			break
 		}
@@ -125,7 +598,13 @@ func (l *Loggregator) Tail(namespace, pod, container string) error {
 			return err
 		}
 
-		_, err = l.Write([]byte(strings.TrimSpace(string(line))))
+		if split {
+			l.writeContinuation([]byte(strings.TrimRight(string(line), "\r\n")), loggregator_v2.Log_OUT)
+			split = false
+			continue
+		}
+
+		_, err = l.Write(append([]byte{}, line...))
 		if err != nil {
 			return err
 		}
@@ -133,3 +612,14 @@ func (l *Loggregator) Tail(namespace, pod, container string) error {
 
 	return nil
 }
+
+// TailFile streams the container logs from the CRI log files in dir, as written
+// by kubelet on the node. It returns once ctx is done and the lines already
+// written are consumed.
+func (l *Loggregator) TailFile(ctx context.Context, dir string) error {
+	defer l.Close()
+	tailer := NewCRIFileTailer(dir, l.WriteCRILine)
+	tailer.MaxLineSize = l.maxLineSize()
+	tailer.Positions = l.Positions
+	return tailer.Run(ctx)
+}
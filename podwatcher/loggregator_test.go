@@ -0,0 +1,132 @@
+package podwatcher_test
+
+import (
+	"strings"
+	"sync"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeEmitter struct {
+	sync.Mutex
+	envelopes []*loggregator_v2.Envelope
+}
+
+func (f *fakeEmitter) Emit(e *loggregator_v2.Envelope) {
+	f.Lock()
+	defer f.Unlock()
+	f.envelopes = append(f.envelopes, e)
+}
+
+func (f *fakeEmitter) payloads() []string {
+	f.Lock()
+	defer f.Unlock()
+	r := []string{}
+	for _, e := range f.envelopes {
+		r = append(r, string(e.GetLog().GetPayload()))
+	}
+	return r
+}
+
+func (f *fakeEmitter) continuations() []bool {
+	f.Lock()
+	defer f.Unlock()
+	r := []bool{}
+	for _, e := range f.envelopes {
+		r = append(r, e.Tags[ContinuationTag] == "true")
+	}
+	return r
+}
+
+var _ = Describe("Loggregator", func() {
+	var (
+		emitter *fakeEmitter
+		l       *Loggregator
+	)
+
+	BeforeEach(func() {
+		emitter = &fakeEmitter{}
+		l = NewLoggregator(nil, &LoggregatorAppMeta{SourceID: "app-guid", InstanceID: "0"}, nil, config.LoggregatorOptions{MaxLineSize: 16})
+		l.LoggregatorClient = emitter
+	})
+
+	Describe("Envelope", func() {
+		It("sets the app metadata", func() {
+			e := l.Envelope([]byte("hello"), loggregator_v2.Log_ERR)
+			Expect(e.SourceId).To(Equal("app-guid"))
+			Expect(e.InstanceId).To(Equal("0"))
+			Expect(e.GetLog().GetType()).To(Equal(loggregator_v2.Log_ERR))
+			Expect(e.Tags).To(HaveKey("source_type"))
+		})
+
+		It("adds the default tags without overriding the app ones", func() {
+			l.ConnectionOptions.Tags = map[string]string{"deployment": "cf", "source_type": "OTHER"}
+			l.Meta.SourceType = "APP"
+			e := l.Envelope([]byte("hello"), loggregator_v2.Log_OUT)
+			Expect(e.Tags).To(HaveKeyWithValue("deployment", "cf"))
+			Expect(e.Tags).To(HaveKeyWithValue("source_type", "APP"))
+		})
+
+		It("adds the pod tags without overriding the bridge ones", func() {
+			l.ConnectionOptions.Tags = map[string]string{"team": "default"}
+			l.Meta.Tags = map[string]string{"team": "payments", "namespace": "other"}
+			l.Meta.Namespace = "eirini"
+			e := l.Envelope([]byte("hello"), loggregator_v2.Log_OUT)
+			Expect(e.Tags).To(HaveKeyWithValue("team", "payments"))
+			Expect(e.Tags).To(HaveKeyWithValue("namespace", "eirini"))
+		})
+	})
+
+	Describe("Forward", func() {
+		It("sends a trimmed envelope per line", func() {
+			Expect(l.Forward(strings.NewReader("first \n  second\n"))).To(Succeed())
+			Expect(emitter.payloads()).To(Equal([]string{"first", "second"}))
+		})
+
+		It("splits the lines longer than the max line size", func() {
+			Expect(l.Forward(strings.NewReader("short\n" + strings.Repeat("a", 40) + "\nend\n"))).To(Succeed())
+			Expect(emitter.payloads()).To(Equal([]string{
+				"short",
+				strings.Repeat("a", 16),
+				strings.Repeat("a", 16),
+				strings.Repeat("a", 8),
+				"end",
+			}))
+			Expect(emitter.continuations()).To(Equal([]bool{false, false, true, true, false}))
+		})
+
+		It("doesn't trim the lines it splits", func() {
+			line := "  leading " + strings.Repeat("a", 6) + "  middle  " + strings.Repeat("b", 20) + "  "
+			Expect(l.Forward(strings.NewReader(line + "\n"))).To(Succeed())
+			Expect(len(emitter.payloads())).To(BeNumerically(">", 1))
+			Expect(strings.Join(emitter.payloads(), "")).To(Equal(line))
+		})
+
+		It("splits the aggregated lines longer than the max line size", func() {
+			l.ConnectionOptions.Multiline = config.MultilineOptions{ContinuationPattern: `^\s`}
+			Expect(l.Forward(strings.NewReader("error\n  at one\n  at two\n"))).To(Succeed())
+			l.Flush()
+			Expect(strings.Join(emitter.payloads(), "")).To(Equal("error\n  at one\n  at two"))
+			Expect(emitter.continuations()).To(Equal([]bool{false, true}))
+		})
+	})
+
+	Describe("Write", func() {
+		It("doesn't break multibyte characters when splitting", func() {
+			_, err := l.Write([]byte(strings.Repeat("é", 10)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(emitter.payloads()).To(Equal([]string{strings.Repeat("é", 8), strings.Repeat("é", 2)}))
+		})
+
+		It("splits the characters longer than the max line size apart", func() {
+			l.ConnectionOptions.MaxLineSize = 1
+			_, err := l.Write([]byte("aé€"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(emitter.payloads()).To(Equal([]string{"a", "é", "€"}))
+		})
+	})
+})
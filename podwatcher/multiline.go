@@ -0,0 +1,149 @@
+package podwatcher
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// AnnotationPrefix is the prefix of the pod annotations which customize how the
+// bridge handles the logs of an app
+const AnnotationPrefix = "loggregator-bridge.cloudfoundry.org/"
+
+// Pod annotations overriding the global multiline options for an app
+const (
+	AnnotationMultilineStartPattern        = AnnotationPrefix + "multiline-start-pattern"
+	AnnotationMultilineContinuationPattern = AnnotationPrefix + "multiline-continuation-pattern"
+	AnnotationMultilineMaxLines            = AnnotationPrefix + "multiline-max-lines"
+	AnnotationMultilineFlushTimeout        = AnnotationPrefix + "multiline-flush-timeout"
+)
+
+// Defaults used when the multiline aggregation is enabled without limits
+const (
+	DefaultMultilineMaxLines     = 500
+	DefaultMultilineFlushTimeout = time.Second
+)
+
+// MultilineOptionsFromAnnotations returns the multiline options of an app, the
+// annotations which are set override the global ones.
+func MultilineOptionsFromAnnotations(global config.MultilineOptions, annotations map[string]string) (config.MultilineOptions, error) {
+	opts := global
+	if v, ok := annotations[AnnotationMultilineStartPattern]; ok {
+		opts.StartPattern = v
+	}
+	if v, ok := annotations[AnnotationMultilineContinuationPattern]; ok {
+		opts.ContinuationPattern = v
+	}
+	if v, ok := annotations[AnnotationMultilineMaxLines]; ok {
+		maxLines, err := strconv.Atoi(v)
+		if err != nil {
+			return global, err
+		}
+		opts.MaxLines = maxLines
+	}
+	if v, ok := annotations[AnnotationMultilineFlushTimeout]; ok {
+		flushTimeout, err := time.ParseDuration(v)
+		if err != nil {
+			return global, err
+		}
+		opts.FlushTimeout = flushTimeout
+	}
+
+	if err := opts.Validate(); err != nil {
+		return global, err
+	}
+	return opts, nil
+}
+
+// MultilineAggregator joins consecutive log lines belonging to the same event
+// (e.g. a stack trace) and hands them over as a single message.
+// The buffered event is emitted when a new one starts, when it reaches the
+// max lines or when no line is added for the flush timeout.
+type MultilineAggregator struct {
+	start, continuation *regexp.Regexp
+	maxLines            int
+	flushTimeout        time.Duration
+	emit                func([]byte)
+
+	mu    sync.Mutex
+	lines [][]byte
+	timer *time.Timer
+}
+
+// NewMultilineAggregator returns a MultilineAggregator calling emit for every
+// aggregated message
+func NewMultilineAggregator(opts config.MultilineOptions, emit func([]byte)) (*MultilineAggregator, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	a := &MultilineAggregator{
+		maxLines:     opts.MaxLines,
+		flushTimeout: opts.FlushTimeout,
+		emit:         emit,
+	}
+	if opts.StartPattern != "" {
+		a.start = regexp.MustCompile(opts.StartPattern)
+	}
+	if opts.ContinuationPattern != "" {
+		a.continuation = regexp.MustCompile(opts.ContinuationPattern)
+	}
+	if a.maxLines == 0 {
+		a.maxLines = DefaultMultilineMaxLines
+	}
+	if a.flushTimeout == 0 {
+		a.flushTimeout = DefaultMultilineFlushTimeout
+	}
+	return a, nil
+}
+
+func (a *MultilineAggregator) isContinuation(line []byte) bool {
+	if a.continuation != nil && a.continuation.Match(line) {
+		return true
+	}
+	return a.start != nil && !a.start.Match(line)
+}
+
+// Add adds a line, emitting the buffered event if the line starts a new one
+func (a *MultilineAggregator) Add(line []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.lines) > 0 && !a.isContinuation(line) {
+		a.flush()
+	}
+
+	a.lines = append(a.lines, line)
+	if len(a.lines) >= a.maxLines {
+		a.flush()
+		return
+	}
+
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.flushTimeout, a.Flush)
+	} else {
+		a.timer.Reset(a.flushTimeout)
+	}
+}
+
+// Flush emits the buffered event, if any
+func (a *MultilineAggregator) Flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flush()
+}
+
+func (a *MultilineAggregator) flush() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if len(a.lines) == 0 {
+		return
+	}
+	a.emit(bytes.Join(a.lines, []byte("\n")))
+	a.lines = nil
+}
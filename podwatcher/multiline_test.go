@@ -0,0 +1,119 @@
+package podwatcher_test
+
+import (
+	"sync"
+	"time"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type emitted struct {
+	sync.Mutex
+	messages []string
+}
+
+func (e *emitted) emit(b []byte) {
+	e.Lock()
+	defer e.Unlock()
+	e.messages = append(e.messages, string(b))
+}
+
+func (e *emitted) get() []string {
+	e.Lock()
+	defer e.Unlock()
+	return append([]string{}, e.messages...)
+}
+
+var _ = Describe("Multiline", func() {
+	var e *emitted
+
+	BeforeEach(func() { e = &emitted{} })
+
+	add := func(a *MultilineAggregator, lines ...string) {
+		for _, l := range lines {
+			a.Add([]byte(l))
+		}
+	}
+
+	Describe("MultilineAggregator", func() {
+		It("joins the lines not matching the start pattern", func() {
+			a, err := NewMultilineAggregator(config.MultilineOptions{StartPattern: `^\d{4}-`}, e.emit)
+			Expect(err).ToNot(HaveOccurred())
+
+			add(a, "2020-10-19 Exception in thread main", "  at Foo.bar(Foo.java:10)", "  at Foo.main(Foo.java:3)", "2020-10-19 next")
+			Expect(e.get()).To(Equal([]string{"2020-10-19 Exception in thread main\n  at Foo.bar(Foo.java:10)\n  at Foo.main(Foo.java:3)"}))
+
+			a.Flush()
+			Expect(e.get()).To(Equal([]string{
+				"2020-10-19 Exception in thread main\n  at Foo.bar(Foo.java:10)\n  at Foo.main(Foo.java:3)",
+				"2020-10-19 next",
+			}))
+		})
+
+		It("joins the lines matching the continuation pattern", func() {
+			a, err := NewMultilineAggregator(config.MultilineOptions{ContinuationPattern: `^\s+(at|from) `}, e.emit)
+			Expect(err).ToNot(HaveOccurred())
+
+			add(a, "NoMethodError", "    from app.rb:3", "    from app.rb:1", "Listening on 8080", "Ready")
+			a.Flush()
+			Expect(e.get()).To(Equal([]string{"NoMethodError\n    from app.rb:3\n    from app.rb:1", "Listening on 8080", "Ready"}))
+		})
+
+		It("emits the event once it reaches the max lines", func() {
+			a, err := NewMultilineAggregator(config.MultilineOptions{ContinuationPattern: `^\s`, MaxLines: 2}, e.emit)
+			Expect(err).ToNot(HaveOccurred())
+
+			add(a, "error", " one", " two")
+			Expect(e.get()).To(Equal([]string{"error\n one"}))
+		})
+
+		It("emits the event after the flush timeout", func() {
+			a, err := NewMultilineAggregator(config.MultilineOptions{ContinuationPattern: `^\s`, FlushTimeout: 20 * time.Millisecond}, e.emit)
+			Expect(err).ToNot(HaveOccurred())
+
+			add(a, "error", " one")
+			Expect(e.get()).To(BeEmpty())
+			Eventually(e.get).Should(Equal([]string{"error\n one"}))
+		})
+
+		It("fails with an invalid pattern", func() {
+			_, err := NewMultilineAggregator(config.MultilineOptions{StartPattern: `(`}, e.emit)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("MultilineOptionsFromAnnotations", func() {
+		global := config.MultilineOptions{StartPattern: `^\S`, MaxLines: 10}
+
+		It("returns the global options without annotations", func() {
+			opts, err := MultilineOptionsFromAnnotations(global, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(Equal(global))
+		})
+
+		It("overrides the global options with the annotations", func() {
+			opts, err := MultilineOptionsFromAnnotations(global, map[string]string{
+				AnnotationMultilineStartPattern:        "",
+				AnnotationMultilineContinuationPattern: `^\s+at `,
+				AnnotationMultilineFlushTimeout:        "200ms",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(Equal(config.MultilineOptions{ContinuationPattern: `^\s+at `, MaxLines: 10, FlushTimeout: 200 * time.Millisecond}))
+		})
+
+		It("disables the aggregation if the patterns are emptied", func() {
+			opts, err := MultilineOptionsFromAnnotations(global, map[string]string{AnnotationMultilineStartPattern: ""})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts.Enabled()).To(BeFalse())
+		})
+
+		It("returns the global options with invalid annotations", func() {
+			opts, err := MultilineOptionsFromAnnotations(global, map[string]string{AnnotationMultilineMaxLines: "many"})
+			Expect(err).To(HaveOccurred())
+			Expect(opts).To(Equal(global))
+		})
+	})
+})
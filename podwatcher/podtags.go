@@ -0,0 +1,54 @@
+package podwatcher
+
+import (
+	"sort"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// PodTags returns the pod labels and annotations selected by the options, to
+// be copied into the envelope tags. The labels win over the annotations with
+// the same key. The tags beyond the limit are left out, dropped tells how
+// many.
+func PodTags(opts config.PodTagOptions, labels, annotations map[string]string) (tags map[string]string, dropped int) {
+	maxTags := opts.MaxTags
+	if maxTags == 0 {
+		maxTags = config.DefaultMaxPodTags
+	}
+
+	tags = map[string]string{}
+	for _, source := range []struct {
+		keys   []string
+		values map[string]string
+	}{{opts.Labels, labels}, {opts.Annotations, annotations}} {
+		for _, key := range selectedKeys(source.keys, source.values) {
+			if _, ok := tags[key]; ok {
+				continue
+			}
+			if len(tags) == maxTags {
+				dropped++
+				continue
+			}
+			tags[key] = source.values[key]
+		}
+	}
+	return tags, dropped
+}
+
+// selectedKeys returns the sorted keys of values matching the patterns
+func selectedKeys(patterns []string, values map[string]string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	keys := []string{}
+	for key := range values {
+		for _, pattern := range patterns {
+			if config.MatchKey(pattern, key) {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
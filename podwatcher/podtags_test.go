@@ -0,0 +1,50 @@
+package podwatcher_test
+
+import (
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PodTags", func() {
+	labels := map[string]string{
+		"team":                    "payments",
+		"example.com/cost-center": "42",
+		"example.com/owner":       "alice",
+		"unrelated":               "x",
+	}
+	annotations := map[string]string{
+		"team":      "ignored",
+		"note/text": "hello",
+	}
+
+	It("copies the labels and annotations by key or prefix", func() {
+		tags, dropped := PodTags(config.PodTagOptions{
+			Labels:      []string{"team", "example.com/*"},
+			Annotations: []string{"team", "note/*"},
+		}, labels, annotations)
+		Expect(dropped).To(Equal(0))
+		Expect(tags).To(Equal(map[string]string{
+			"team":                    "payments",
+			"example.com/cost-center": "42",
+			"example.com/owner":       "alice",
+			"note/text":               "hello",
+		}))
+	})
+
+	It("limits the number of tags", func() {
+		tags, dropped := PodTags(config.PodTagOptions{
+			Labels:      []string{"example.com/*"},
+			Annotations: []string{"note/*"},
+			MaxTags:     1,
+		}, labels, annotations)
+		Expect(dropped).To(Equal(2))
+		Expect(tags).To(Equal(map[string]string{"example.com/cost-center": "42"}))
+	})
+
+	It("copies nothing by default", func() {
+		tags, _ := PodTags(config.PodTagOptions{}, labels, annotations)
+		Expect(tags).To(BeEmpty())
+	})
+})
@@ -2,18 +2,23 @@ package podwatcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"code.cloudfoundry.org/eirini-loggregator-bridge/cloudcontroller"
 	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
 	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
 	eirinix "code.cloudfoundry.org/eirinix"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -24,6 +29,20 @@ type PodWatcher struct {
 	Config     config.ConfigType
 	Containers ContainerList
 	Manager    eirinix.Manager
+	// Health tracks the sync and the watch for the probes
+	Health *Health
+
+	// standby is 1 while another replica holds the leader lease. It is
+	// changed under mu, but read atomically so that the probes don't wait
+	// for a sync of the running pods.
+	standby int32
+	// stopped is true once shut down, the leadership isn't taken anymore
+	stopped bool
+	// leaseNamespace and leaseName locate the leader lease, they are taken
+	// from the config the PodWatcher is created with, as the namespace can
+	// be reloaded
+	leaseNamespace, leaseName string
+	mu                        sync.Mutex
 }
 
 type Container struct {
@@ -33,10 +52,25 @@ type Container struct {
 	PodUID             string
 	UID                string
 	InitContainer      bool
+	Annotations        map[string]string
 	State              *corev1.ContainerState
 	LoggregatorOptions config.LoggregatorOptions
 	Loggregator        *Loggregator
 	AppMeta            *LoggregatorAppMeta
+	// LogDir is the CRI log directory of the container on the node.
+	// When set, logs are read from there instead of the API server.
+	LogDir string
+	// Stats are reported by the status endpoint
+	Stats *TailStats
+	// Restarts is the restart count of the container, the log stream of
+	// every new run is a new tail
+	Restarts int32
+	// CloudController, when set, is looked up for the missing CF metadata
+	CloudController *cloudcontroller.Client
+	// Positions, when set, records how far the CRI log files are read
+	Positions *LogPositions
+
+	stop context.CancelFunc
 }
 
 type ContainerList struct {
@@ -45,6 +79,20 @@ type ContainerList struct {
 	LoggregatorOptions config.LoggregatorOptions
 	Tails              sync.WaitGroup
 	Context            context.Context
+	// Shard restricts the tailed pods to the ones owned by this replica.
+	// A nil Shard means that all pods are tailed.
+	Shard *Shard
+	// NodeName restricts the tailed pods to the ones scheduled on the node,
+	// their logs are read from the CRI log files in PodLogDir.
+	NodeName  string
+	PodLogDir string
+	// Positions, when set, records how far the CRI log files are read, so
+	// that a container tailed again doesn't send its lines again
+	Positions *LogPositions
+	// Selector restricts the tailed pods by their labels, nil selects all
+	Selector labels.Selector
+	// CloudController, when set, is looked up for the missing CF metadata
+	CloudController *cloudcontroller.Client
 }
 
 func (cl *ContainerList) GetContainer(uid string) (*Container, bool) {
@@ -54,13 +102,21 @@ func (cl *ContainerList) GetContainer(uid string) (*Container, bool) {
 
 func (cl *ContainerList) AddContainer(c *Container) {
 	cl.Containers[c.UID] = c
+	if cl.PodLogDir != "" {
+		c.LogDir = PodLogDir(cl.PodLogDir, c.Namespace, c.PodName, c.PodUID, c.Name)
+	}
+	c.CloudController = cl.CloudController
+	c.Positions = cl.Positions
 	c.Read(cl.Context, cl.LoggregatorOptions, cl.KubeConfig, &cl.Tails)
 }
 
 func (cl *ContainerList) RemoveContainer(uid string) error {
 	LogDebug("Removing container: ", uid)
-	_, ok := cl.GetContainer(uid)
+	c, ok := cl.GetContainer(uid)
 	if ok {
+		if c.stop != nil {
+			c.stop()
+		}
 		delete(cl.Containers, uid)
 	}
 	return nil
@@ -68,35 +124,98 @@ func (cl *ContainerList) RemoveContainer(uid string) error {
 
 // EnsureContainer make sure the container exists in the list and we are
 // monitoring it.
-func (cl ContainerList) EnsureContainer(c *Container) error {
+func (cl *ContainerList) EnsureContainer(c *Container) error {
 	LogDebug(c.UID + ": ensuring container is monitored")
 
-	if _, ok := cl.GetContainer(c.UID); !ok {
+	if existing, ok := cl.GetContainer(c.UID); !ok {
 		cl.AddContainer(c)
+	} else {
+		existing.Restarts = c.Restarts
 	}
 	return nil
 }
 
 func (c *Container) Read(ctx context.Context, LoggregatorOptions config.LoggregatorOptions, KubeConfig *rest.Config, wg *sync.WaitGroup) {
+	// Log files and streams are still there once the container is removed
+	// (stopped, or not selected anymore), the tail needs to be told when to
+	// stop following them.
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, c.stop = context.WithCancel(ctx)
+
+	if c.Stats == nil {
+		c.Stats = &TailStats{}
+	}
+
+	// The tail doesn't wait for the Cloud Controller, the envelopes get the
+	// CF tags once the lookup returns
+	if c.CloudController != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.ResolveCFMetadata(ctx, c.CloudController)
+		}()
+	}
+
 	wg.Add(1)
 	go func(c *Container, w *sync.WaitGroup) {
 		defer wg.Done()
-		kubeClient, err := kubernetes.NewForConfig(KubeConfig)
-		if err != nil {
-			LogError(err.Error())
+		log := c.AppMeta.logger()
+		var kubeClient *kubernetes.Clientset
+		var err error
+		if c.LogDir == "" {
+			kubeClient, err = kubernetes.NewForConfig(KubeConfig)
+			if err != nil {
+				log.Error(err.Error())
+				c.Stats.Failed(err)
+			}
 		}
-		c.Loggregator = NewLoggregator(ctx, c.AppMeta, kubeClient, LoggregatorOptions)
+		c.Loggregator = c.NewLoggregator(ctx, kubeClient, LoggregatorOptions)
+		c.Loggregator.Stats = c.Stats
+		c.Loggregator.Positions = c.Positions
 		if err = c.Loggregator.SetupLoggregatorClient(); err != nil {
-			LogError("Error: ", err.Error())
+			log.Error("Error: ", err.Error())
+			c.Stats.Failed(err)
+			// The tail which would close it isn't started
+			c.Loggregator.Close()
 			return
 		}
-		err = c.Tail(kubeClient)
+		c.Stats.Started()
+		if c.LogDir != "" {
+			err = c.Loggregator.TailFile(ctx, c.LogDir)
+		} else {
+			err = c.Tail(kubeClient)
+		}
 		if err != nil {
-			LogError("Error: ", err.Error())
+			log.Error("Error: ", err.Error())
+			c.Stats.Failed(err)
 		}
 	}(c, wg)
 }
 
+// NewLoggregator returns the Loggregator of the container, with the options
+// overridden by the pod annotations
+func (c *Container) NewLoggregator(ctx context.Context, kubeClient *kubernetes.Clientset, opts config.LoggregatorOptions) *Loggregator {
+	log := c.AppMeta.logger()
+	multiline, err := MultilineOptionsFromAnnotations(opts.Multiline, c.Annotations)
+	if err != nil {
+		log.Error("Ignoring multiline annotations: ", err.Error())
+	}
+	opts.Multiline = multiline
+	rateLimit, err := RateLimitOptionsFromAnnotations(opts.RateLimit, c.Annotations)
+	if err != nil {
+		log.Error("Ignoring rate limit annotations: ", err.Error())
+	}
+	opts.RateLimit = rateLimit
+	jsonLogs, err := JSONLogOptionsFromAnnotations(opts.JSONLogs, c.Annotations)
+	if err != nil {
+		log.Error("Ignoring JSON log annotations: ", err.Error())
+	}
+	opts.JSONLogs = jsonLogs
+	return NewLoggregator(ctx, c.AppMeta, kubeClient, opts)
+}
+
 // Tail connects to the Kube
 func (c *Container) Tail(kubeClient *kubernetes.Clientset) error {
 	// NOTE: We may end up implementing a cursor to get
@@ -129,6 +248,7 @@ func (c *Container) findState(containerStatuses []corev1.ContainerStatus) {
 	for _, status := range containerStatuses {
 		if status.Name == c.Name {
 			c.State = &status.State
+			c.Restarts = status.RestartCount
 		}
 	}
 }
@@ -161,14 +281,12 @@ func (cl *ContainerList) UpdateContainer(c *Container) error {
 	return nil
 }
 
-func ExtractContainersFromPod(pod *corev1.Pod) map[string]*Container {
+// ExtractContainersFromPod returns the containers of an Eirini pod which are
+// selected by the container lists, keyed by UID, with the app metadata of
+// their envelopes
+func ExtractContainersFromPod(pod *corev1.Pod, opts config.LoggregatorOptions) map[string]*Container {
 	result := map[string]*Container{}
 
-	sourceType, ok := pod.GetLabels()[eirinix.LabelSourceType]
-	if ok && sourceType == "APP" {
-		sourceType = "APP/PROC/WEB"
-	}
-
 	// If there is no guid, someone deployed a pod in the Eirini namespace
 	// and we are not filtering by Labels (yet) or we get a Pod which is not
 	// created by Eirini.
@@ -178,19 +296,33 @@ func ExtractContainersFromPod(pod *corev1.Pod) map[string]*Container {
 		return result // empty list
 	}
 
+	filter, err := ContainerFilterFromAnnotations(opts.Containers, pod.GetAnnotations())
+	if err != nil {
+		LogError("Ignoring the container annotations of pod ", pod.GetName(), ": ", err.Error())
+	}
+	cf := CFMetadataFromPod(pod.GetLabels(), pod.GetAnnotations())
+	tags, dropped := PodTags(opts.PodTags, pod.GetLabels(), pod.GetAnnotations())
+	if dropped > 0 {
+		LogDebug("Not copying ", dropped, " labels and annotations of pod ", pod.GetName(), " over the tag limit")
+	}
+
 	// NOTE: The order of the lists matter!
 	for i, clist := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
 		cstatuses := [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses}
 		for _, c := range clist {
+			if !filter.Selected(c.Name) {
+				continue
+			}
 			container := &Container{
 				Name:          c.Name,
 				PodName:       pod.Name,
 				PodUID:        string(pod.UID),
 				Namespace:     pod.Namespace,
 				InitContainer: (i == 0),
+				Annotations:   pod.GetAnnotations(),
 				AppMeta: &LoggregatorAppMeta{
 					SourceID:   guid,
-					SourceType: sourceType,
+					SourceType: SourceType(opts.SourceTypes, pod.GetLabels(), pod.GetAnnotations(), c.Name, i == 0),
 					// since Eirini 1.8.0 - previously staging pods were named after the app guid, but that's not the case anymore
 					// annotate in the podname in the tags the guid of the app to keep compatibility and with such, ensure staging logs get streamed.
 					PodName:   guid,
@@ -199,6 +331,8 @@ func ExtractContainersFromPod(pod *corev1.Pod) map[string]*Container {
 					// TODO: Is this correct?
 					// https://github.com/gdankov/loggregator-ci/blob/eirini/docker-images/fluentd/plugins/loggregator.rb#L54
 					Cluster: pod.GetClusterName(),
+					CF:      cf,
+					Tags:    tags,
 				},
 			}
 			container.extractInstanceID()
@@ -216,7 +350,20 @@ func ExtractContainersFromPod(pod *corev1.Pod) map[string]*Container {
 // the relevant gorouting (if it is still running, it could already be stopped
 // because of an error).
 func (cl *ContainerList) EnsurePodStatus(pod *corev1.Pod) error {
-	podContainers := ExtractContainersFromPod(pod)
+	if cl.Shard != nil && !cl.Shard.Owns(string(pod.UID)) {
+		LogDebug("Skipping pod owned by another shard: ", pod.GetName())
+		return nil
+	}
+	if cl.NodeName != "" && pod.Spec.NodeName != cl.NodeName {
+		return nil
+	}
+	if cl.Selector != nil && !cl.Selector.Matches(labels.Set(pod.GetLabels())) {
+		// The pod could have been tailed with a previous selector
+		cl.cleanup(string(pod.UID), map[string]*Container{})
+		return nil
+	}
+
+	podContainers := ExtractContainersFromPod(pod, cl.LoggregatorOptions)
 
 	for _, c := range podContainers {
 		cl.UpdateContainer(c)
@@ -227,17 +374,57 @@ func (cl *ContainerList) EnsurePodStatus(pod *corev1.Pod) error {
 	return nil
 }
 
-func NewPodWatcher(config config.ConfigType) *PodWatcher {
-	return &PodWatcher{
-		Config:     config,
+func NewPodWatcher(conf config.ConfigType) *PodWatcher {
+	pw := &PodWatcher{
+		Config:     conf,
 		Containers: ContainerList{Containers: map[string]*Container{}},
+		Health:     NewHealth(conf.LivenessWindow),
 	}
+	pw.setStandby(conf.HAMode == config.HAModeLeaderElection)
+	pw.leaseNamespace, pw.leaseName = conf.LeaderElectionNamespace, conf.LeaderElectionID
+	if pw.leaseNamespace == "" {
+		pw.leaseNamespace = conf.Namespace
+	}
+	if selector, err := conf.Selector(); err == nil {
+		pw.Containers.Selector = selector
+	}
+	if conf.LogSource == config.LogSourceNode {
+		pw.Containers.NodeName = conf.NodeName
+		pw.Containers.PodLogDir = conf.PodLogDir
+		if pw.Containers.PodLogDir == "" {
+			pw.Containers.PodLogDir = DefaultPodLogDir
+		}
+	}
+	return pw
 }
 
 func (pw *PodWatcher) Finish() {
 	pw.Containers.Tails.Wait()
 }
 
+// Shutdown stops the tails and waits for the envelopes they queued to be sent,
+// or written to the spool, which is closed then. The log positions are saved
+// last, once the tails don't move them anymore. The PodWatcher is put in
+// standby, so that neither the watch nor the resyncs start new tails.
+func (pw *PodWatcher) Shutdown() {
+	pw.mu.Lock()
+	pw.setStandby(true)
+	pw.stopped = true
+	for uid := range pw.Containers.Containers {
+		pw.Containers.RemoveContainer(uid)
+	}
+	pw.mu.Unlock()
+
+	pw.Finish()
+	SharedSenderPool(pw.Config.GetLoggregatorOptions().Backpressure.Senders).Drain()
+	CloseSpool()
+	if pw.Containers.Positions != nil {
+		if err := pw.Containers.Positions.Save(); err != nil {
+			LogError("Saving the log positions: ", err.Error())
+		}
+	}
+}
+
 // EnsureLogStream ensures that the already running pod logs are tracked
 // and sets the latest RV found to be able to track future changes.
 // It gets the current RV to start watching on and
@@ -247,26 +434,51 @@ func (pw *PodWatcher) Finish() {
 // pods if restarted (or updated).
 func (pw *PodWatcher) EnsureLogStream(ctx context.Context, manager eirinix.Manager) error {
 	managerOptions := manager.GetManagerOptions()
-	client, err := manager.GetKubeClient()
+
+	// The status endpoint is already served, it reads the containers
+	pw.mu.Lock()
+	startResourceVersion, err := pw.syncPods(ctx, manager)
+	pw.mu.Unlock()
 	if err != nil {
 		return err
 	}
+	pw.Health.Synced()
+
+	managerOptions.WatcherStartRV = startResourceVersion
+	manager.SetManagerOptions(managerOptions)
+
+	return nil
+}
+
+// syncPods streams the logs of the pods currently running in the namespace
+// and returns the resource version the list was taken at.
+func (pw *PodWatcher) syncPods(ctx context.Context, manager eirinix.Manager) (string, error) {
+	client, err := manager.GetKubeClient()
+	if err != nil {
+		return "", err
+	}
 	config, err := manager.GetKubeConnection()
 	if err != nil {
-		return err
+		return "", err
 	}
 	pw.Containers.Context = ctx
 
+	// In node mode, only the pods of the node are listed
+	podFields := fields.Everything()
+	if pw.Containers.NodeName != "" {
+		podFields = fields.OneTermEqualSelector("spec.nodeName", pw.Containers.NodeName)
+	}
+
 	// Get current RV
-	lw := cache.NewListWatchFromClient(client.RESTClient(), "pods", pw.Config.Namespace, fields.Everything())
+	lw := cache.NewListWatchFromClient(client.RESTClient(), "pods", pw.Config.Namespace, podFields)
 	list, err := lw.List(metav1.ListOptions{})
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	metaObj, err := meta.ListAccessor(list)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// To avoid races, we first get the latest RV, then we take the current running pod and
@@ -274,36 +486,71 @@ func (pw *PodWatcher) EnsureLogStream(ctx context.Context, manager eirinix.Manag
 	startResourceVersion := metaObj.GetResourceVersion()
 
 	// Read current running pods and ensure the logstream is tracked
-	podlist, err := client.Pods(pw.Config.Namespace).List(ctx, metav1.ListOptions{})
+	podlist, err := client.Pods(pw.Config.Namespace).List(ctx, metav1.ListOptions{FieldSelector: podFields.String()})
+	if err != nil {
+		return "", err
+	}
 
+	running := map[string]bool{}
 	for _, pod := range podlist.Items {
 		LogDebug(fmt.Sprintf("Detected running pod: %s", pod.GetName()))
+		running[string(pod.UID)] = true
 
 		pw.Containers.KubeConfig = config
 		pw.Containers.LoggregatorOptions = pw.Config.GetLoggregatorOptions()
 		pw.Containers.EnsurePodStatus(pod.DeepCopy())
 	}
-	managerOptions.WatcherStartRV = startResourceVersion
-	manager.SetManagerOptions(managerOptions)
 
-	return nil
+	// Stop the tails of the pods deleted while the watch was not looking,
+	// e.g. between two resyncs
+	for _, c := range pw.Containers.Containers {
+		if !running[c.PodUID] {
+			pw.Containers.cleanup(c.PodUID, map[string]*Container{})
+		}
+	}
+
+	return startResourceVersion, nil
 }
 
 func (pw *PodWatcher) Handle(manager eirinix.Manager, e watch.Event) {
 	LogDebug("Received event: ", e)
+	// The watch isn't restarted once it stops, the probes fail so that the
+	// bridge gets restarted
 	if e.Object == nil {
-		// Closed because of error
-		// TODO: Handle errors ( maybe kill the whole application )
-		// because it is going to run in goroutines, and we can't
-		// just return gracefully and panicking the whole
+		LogError("The pod watch channel was closed")
+		pw.Health.WatchStopped(errors.New("watch channel closed"))
+		return
+	}
+	if e.Type == watch.Error {
+		err := apierrors.FromObject(e.Object)
+		LogError("The pod watch stopped: ", err.Error())
+		pw.Health.WatchStopped(err)
 		return
 	}
+	pw.Health.WatchEvent()
 
 	pod, ok := e.Object.(*corev1.Pod)
 	if !ok {
 		LogError("Received non-pod object in watcher channel")
 		return
 	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.Standby() {
+		return
+	}
+
+	if e.Type == watch.Deleted {
+		pw.Containers.cleanup(string(pod.UID), map[string]*Container{})
+		return
+	}
+	// The watch of the previous namespace runs until the manager of the
+	// reloaded one replaces it
+	if pod.Namespace != pw.Config.Namespace {
+		return
+	}
+
 	config, err := manager.GetKubeConnection()
 	if err != nil {
 		LogError(err.Error())
@@ -313,3 +560,77 @@ func (pw *PodWatcher) Handle(manager eirinix.Manager, e watch.Event) {
 	pw.Containers.LoggregatorOptions = pw.Config.GetLoggregatorOptions()
 	pw.Containers.EnsurePodStatus(pod)
 }
+
+// RunResync lists the running pods again every interval until ctx is done,
+// to catch up with the events the watch could have missed. Every resync
+// counts as activity for the liveness probe.
+func (pw *PodWatcher) RunResync(ctx context.Context, manager eirinix.Manager, interval time.Duration) {
+	if interval == 0 {
+		interval = config.DefaultResyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pw.resync(manager); err != nil {
+				LogError("Resync of the running pods failed: ", err.Error())
+			}
+		}
+	}
+}
+
+func (pw *PodWatcher) resync(manager eirinix.Manager) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	// In standby there is nothing to sync, and before the first sync the
+	// tails have no context to run in yet
+	if pw.Standby() || pw.Containers.Context == nil {
+		return nil
+	}
+	if _, err := pw.syncPods(pw.Containers.Context, manager); err != nil {
+		return err
+	}
+	pw.Health.Synced()
+	return nil
+}
+
+// Reload switches to a new config, see config.ConfigType.Reload for the
+// settings which can change. When the namespace or the pod selector changes,
+// the running pods are synced again: the pods which are not selected anymore
+// stop being tailed and the newly selected ones start, the other tails keep
+// running. When the namespace changes, manager is the one watching the new
+// namespace, its watch starts at the resource version of the sync.
+func (pw *PodWatcher) Reload(manager eirinix.Manager, conf config.ConfigType) error {
+	selector, err := conf.Selector()
+	if err != nil {
+		return err
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	selectorChanged := conf.PodSelector != pw.Config.PodSelector
+	namespaceChanged := conf.Namespace != pw.Config.Namespace
+	pw.Config = conf
+	pw.Containers.Selector = selector
+	if !selectorChanged && !namespaceChanged || pw.Standby() || pw.Containers.Context == nil {
+		return nil
+	}
+	startResourceVersion, err := pw.syncPods(pw.Containers.Context, manager)
+	if err != nil {
+		return err
+	}
+	pw.Health.Synced()
+
+	if namespaceChanged {
+		managerOptions := manager.GetManagerOptions()
+		managerOptions.WatcherStartRV = startResourceVersion
+		manager.SetManagerOptions(managerOptions)
+	}
+	return nil
+}
@@ -1,17 +1,50 @@
 package podwatcher_test
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
 	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
 	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/spool"
 	eirinix "code.cloudfoundry.org/eirinix"
+	eirinixcatalog "code.cloudfoundry.org/eirinix/testing"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/rest"
 )
 
+// countingSender counts the envelopes replayed from a spool
+type countingSender struct {
+	mu        sync.Mutex
+	envelopes int
+}
+
+func (c *countingSender) Send(ctx context.Context, batch []*loggregator_v2.Envelope) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.envelopes += len(batch)
+	return nil
+}
+
+func (c *countingSender) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.envelopes
+}
+
 var _ = Describe("podwatcher", func() {
 	cl := &ContainerList{}
 
@@ -28,6 +61,112 @@ var _ = Describe("podwatcher", func() {
 				Expect(pw.Config.Namespace).To(Equal("test"))
 			})
 		})
+
+		Context("when running in leader-election mode", func() {
+			It("starts in standby", func() {
+				pw := NewPodWatcher(config.ConfigType{Namespace: "test", HAMode: config.HAModeLeaderElection})
+				Expect(pw.Standby()).To(BeTrue())
+			})
+
+			It("ignores the events while in standby", func() {
+				pw := NewPodWatcher(config.ConfigType{Namespace: "test", HAMode: config.HAModeLeaderElection})
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:    types.UID("poduid"),
+						Labels: map[string]string{eirinix.LabelAppGUID: "app-guid"},
+					},
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "opi"}}},
+					Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "opi", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+					}},
+				}
+				eirinixcat := eirinixcatalog.NewCatalog()
+				pw.Handle(eirinixcat.SimpleManager(), watch.Event{Type: watch.Added, Object: pod})
+				Expect(pw.Containers.Containers).To(BeEmpty())
+			})
+
+			It("forgets the tailed containers when losing the lease", func() {
+				pw := NewPodWatcher(config.ConfigType{Namespace: "test"})
+				Expect(pw.Standby()).To(BeFalse())
+				pw.Containers.Containers["poduid-opi"] = &Container{Name: "opi", UID: "poduid-opi"}
+
+				pw.StopLeading()
+				Expect(pw.Standby()).To(BeTrue())
+				Expect(pw.Containers.Containers).To(BeEmpty())
+			})
+
+			It("tells whether it is in standby while syncing the pods as leader", func() {
+				gate := make(chan struct{})
+				var release sync.Once
+				api := newKubeAPI(3, gate)
+				defer api.Close()
+				defer release.Do(func() { close(gate) })
+				ctx, cancel := context.WithCancel(context.Background())
+				pw := NewPodWatcher(config.ConfigType{Namespace: "test", HAMode: config.HAModeLeaderElection})
+				defer func() {
+					cancel()
+					pw.Finish()
+				}()
+
+				manager := api.manager()
+				led := make(chan error, 1)
+				go func() { led <- pw.StartLeading(ctx, manager) }()
+				Eventually(api.listing).Should(Receive())
+				standby := make(chan bool, 1)
+				go func() { standby <- pw.Standby() }()
+				Eventually(standby).Should(Receive(BeTrue()))
+
+				release.Do(func() { close(gate) })
+				Eventually(led).Should(Receive(BeNil()))
+				Expect(pw.Standby()).To(BeFalse())
+				// The watch starts where the pods were listed
+				Expect(manager.GetManagerOptions().WatcherStartRV).To(Equal("1"))
+			})
+		})
+
+		Context("when the namespace is reloaded", func() {
+			It("tails the pods of the new namespace only", func() {
+				api := newKubeAPI(3, nil)
+				defer api.Close()
+				ctx, cancel := context.WithCancel(context.Background())
+				conf := config.ConfigType{Namespace: "test"}
+				pw := NewPodWatcher(conf)
+				defer func() {
+					cancel()
+					pw.Finish()
+				}()
+				Expect(pw.EnsureLogStream(ctx, api.manager())).To(Succeed())
+
+				conf.Namespace = "other"
+				next := api.manager()
+				Expect(pw.Reload(next, conf)).To(Succeed())
+				namespaces := func() []string {
+					var namespaces []string
+					for _, c := range pw.Status().Containers {
+						namespaces = append(namespaces, c.Namespace)
+					}
+					return namespaces
+				}
+				Expect(namespaces()).To(Equal([]string{"other", "other", "other"}))
+				Expect(next.GetManagerOptions().WatcherStartRV).To(Equal("1"))
+
+				// The watch of the previous namespace still runs for a while
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "app-9",
+						Namespace: "test",
+						UID:       types.UID("test-poduid-9"),
+						Labels:    map[string]string{eirinix.LabelAppGUID: "app-guid"},
+					},
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "opi"}}},
+					Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "opi", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+					}},
+				}
+				pw.Handle(api.manager(), watch.Event{Type: watch.Added, Object: pod})
+				Expect(namespaces()).To(Equal([]string{"other", "other", "other"}))
+			})
+		})
 	})
 
 	Describe("ContainerList", func() {
@@ -84,6 +223,19 @@ var _ = Describe("podwatcher", func() {
 				Expect(cont.AppMeta.SourceType).To(Equal("APP/PROC/WEB"))
 			})
 
+			It("Sets the restart count of the containers", func() {
+				pod.Status.ContainerStatuses[0].RestartCount = 2
+				Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+				cont, ok := cl.GetContainer("poduid-testcontainer")
+				Expect(ok).Should(BeTrue())
+				Expect(cont.Restarts).To(Equal(int32(2)))
+
+				// The restart was missed, the container is still tailed
+				pod.Status.ContainerStatuses[0].RestartCount = 3
+				Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+				Expect(cont.Restarts).To(Equal(int32(3)))
+			})
+
 			It("Sets the SourceType correctly when source_type is APP", func() {
 				pod.ObjectMeta.Labels[eirinix.LabelSourceType] = "APP"
 				err := cl.EnsurePodStatus(pod)
@@ -122,6 +274,57 @@ var _ = Describe("podwatcher", func() {
 				Expect(cont.AppMeta.InstanceID).To(Equal("0"))
 			})
 
+			It("Copies the selected labels into the app metadata", func() {
+				pod.ObjectMeta.Labels["team"] = "payments"
+				cl.LoggregatorOptions.PodTags = config.PodTagOptions{Labels: []string{"team"}}
+				err := cl.EnsurePodStatus(pod)
+				Expect(err).To(BeNil())
+				cont, ok := cl.GetContainer("poduid-testcontainer")
+				Expect(ok).Should(BeTrue())
+				Expect(cont.AppMeta.Tags).To(Equal(map[string]string{"team": "payments"}))
+			})
+
+			It("Sets the CF metadata of the pod", func() {
+				pod.ObjectMeta.Labels[eirinix.LabelProcessType] = "web"
+				pod.ObjectMeta.Annotations = map[string]string{LabelAppName: "ruby-app", LabelSpaceName: "dev"}
+				err := cl.EnsurePodStatus(pod)
+				Expect(err).To(BeNil())
+				cont, ok := cl.GetContainer("poduid-testcontainer")
+				Expect(ok).Should(BeTrue())
+				Expect(cont.AppMeta.CF).To(Equal(CFMetadata{AppID: "app-guid", AppName: "ruby-app", SpaceName: "dev", ProcessType: "web"}))
+			})
+
+			It("Doesn't add the excluded containers", func() {
+				cl.LoggregatorOptions.Containers = config.ContainerFilterOptions{Exclude: []string{"testinit*"}}
+				err := cl.EnsurePodStatus(pod)
+				Expect(err).To(BeNil())
+				Expect(len(cl.Containers)).Should(Equal(1))
+				_, ok := cl.GetContainer("poduid-testcontainer")
+				Expect(ok).Should(BeTrue())
+			})
+
+			It("Doesn't add any containers if the pod runs on another node", func() {
+				cl.NodeName = "node-1"
+				pod.Spec.NodeName = "node-2"
+				err := cl.EnsurePodStatus(pod)
+				Expect(err).To(BeNil())
+				Expect(len(cl.Containers)).Should(Equal(0))
+			})
+
+			It("Reads the logs from the node log directory if the pod runs on the node", func() {
+				cl.Context = context.Background()
+				cl.NodeName = "node-1"
+				cl.PodLogDir = "/var/log/pods"
+				pod.Spec.NodeName = "node-1"
+				err := cl.EnsurePodStatus(pod)
+				Expect(err).To(BeNil())
+				cont, ok := cl.GetContainer("poduid-testcontainer")
+				Expect(ok).Should(BeTrue())
+				Expect(cont.LogDir).To(Equal("/var/log/pods/_ruby-app-tmp-c6858e2e56-2_poduid/testcontainer"))
+				cl.RemoveContainer("poduid-testcontainer")
+				cl.RemoveContainer("poduid-testinitcontainer")
+			})
+
 			It("Doesn't add any containers if the guid is empty", func() {
 				delete(pod.ObjectMeta.Labels, eirinix.LabelAppGUID)
 				err := cl.EnsurePodStatus(pod)
@@ -129,6 +332,118 @@ var _ = Describe("podwatcher", func() {
 				Expect(len(cl.Containers)).Should(Equal(0))
 			})
 
+			It("Removes the containers of a pod which is not selected anymore", func() {
+				Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+				Expect(len(cl.Containers)).Should(Equal(2))
+
+				selector, err := config.ConfigType{PodSelector: eirinix.LabelSourceType + "=STG"}.Selector()
+				Expect(err).ToNot(HaveOccurred())
+				cl.Selector = selector
+				Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+				Expect(len(cl.Containers)).Should(Equal(0))
+			})
+
+			Context("when the logs are streamed from the API server", func() {
+				var (
+					dir     string
+					server  *httptest.Server
+					mu      sync.Mutex
+					streams map[string]bool
+					cancel  context.CancelFunc
+				)
+
+				// streaming returns the containers whose log stream is open
+				streaming := func() map[string]bool {
+					mu.Lock()
+					defer mu.Unlock()
+					open := map[string]bool{}
+					for container, ok := range streams {
+						if ok {
+							open[container] = true
+						}
+					}
+					return open
+				}
+
+				tailsDone := func() <-chan struct{} {
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						cl.Tails.Wait()
+					}()
+					return done
+				}
+
+				BeforeEach(func() {
+					var err error
+					dir, err = ioutil.TempDir("", "certs")
+					Expect(err).ToNot(HaveOccurred())
+					ca := newTestCA()
+					cert, key, _ := ca.issue(2, time.Now().Add(time.Hour))
+					cl.LoggregatorOptions = config.LoggregatorOptions{
+						Endpoint: "127.0.0.1:1",
+						CAPath:   filepath.Join(dir, "ca.crt"),
+						CertPath: filepath.Join(dir, "tls.crt"),
+						KeyPath:  filepath.Join(dir, "tls.key"),
+					}
+					Expect(ioutil.WriteFile(cl.LoggregatorOptions.CAPath, ca.pem, 0600)).To(Succeed())
+					Expect(ioutil.WriteFile(cl.LoggregatorOptions.CertPath, cert, 0600)).To(Succeed())
+					Expect(ioutil.WriteFile(cl.LoggregatorOptions.KeyPath, key, 0600)).To(Succeed())
+
+					streams = map[string]bool{}
+					server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						container := r.URL.Query().Get("container")
+						mu.Lock()
+						streams[container] = true
+						mu.Unlock()
+						defer func() {
+							mu.Lock()
+							defer mu.Unlock()
+							streams[container] = false
+						}()
+
+						w.WriteHeader(http.StatusOK)
+						w.(http.Flusher).Flush()
+						<-r.Context().Done()
+					}))
+					cl.KubeConfig = &rest.Config{Host: server.URL}
+					cl.Context, cancel = context.WithCancel(context.Background())
+					pod.ObjectMeta.Namespace = "eirini"
+				})
+
+				AfterEach(func() {
+					cancel()
+					Eventually(tailsDone()).Should(BeClosed())
+					server.Close()
+					os.RemoveAll(dir)
+				})
+
+				It("Stops the tails of the pods which are not selected anymore", func() {
+					Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+					Eventually(streaming).Should(Equal(map[string]bool{"testcontainer": true, "testinitcontainer": true}))
+
+					selector, err := config.ConfigType{PodSelector: eirinix.LabelSourceType + "=STG"}.Selector()
+					Expect(err).ToNot(HaveOccurred())
+					cl.Selector = selector
+					Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+					Eventually(tailsDone()).Should(BeClosed())
+					Expect(streaming()).To(BeEmpty())
+				})
+
+				It("Removes the containers excluded by a pod annotation and stops their tails", func() {
+					Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+					Expect(len(cl.Containers)).Should(Equal(2))
+					Eventually(streaming).Should(Equal(map[string]bool{"testcontainer": true, "testinitcontainer": true}))
+
+					pod.ObjectMeta.Annotations = map[string]string{AnnotationIncludeContainers: "testinitcontainer"}
+					Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+					Expect(len(cl.Containers)).Should(Equal(1))
+					_, ok := cl.GetContainer("poduid-testinitcontainer")
+					Expect(ok).Should(BeTrue())
+					Eventually(streaming).Should(Equal(map[string]bool{"testinitcontainer": true}))
+					Consistently(streaming, 200*time.Millisecond).Should(Equal(map[string]bool{"testinitcontainer": true}))
+				})
+			})
 		})
 
 		Context("when more containers for the same pod are added", func() {
@@ -387,4 +702,98 @@ var _ = Describe("podwatcher", func() {
 			})
 		})
 	})
+
+	Describe("PodWatcher Shutdown", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "shutdown")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+			// The sends to the unreachable endpoint failed, the other
+			// probe tests expect a healthy sink
+			SharedSinkHealth.Report(nil)
+		})
+
+		It("writes the envelopes still queued to the spool", func() {
+			ca := newTestCA()
+			cert, key, _ := ca.issue(2, time.Now().Add(time.Hour))
+			opts := config.LoggregatorOptions{
+				Endpoint: "127.0.0.1:1",
+				CAPath:   filepath.Join(dir, "ca.crt"),
+				CertPath: filepath.Join(dir, "tls.crt"),
+				KeyPath:  filepath.Join(dir, "tls.key"),
+				Spool:    config.SpoolOptions{Dir: filepath.Join(dir, "spool")},
+			}
+			Expect(ioutil.WriteFile(opts.CAPath, ca.pem, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(opts.CertPath, cert, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(opts.KeyPath, key, 0600)).To(Succeed())
+
+			l := NewLoggregator(nil, &LoggregatorAppMeta{SourceID: "app-guid", InstanceID: "0"}, nil, opts)
+			Expect(l.SetupLoggregatorClient()).To(Succeed())
+			for i := 0; i < 1000; i++ {
+				_, err := l.Write([]byte("line " + strconv.Itoa(i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			NewPodWatcher(config.ConfigType{Namespace: "test"}).Shutdown()
+
+			segments, err := filepath.Glob(filepath.Join(opts.Spool.Dir, "*.spool"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(segments).ToNot(BeEmpty())
+
+			replayed := &countingSender{}
+			s, err := spool.New(replayed, spool.Options{SpoolOptions: opts.Spool})
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			Eventually(replayed.count).Should(Equal(1000))
+		})
+	})
+
+	Describe("Container Read", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "read")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() { os.RemoveAll(dir) })
+
+		It("releases the rate limits when the Loggregator client can't be set up", func() {
+			ca := newTestCA()
+			cert, key, _ := ca.issue(2, time.Now().Add(time.Hour))
+			notADir := filepath.Join(dir, "file")
+			Expect(ioutil.WriteFile(notADir, nil, 0600)).To(Succeed())
+			opts := config.LoggregatorOptions{
+				Endpoint:  "127.0.0.1:1",
+				CAPath:    filepath.Join(dir, "ca.crt"),
+				CertPath:  filepath.Join(dir, "tls.crt"),
+				KeyPath:   filepath.Join(dir, "tls.key"),
+				Spool:     config.SpoolOptions{Dir: filepath.Join(notADir, "spool")},
+				RateLimit: config.RateLimitOptions{AppLinesPerSecond: 10, InstanceLinesPerSecond: 5},
+			}
+			Expect(ioutil.WriteFile(opts.CAPath, ca.pem, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(opts.CertPath, cert, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(opts.KeyPath, key, 0600)).To(Succeed())
+
+			buckets := SharedRateLimiters.Len()
+			c := &Container{
+				UID:     "failing-uid",
+				LogDir:  dir,
+				AppMeta: &LoggregatorAppMeta{SourceID: "failing-app", InstanceID: "0"},
+				Stats:   &TailStats{},
+			}
+			wg := &sync.WaitGroup{}
+			c.Read(context.Background(), opts, nil, wg)
+			wg.Wait()
+
+			Expect(c.Status().LastError).ToNot(BeEmpty())
+			Expect(SharedRateLimiters.Len()).To(Equal(buckets))
+		})
+	})
 })
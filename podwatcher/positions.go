@@ -0,0 +1,135 @@
+package podwatcher
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+)
+
+// LogPositionsSaveInterval is how often the log positions are saved to their
+// file, the lines read since the last save are sent again after a restart
+var LogPositionsSaveInterval = 5 * time.Second
+
+// logPositionHeadSize is how much of the beginning of the files is compared,
+// the first CRI timestamp tells the files apart
+const logPositionHeadSize = 64
+
+// LogPosition is how far a CRI log file was read. The inode and the first
+// bytes of the file tell whether it is still the same one: kubelet reuses the
+// names when rotating, and the inodes of the deleted files are reused.
+type LogPosition struct {
+	Inode  uint64 `json:"inode"`
+	Head   []byte `json:"head"`
+	Offset int64  `json:"offset"`
+}
+
+// LogPositions remembers how far the CRI log files were read, so that a tail
+// which is started again (the container is stopped and selected again, the
+// bridge restarts) doesn't send the lines again. The positions are saved to
+// Path when set, otherwise they are only kept in memory.
+type LogPositions struct {
+	Path string
+
+	mu        sync.Mutex
+	positions map[string]LogPosition
+	changed   bool
+}
+
+// NewLogPositions returns the LogPositions saved to path, which are loaded
+// when the file exists. An empty path keeps the positions in memory.
+func NewLogPositions(path string) (*LogPositions, error) {
+	p := &LogPositions{Path: path, positions: map[string]LogPosition{}}
+	if path == "" {
+		return p, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.positions); err != nil {
+		LogWarn("Ignoring the invalid log positions in ", path, ": ", err.Error())
+		p.positions = map[string]LogPosition{}
+	}
+	return p, nil
+}
+
+// Get returns the position of the log file
+func (p *LogPositions) Get(file string) (LogPosition, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pos, ok := p.positions[file]
+	return pos, ok
+}
+
+// Set records the position of the log file
+func (p *LogPositions) Set(file string, pos LogPosition) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.positions[file] = pos
+	p.changed = true
+}
+
+// Save writes the positions to Path, the ones of the files which don't exist
+// anymore are dropped
+func (p *LogPositions) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for file := range p.positions {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			delete(p.positions, file)
+			p.changed = true
+		}
+	}
+	if p.Path == "" || !p.changed {
+		return nil
+	}
+
+	b, err := json.Marshal(p.positions)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so that a crash never leaves a partial file
+	tmp := filepath.Join(filepath.Dir(p.Path), "."+filepath.Base(p.Path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.Path); err != nil {
+		return err
+	}
+	p.changed = false
+	return nil
+}
+
+// Run saves the positions every interval until ctx is done. The last save is
+// done by PodWatcher.Shutdown, once the tails are stopped.
+func (p *LogPositions) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Save(); err != nil {
+				LogError("Saving the log positions: ", err.Error())
+			}
+		}
+	}
+}
+
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package podwatcher_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LogPositions", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "positions")
+		Expect(err).ToNot(HaveOccurred())
+		path = filepath.Join(dir, "positions.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("loads the saved positions", func() {
+		logFile := filepath.Join(dir, "0.log")
+		appendFile(logFile, "2020-10-19T10:00:00Z stdout F first\n")
+		positions, err := NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		positions.Set(logFile, LogPosition{Inode: 1, Head: []byte("2020"), Offset: 36})
+		Expect(positions.Save()).To(Succeed())
+
+		positions, err = NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		pos, ok := positions.Get(logFile)
+		Expect(ok).To(BeTrue())
+		Expect(pos).To(Equal(LogPosition{Inode: 1, Head: []byte("2020"), Offset: 36}))
+	})
+
+	It("forgets the files which don't exist anymore", func() {
+		positions, err := NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		positions.Set(filepath.Join(dir, "removed.log"), LogPosition{Offset: 10})
+		Expect(positions.Save()).To(Succeed())
+
+		positions, err = NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		_, ok := positions.Get(filepath.Join(dir, "removed.log"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("ignores an invalid positions file", func() {
+		Expect(ioutil.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+		positions, err := NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		_, ok := positions.Get(filepath.Join(dir, "0.log"))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("are saved by the shutdown of the PodWatcher, once the tails are stopped", func() {
+		positions, err := NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		logDir := filepath.Join(dir, "opi")
+		Expect(os.Mkdir(logDir, 0755)).To(Succeed())
+		content := "2020-10-19T10:00:00Z stdout F first\n2020-10-19T10:00:00Z stdout F second\n"
+		appendFile(filepath.Join(logDir, "0.log"), content)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tailer := NewCRIFileTailer(logDir, (&criLines{}).handle)
+		tailer.Positions = positions
+		Expect(tailer.Run(ctx)).To(Succeed())
+		Expect(path).ToNot(BeAnExistingFile())
+
+		pw := NewPodWatcher(config.ConfigType{Namespace: "test"})
+		pw.Containers.Positions = positions
+		pw.Shutdown()
+
+		saved, err := NewLogPositions(path)
+		Expect(err).ToNot(HaveOccurred())
+		pos, ok := saved.Get(filepath.Join(logDir, "0.log"))
+		Expect(ok).To(BeTrue())
+		Expect(pos.Offset).To(Equal(int64(len(content))))
+	})
+})
@@ -0,0 +1,28 @@
+package podwatcher
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+)
+
+// DefaultPreflightDialTimeout bounds the TLS handshake of DialLoggregator
+const DefaultPreflightDialTimeout = 10 * time.Second
+
+// DialLoggregator checks that the Loggregator endpoint is reachable and
+// completes a TLS handshake with the configured certificates
+func DialLoggregator(opts config.LoggregatorOptions, timeout time.Duration) error {
+	tlsConfig, err := LoggregatorTLSConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", opts.Endpoint, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("TLS handshake with loggregator-endpoint %q failed (check the endpoint and that loggregator-ca-path signs its certificate): %s", opts.Endpoint, err.Error())
+	}
+	return conn.Close()
+}
@@ -0,0 +1,116 @@
+package podwatcher_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DialLoggregator", func() {
+	var (
+		dir      string
+		ca       *testCA
+		listener net.Listener
+		opts     config.LoggregatorOptions
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "preflight")
+		Expect(err).ToNot(HaveOccurred())
+
+		ca = newTestCA()
+		serverCert, serverKey, _ := ca.issue(10, time.Now().Add(time.Hour))
+		pair, err := tls.X509KeyPair(serverCert, serverKey)
+		Expect(err).ToNot(HaveOccurred())
+		clients := x509.NewCertPool()
+		clients.AddCert(ca.cert)
+
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			ClientCAs:    clients,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}(listener)
+
+		clientCert, clientKey, _ := ca.issue(11, time.Now().Add(time.Hour))
+		opts = config.LoggregatorOptions{
+			Endpoint: listener.Addr().String(),
+			CAPath:   filepath.Join(dir, "ca.crt"),
+			CertPath: filepath.Join(dir, "tls.crt"),
+			KeyPath:  filepath.Join(dir, "tls.key"),
+		}
+		Expect(ioutil.WriteFile(opts.CAPath, ca.pem, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(opts.CertPath, clientCert, 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(opts.KeyPath, clientKey, 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("succeeds when the endpoint accepts the certificates", func() {
+		Expect(DialLoggregator(opts, time.Second)).To(Succeed())
+	})
+
+	Context("when the CA doesn't sign the endpoint certificate", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(opts.CAPath, newTestCA().pem, 0600)).To(Succeed())
+		})
+
+		It("returns an error", func() {
+			err := DialLoggregator(opts, time.Second)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("TLS handshake with loggregator-endpoint"))
+		})
+	})
+
+	Context("when the endpoint certificate has a different name", func() {
+		It("succeeds with the server name override", func() {
+			opts.ServerName = "localhost"
+			Expect(DialLoggregator(opts, time.Second)).To(Succeed())
+		})
+
+		It("fails with a name missing from the certificate", func() {
+			opts.ServerName = "doppler.service.cf.internal"
+			Expect(DialLoggregator(opts, time.Second)).ToNot(Succeed())
+		})
+	})
+
+	Context("with a min TLS version", func() {
+		It("negotiates TLS 1.3", func() {
+			opts.MinTLSVersion = "1.3"
+			Expect(DialLoggregator(opts, time.Second)).To(Succeed())
+		})
+	})
+
+	Context("when the endpoint is unreachable", func() {
+		BeforeEach(func() {
+			listener.Close()
+		})
+
+		It("returns an error", func() {
+			Expect(DialLoggregator(opts, time.Second)).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,66 @@
+package podwatcher
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// Output formats of the EnvelopePrinter
+const (
+	PrintFormatText = "text"
+	PrintFormatJSON = "json"
+)
+
+// EnvelopePrinter is an Emitter writing the envelopes instead of sending them
+// to Loggregator, to see what the bridge would send
+type EnvelopePrinter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    string
+	marshaler jsonpb.Marshaler
+}
+
+// NewEnvelopePrinter returns an EnvelopePrinter writing to w in the given
+// format, one envelope per line
+func NewEnvelopePrinter(w io.Writer, format string) (*EnvelopePrinter, error) {
+	switch format {
+	case PrintFormatText, PrintFormatJSON:
+	default:
+		return nil, fmt.Errorf("invalid output format %q (allowed: %q, %q)", format, PrintFormatText, PrintFormatJSON)
+	}
+	return &EnvelopePrinter{w: w, format: format, marshaler: jsonpb.Marshaler{OrigName: true}}, nil
+}
+
+// Emit writes the envelope
+func (p *EnvelopePrinter) Emit(e *loggregator_v2.Envelope) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.format == PrintFormatJSON {
+		if err := p.marshaler.Marshal(p.w, e); err != nil {
+			fmt.Fprintf(p.w, "failed to marshal the envelope: %s\n", err.Error())
+			return
+		}
+		fmt.Fprintln(p.w)
+		return
+	}
+
+	tags := make([]string, 0, len(e.Tags))
+	for k, v := range e.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(p.w, "%s %s/%s %s [%s] %s\n",
+		time.Unix(0, e.Timestamp).UTC().Format(time.RFC3339Nano),
+		e.SourceId, e.InstanceId,
+		e.GetLog().GetType(),
+		strings.Join(tags, " "),
+		e.GetLog().GetPayload())
+}
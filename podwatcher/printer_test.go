@@ -0,0 +1,57 @@
+package podwatcher_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("EnvelopePrinter", func() {
+	var (
+		out *bytes.Buffer
+		l   *Loggregator
+	)
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		meta := &LoggregatorAppMeta{SourceID: "app-guid", InstanceID: "1", SourceType: "APP/PROC/WEB", Namespace: "eirini", PodName: "app-guid", Container: "opi"}
+		l = NewLoggregator(nil, meta, nil, config.LoggregatorOptions{})
+	})
+
+	It("prints the envelopes as text", func() {
+		printer, err := NewEnvelopePrinter(out, PrintFormatText)
+		Expect(err).ToNot(HaveOccurred())
+		l.LoggregatorClient = printer
+
+		Expect(l.Forward(strings.NewReader("hello\n"))).To(Succeed())
+		line := out.String()
+		Expect(line).To(HaveSuffix(" app-guid/1 OUT [cluster= container=opi namespace=eirini pod_name=app-guid source_type=APP/PROC/WEB] hello\n"))
+	})
+
+	It("prints the envelopes as JSON", func() {
+		printer, err := NewEnvelopePrinter(out, PrintFormatJSON)
+		Expect(err).ToNot(HaveOccurred())
+		l.LoggregatorClient = printer
+
+		Expect(l.Forward(strings.NewReader("hello\nworld\n"))).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(2))
+
+		var envelope map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &envelope)).To(Succeed())
+		Expect(envelope).To(HaveKeyWithValue("source_id", "app-guid"))
+		Expect(envelope).To(HaveKeyWithValue("instance_id", "1"))
+		Expect(envelope["tags"]).To(HaveKeyWithValue("source_type", "APP/PROC/WEB"))
+		Expect(envelope["log"]).To(HaveKeyWithValue("payload", "aGVsbG8=")) // base64 of "hello"
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := NewEnvelopePrinter(out, "yaml")
+		Expect(err).To(MatchError(ContainSubstring(`invalid output format "yaml"`)))
+	})
+})
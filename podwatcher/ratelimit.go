@@ -0,0 +1,227 @@
+package podwatcher
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Pod annotations overriding the global rate limits for an app
+const (
+	AnnotationRateLimitAppLinesPerSecond      = AnnotationPrefix + "rate-limit-app-lines-per-second"
+	AnnotationRateLimitAppBurst               = AnnotationPrefix + "rate-limit-app-burst"
+	AnnotationRateLimitInstanceLinesPerSecond = AnnotationPrefix + "rate-limit-instance-lines-per-second"
+	AnnotationRateLimitInstanceBurst          = AnnotationPrefix + "rate-limit-instance-burst"
+)
+
+// RateLimitOptionsFromAnnotations returns the rate limits of an app, the
+// annotations which are set override the global ones.
+func RateLimitOptionsFromAnnotations(global config.RateLimitOptions, annotations map[string]string) (config.RateLimitOptions, error) {
+	opts := global
+	for annotation, value := range map[string]*float64{
+		AnnotationRateLimitAppLinesPerSecond:      &opts.AppLinesPerSecond,
+		AnnotationRateLimitInstanceLinesPerSecond: &opts.InstanceLinesPerSecond,
+	} {
+		if v, ok := annotations[annotation]; ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return global, err
+			}
+			*value = f
+		}
+	}
+	for annotation, value := range map[string]*int{
+		AnnotationRateLimitAppBurst:      &opts.AppBurst,
+		AnnotationRateLimitInstanceBurst: &opts.InstanceBurst,
+	} {
+		if v, ok := annotations[annotation]; ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return global, err
+			}
+			*value = i
+		}
+	}
+
+	if err := opts.Validate(); err != nil {
+		return global, err
+	}
+	return opts, nil
+}
+
+// RateLimiters holds the token buckets shared by the tails of the same app
+// or app instance. A bucket is dropped once no tail uses it anymore.
+type RateLimiters struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	limiter *rate.Limiter
+	refs    int
+}
+
+// SharedRateLimiters are the token buckets used by all the Loggregator tails
+var SharedRateLimiters = NewRateLimiters()
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{buckets: map[string]*tokenBucket{}}
+}
+
+func (r *RateLimiters) acquire(key string, linesPerSecond float64, burst int) *rate.Limiter {
+	if linesPerSecond <= 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = int(math.Ceil(linesPerSecond))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The tails of the bucket share its limiter, which is updated in place
+	// with the limits of the latest tail
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &tokenBucket{limiter: rate.NewLimiter(rate.Limit(linesPerSecond), burst)}
+		r.buckets[key] = b
+	} else {
+		b.limiter.SetLimit(rate.Limit(linesPerSecond))
+		b.limiter.SetBurst(burst)
+	}
+	b.refs++
+	return b.limiter
+}
+
+func (r *RateLimiters) release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, ok := r.buckets[key]; ok {
+		b.refs--
+		if b.refs <= 0 {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of token buckets in use
+func (r *RateLimiters) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buckets)
+}
+
+// RateLimiter limits the log lines of a container tail with the buckets of
+// its app and app instance. The number of dropped lines is reported at most
+// once per report interval.
+type RateLimiter struct {
+	limiters            *RateLimiters
+	appKey, instanceKey string
+	app, instance       *rate.Limiter
+	reportInterval      time.Duration
+	report              func(dropped uint64)
+
+	mu          sync.Mutex
+	dropped     uint64
+	lastDropped bool
+	timer       *time.Timer
+}
+
+// NewRateLimiter returns a RateLimiter for the given app instance, report is
+// called with the number of lines dropped since the last report.
+func (r *RateLimiters) NewRateLimiter(meta *LoggregatorAppMeta, opts config.RateLimitOptions, report func(dropped uint64)) *RateLimiter {
+	rl := &RateLimiter{
+		limiters:       r,
+		appKey:         meta.SourceID,
+		instanceKey:    meta.SourceID + "/" + meta.InstanceID,
+		reportInterval: opts.ReportInterval,
+		report:         report,
+	}
+	if rl.reportInterval == 0 {
+		rl.reportInterval = config.DefaultRateLimitReportInterval
+	}
+	rl.app = r.acquire(rl.appKey, opts.AppLinesPerSecond, opts.AppBurst)
+	rl.instance = r.acquire(rl.instanceKey, opts.InstanceLinesPerSecond, opts.InstanceBurst)
+	return rl
+}
+
+// Allow returns true if a line can be sent. The continuation of a line is
+// sent only if the line itself was.
+func (rl *RateLimiter) Allow(continuation bool) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if continuation {
+		return !rl.lastDropped
+	}
+
+	// The instance bucket goes first, so that a single chatty instance
+	// doesn't consume the tokens of the whole app. Its token is given back
+	// when the app bucket denies the line.
+	now := time.Now()
+	instance, allowed := reserve(rl.instance, now)
+	if allowed {
+		if _, allowed = reserve(rl.app, now); !allowed && instance != nil {
+			instance.CancelAt(now)
+		}
+	}
+	rl.lastDropped = !allowed
+	if !allowed {
+		rl.dropped++
+		metrics.RateLimitedLines.Inc()
+		if rl.timer == nil {
+			rl.timer = time.AfterFunc(rl.reportInterval, rl.Report)
+		}
+	}
+	return allowed
+}
+
+// reserve takes a token of the limiter if one is available now, a nil limiter
+// doesn't limit
+func reserve(limiter *rate.Limiter, now time.Time) (*rate.Reservation, bool) {
+	if limiter == nil {
+		return nil, true
+	}
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return nil, false
+	}
+	if r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil, false
+	}
+	return r, true
+}
+
+// Report reports the lines dropped since the last report, if any
+func (rl *RateLimiter) Report() {
+	rl.mu.Lock()
+	dropped := rl.dropped
+	rl.dropped = 0
+	if rl.timer != nil {
+		rl.timer.Stop()
+		rl.timer = nil
+	}
+	rl.mu.Unlock()
+
+	if dropped > 0 {
+		rl.report(dropped)
+	}
+}
+
+// Close reports the pending dropped lines and releases the token buckets
+func (rl *RateLimiter) Close() {
+	rl.Report()
+	if rl.app != nil {
+		rl.limiters.release(rl.appKey)
+	}
+	if rl.instance != nil {
+		rl.limiters.release(rl.instanceKey)
+	}
+}
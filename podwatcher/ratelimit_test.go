@@ -0,0 +1,153 @@
+package podwatcher_test
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type reports struct {
+	sync.Mutex
+	dropped []uint64
+}
+
+func (r *reports) report(dropped uint64) {
+	r.Lock()
+	defer r.Unlock()
+	r.dropped = append(r.dropped, dropped)
+}
+
+func (r *reports) get() []uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return append([]uint64{}, r.dropped...)
+}
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		limiters *RateLimiters
+		r        *reports
+	)
+
+	BeforeEach(func() {
+		limiters = NewRateLimiters()
+		r = &reports{}
+	})
+
+	allowed := func(rl *RateLimiter, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if rl.Allow(false) {
+				count++
+			}
+		}
+		return count
+	}
+
+	Describe("RateLimiter", func() {
+		It("limits the lines of an instance", func() {
+			rl := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "0"}, config.RateLimitOptions{InstanceLinesPerSecond: 1, InstanceBurst: 5}, r.report)
+			defer rl.Close()
+			Expect(allowed(rl, 10)).To(Equal(5))
+		})
+
+		It("shares the app bucket among the instances", func() {
+			opts := config.RateLimitOptions{AppLinesPerSecond: 1, AppBurst: 6, InstanceLinesPerSecond: 1, InstanceBurst: 4}
+			rl0 := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "0"}, opts, r.report)
+			defer rl0.Close()
+			rl1 := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "1"}, opts, r.report)
+			defer rl1.Close()
+			other := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "other-app", InstanceID: "0"}, opts, r.report)
+			defer other.Close()
+
+			Expect(allowed(rl0, 10)).To(Equal(4))
+			Expect(allowed(rl1, 10)).To(Equal(2))
+			Expect(allowed(other, 10)).To(Equal(4))
+		})
+
+		It("updates the shared bucket with the limits of a new tail", func() {
+			rl0 := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "0"}, config.RateLimitOptions{AppLinesPerSecond: 1, AppBurst: 4}, r.report)
+			defer rl0.Close()
+			rl1 := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "1"}, config.RateLimitOptions{AppLinesPerSecond: 1, AppBurst: 2}, r.report)
+			defer rl1.Close()
+
+			Expect(allowed(rl0, 10) + allowed(rl1, 10)).To(Equal(2))
+		})
+
+		It("gives the instance token back when the app bucket denies the line", func() {
+			rl := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "0"}, config.RateLimitOptions{AppLinesPerSecond: 1, AppBurst: 2, InstanceLinesPerSecond: 1, InstanceBurst: 3}, r.report)
+			defer rl.Close()
+			Expect(allowed(rl, 10)).To(Equal(2))
+
+			// Another container of the same instance, without app limit
+			sidecar := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app", InstanceID: "0"}, config.RateLimitOptions{InstanceLinesPerSecond: 1, InstanceBurst: 3}, r.report)
+			defer sidecar.Close()
+			Expect(allowed(sidecar, 10)).To(Equal(1))
+		})
+
+		It("drops the continuation of a dropped line", func() {
+			rl := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app"}, config.RateLimitOptions{InstanceLinesPerSecond: 1}, r.report)
+			defer rl.Close()
+			Expect(rl.Allow(false)).To(BeTrue())
+			Expect(rl.Allow(true)).To(BeTrue())
+			Expect(rl.Allow(false)).To(BeFalse())
+			Expect(rl.Allow(true)).To(BeFalse())
+		})
+
+		It("reports the dropped lines periodically", func() {
+			rl := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app"}, config.RateLimitOptions{InstanceLinesPerSecond: 1, ReportInterval: 20 * time.Millisecond}, r.report)
+			defer rl.Close()
+			allowed(rl, 4)
+			Expect(r.get()).To(BeEmpty())
+			Eventually(r.get).Should(Equal([]uint64{3}))
+			allowed(rl, 2)
+			Eventually(r.get).Should(Equal([]uint64{3, 2}))
+		})
+
+		It("reports the pending dropped lines and releases the buckets when closed", func() {
+			rl := limiters.NewRateLimiter(&LoggregatorAppMeta{SourceID: "app"}, config.RateLimitOptions{AppLinesPerSecond: 1, InstanceLinesPerSecond: 1, ReportInterval: time.Hour}, r.report)
+			Expect(limiters.Len()).To(Equal(2))
+			allowed(rl, 3)
+			rl.Close()
+			Expect(r.get()).To(Equal([]uint64{2}))
+			Expect(limiters.Len()).To(Equal(0))
+		})
+	})
+
+	Describe("RateLimitOptionsFromAnnotations", func() {
+		global := config.RateLimitOptions{AppLinesPerSecond: 100, InstanceLinesPerSecond: 50}
+
+		It("overrides the global options with the annotations", func() {
+			opts, err := RateLimitOptionsFromAnnotations(global, map[string]string{
+				AnnotationRateLimitAppLinesPerSecond: "1000",
+				AnnotationRateLimitInstanceBurst:     "20",
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(Equal(config.RateLimitOptions{AppLinesPerSecond: 1000, InstanceLinesPerSecond: 50, InstanceBurst: 20}))
+		})
+
+		It("returns the global options with invalid annotations", func() {
+			opts, err := RateLimitOptionsFromAnnotations(global, map[string]string{AnnotationRateLimitAppBurst: "-1"})
+			Expect(err).To(HaveOccurred())
+			Expect(opts).To(Equal(global))
+		})
+	})
+
+	Describe("Loggregator", func() {
+		It("sends a notice with the dropped lines in the app stream", func() {
+			emitter := &fakeEmitter{}
+			l := NewLoggregator(nil, &LoggregatorAppMeta{SourceID: "rate-limited-app"}, nil, config.LoggregatorOptions{
+				RateLimit: config.RateLimitOptions{InstanceLinesPerSecond: 1, InstanceBurst: 2},
+			})
+			l.LoggregatorClient = emitter
+			Expect(l.Forward(strings.NewReader("one\ntwo\nthree\nfour\n"))).To(Succeed())
+			l.Close()
+			Expect(emitter.payloads()).To(Equal([]string{"one", "two", "2 log lines dropped due to rate limit"}))
+		})
+	})
+})
@@ -0,0 +1,126 @@
+package podwatcher
+
+import (
+	"bytes"
+	"regexp"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+)
+
+// builtinRedactions are the bundled patterns, by name. The text matched by
+// the prefix group, if any, is kept so that the redacted line still tells
+// what was there.
+var builtinRedactions = map[string][]*regexp.Regexp{
+	config.RedactBearerTokens: {
+		regexp.MustCompile(`(?i)(?P<prefix>\bbearer\s+)[A-Za-z0-9\-._~+/]+=*`),
+	},
+	config.RedactAWSKeys: {
+		regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+		regexp.MustCompile(`(?i)(?P<prefix>aws_secret_access_key["']?\s*[=:]\s*["']?)[A-Za-z0-9/+=]{40}`),
+	},
+	config.RedactEmails: {
+		regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+}
+
+// redactionLookBehind is how much of a split line is looked back at when
+// redacting its next chunk, the secrets starting further back are only
+// redacted up to the split
+const redactionLookBehind = 1024
+
+type redactionPattern struct {
+	name   string
+	re     *regexp.Regexp
+	prefix int
+}
+
+// Redactor replaces the secrets found in the log lines before they are sent
+type Redactor struct {
+	patterns    []redactionPattern
+	replacement []byte
+}
+
+// NewRedactor returns the Redactor applying the bundled patterns selected
+// by the options (all of them by default) and the operator supplied ones.
+// The options are expected to be valid.
+func NewRedactor(opts config.RedactionOptions) (*Redactor, error) {
+	r := &Redactor{replacement: []byte(opts.Replacement)}
+	if opts.Replacement == "" {
+		r.replacement = []byte(config.DefaultRedactionReplacement)
+	}
+
+	builtin := opts.Builtin
+	if len(builtin) == 0 {
+		builtin = []string{config.RedactBearerTokens, config.RedactAWSKeys, config.RedactEmails}
+	}
+	for _, name := range builtin {
+		for _, re := range builtinRedactions[name] {
+			r.add(name, re)
+		}
+	}
+	for _, pattern := range opts.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		r.add(metrics.RedactionCustom, re)
+	}
+	return r, nil
+}
+
+func (r *Redactor) add(name string, re *regexp.Regexp) {
+	p := redactionPattern{name: name, re: re}
+	for i, subexp := range re.SubexpNames() {
+		if subexp == "prefix" {
+			p.prefix = i
+		}
+	}
+	r.patterns = append(r.patterns, p)
+}
+
+// Redact returns the line with the secrets replaced. The line is returned
+// as is when nothing matched.
+func (r *Redactor) Redact(b []byte) []byte {
+	return r.RedactContinuation(nil, b)
+}
+
+// RedactContinuation redacts b, the chunk of a line read after previous. The
+// secrets are looked for in both, the part of a secret crossing them which
+// is in b is replaced: the part in previous was when previous was redacted,
+// provided that it matches on its own, as the bundled bearer tokens and
+// emails do.
+func (r *Redactor) RedactContinuation(previous, b []byte) []byte {
+	for _, p := range r.patterns {
+		text := b
+		if len(previous) > 0 {
+			text = append(append([]byte{}, previous...), b...)
+		}
+
+		var out bytes.Buffer
+		last, redacted := 0, 0
+		for _, m := range p.re.FindAllSubmatchIndex(text, -1) {
+			start, end := m[0], m[1]
+			if p.prefix > 0 && m[2*p.prefix] >= 0 {
+				start = m[2*p.prefix+1]
+			}
+			if end <= len(previous) || start == end {
+				continue
+			}
+			if start < len(previous) {
+				start = len(previous)
+			}
+			out.Write(b[last : start-len(previous)])
+			out.Write(r.replacement)
+			last = end - len(previous)
+			redacted++
+		}
+		if redacted == 0 {
+			continue
+		}
+		metrics.Redactions.WithLabelValues(p.name).Add(float64(redacted))
+		out.Write(b[last:])
+		b = out.Bytes()
+	}
+	return b
+}
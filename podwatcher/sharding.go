@@ -0,0 +1,80 @@
+package podwatcher
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultShardVirtualNodes is the number of points each shard owns on the
+// hash ring. More points give a more even spread of pods across replicas.
+const DefaultShardVirtualNodes = 128
+
+// Shard decides which pods are tailed by this replica when running in
+// sharding mode. Pods are assigned with consistent hashing on their UID,
+// so that changing the number of replicas moves as few pods as possible.
+type Shard struct {
+	Index  int
+	Count  int
+	points []uint32
+	owners map[uint32]int
+}
+
+// NewShard returns the Shard with the given index out of count shards.
+func NewShard(index, count int) (*Shard, error) {
+	if count < 1 {
+		return nil, fmt.Errorf("invalid shard count %d", count)
+	}
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("shard index %d is out of range for %d shards", index, count)
+	}
+
+	s := &Shard{Index: index, Count: count, owners: map[uint32]int{}}
+	for i := 0; i < count; i++ {
+		for v := 0; v < DefaultShardVirtualNodes; v++ {
+			p := hashKey(fmt.Sprintf("shard-%d-%d", i, v))
+			if _, ok := s.owners[p]; ok {
+				continue
+			}
+			s.owners[p] = i
+			s.points = append(s.points, p)
+		}
+	}
+	sort.Slice(s.points, func(i, j int) bool { return s.points[i] < s.points[j] })
+
+	return s, nil
+}
+
+// Owner returns the shard index responsible for the given pod UID
+func (s *Shard) Owner(podUID string) int {
+	h := hashKey(podUID)
+	i := sort.Search(len(s.points), func(i int) bool { return s.points[i] >= h })
+	if i == len(s.points) {
+		i = 0
+	}
+	return s.owners[s.points[i]]
+}
+
+// Owns returns true if the pod with the given UID belongs to this shard
+func (s *Shard) Owns(podUID string) bool {
+	return s.Owner(podUID) == s.Index
+}
+
+// ShardIndexFromHostname extracts the shard index from a StatefulSet pod
+// hostname, e.g. eirini-loggregator-bridge-2 -> 2
+func ShardIndexFromHostname(hostname string) (int, error) {
+	el := strings.Split(hostname, "-")
+	index, err := strconv.Atoi(el[len(el)-1])
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("cannot extract shard index from hostname %q", hostname)
+	}
+	return index, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,122 @@
+package podwatcher_test
+
+import (
+	"fmt"
+
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+var _ = Describe("Shard", func() {
+	podUIDs := []string{}
+	for i := 0; i < 3000; i++ {
+		podUIDs = append(podUIDs, fmt.Sprintf("6ad9f634-b32e-4890-b1ba-%012d", i))
+	}
+
+	Context("when initializing", func() {
+		It("fails with an invalid count", func() {
+			_, err := NewShard(0, 0)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("fails with an index out of range", func() {
+			_, err := NewShard(3, 3)
+			Expect(err).To(HaveOccurred())
+			_, err = NewShard(-1, 3)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when assigning pods", func() {
+		It("assigns every pod to exactly one shard", func() {
+			shards := []*Shard{}
+			for i := 0; i < 3; i++ {
+				s, err := NewShard(i, 3)
+				Expect(err).ToNot(HaveOccurred())
+				shards = append(shards, s)
+			}
+
+			counts := map[int]int{}
+			for _, uid := range podUIDs {
+				owners := 0
+				for _, s := range shards {
+					if s.Owns(uid) {
+						owners++
+						counts[s.Index]++
+					}
+				}
+				Expect(owners).To(Equal(1))
+			}
+
+			for i := 0; i < 3; i++ {
+				Expect(counts[i]).To(BeNumerically("~", len(podUIDs)/3, len(podUIDs)/6))
+			}
+		})
+
+		It("moves only a part of the pods when adding a shard", func() {
+			three, err := NewShard(0, 3)
+			Expect(err).ToNot(HaveOccurred())
+			four, err := NewShard(0, 4)
+			Expect(err).ToNot(HaveOccurred())
+
+			moved := 0
+			for _, uid := range podUIDs {
+				if three.Owner(uid) != four.Owner(uid) {
+					moved++
+				}
+			}
+			Expect(moved).To(BeNumerically("<", len(podUIDs)/2))
+		})
+	})
+
+	Context("when extracting the index from the hostname", func() {
+		It("returns the StatefulSet ordinal", func() {
+			index, err := ShardIndexFromHostname("eirini-loggregator-bridge-2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(index).To(Equal(2))
+		})
+
+		It("fails without an ordinal", func() {
+			_, err := ShardIndexFromHostname("eirini-loggregator-bridge-c6858e2e56-xdcp6")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when set on a ContainerList", func() {
+		cl := &ContainerList{}
+		BeforeEach(func() {
+			cl = &ContainerList{KubeConfig: &rest.Config{}, Containers: map[string]*Container{}}
+		})
+		AfterEach(func() { cl.Tails.Wait() })
+
+		It("only tails the pods owned by the shard", func() {
+			var err error
+			cl.Shard, err = NewShard(0, 2)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, uid := range podUIDs[:20] {
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						UID:    types.UID(uid),
+						Name:   "ruby-app-tmp-c6858e2e56-0",
+						Labels: map[string]string{eirinix.LabelAppGUID: "app-guid", eirinix.LabelSourceType: "APP"},
+					},
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "opi"}}},
+					Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "opi", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+					}},
+				}
+				Expect(cl.EnsurePodStatus(pod)).To(Succeed())
+
+				_, ok := cl.GetContainer(uid + "-opi")
+				Expect(ok).To(Equal(cl.Shard.Owns(uid)))
+			}
+		})
+	})
+})
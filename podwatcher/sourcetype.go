@@ -0,0 +1,46 @@
+package podwatcher
+
+import (
+	"strings"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	eirinix "code.cloudfoundry.org/eirinix"
+)
+
+// LabelTaskName is the pod label, or annotation, holding the name of a task.
+// The task guid is used when it is missing.
+const LabelTaskName = "cloudfoundry.org/task_name"
+
+// DefaultProcessType is the process type of the apps without the label
+const DefaultProcessType = "web"
+
+// SourceType returns the source_type of a container, from the first
+// matching rule (the config.DefaultSourceTypeRules when rules is empty). The
+// source type label is used as is when no rule matches.
+func SourceType(rules []config.SourceTypeRule, labels, annotations map[string]string, container string, init bool) string {
+	if len(rules) == 0 {
+		rules = config.DefaultSourceTypeRules
+	}
+	label := labels[eirinix.LabelSourceType]
+
+	for _, rule := range rules {
+		if !rule.Matches(label, container, init) {
+			continue
+		}
+		processType := podValue(labels, annotations, eirinix.LabelProcessType)
+		if processType == "" {
+			processType = DefaultProcessType
+		}
+		taskName := podValue(labels, annotations, LabelTaskName)
+		if taskName == "" {
+			taskName = labels[eirinix.LabelGUID]
+		}
+		return strings.NewReplacer(
+			config.SourceTypeProcessType, strings.ToUpper(processType),
+			config.SourceTypeTaskName, taskName,
+			config.SourceTypeContainer, container,
+			config.SourceTypeLabel, label,
+		).Replace(rule.Result)
+	}
+	return label
+}
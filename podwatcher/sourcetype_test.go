@@ -0,0 +1,57 @@
+package podwatcher_test
+
+import (
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SourceType", func() {
+	labels := func(sourceType string, extra ...string) map[string]string {
+		l := map[string]string{eirinix.LabelSourceType: sourceType}
+		for i := 0; i+1 < len(extra); i += 2 {
+			l[extra[i]] = extra[i+1]
+		}
+		return l
+	}
+
+	Context("with the default rules", func() {
+		It("maps the staging containers to STG", func() {
+			Expect(SourceType(nil, labels("STG"), nil, "opi-task-downloader", true)).To(Equal("STG"))
+			Expect(SourceType(nil, labels("STG"), nil, "opi-task-uploader", false)).To(Equal("STG"))
+		})
+
+		It("maps the tasks to APP/TASK/<name>", func() {
+			Expect(SourceType(nil, labels("TASK", eirinix.LabelGUID, "task-guid"), map[string]string{LabelTaskName: "migrate"}, "opi-task", false)).To(Equal("APP/TASK/migrate"))
+			Expect(SourceType(nil, labels("TASK", eirinix.LabelGUID, "task-guid"), nil, "opi-task", false)).To(Equal("APP/TASK/task-guid"))
+		})
+
+		It("maps the app processes to APP/PROC/<type>", func() {
+			Expect(SourceType(nil, labels("APP"), nil, "opi", false)).To(Equal("APP/PROC/WEB"))
+			Expect(SourceType(nil, labels("APP", eirinix.LabelProcessType, "worker"), nil, "opi", false)).To(Equal("APP/PROC/WORKER"))
+			Expect(SourceType(nil, labels("APP", eirinix.LabelProcessType, "worker"), nil, "setup", true)).To(Equal("APP/PROC/WORKER"))
+		})
+
+		It("maps the other containers of the app pods to sidecars", func() {
+			Expect(SourceType(nil, labels("APP", eirinix.LabelProcessType, "web"), nil, "envoy", false)).To(Equal("APP/PROC/WEB/SIDECAR"))
+		})
+
+		It("keeps the unknown source types", func() {
+			Expect(SourceType(nil, labels("somethingelse"), nil, "opi", false)).To(Equal("somethingelse"))
+			Expect(SourceType(nil, map[string]string{}, nil, "opi", false)).To(Equal(""))
+		})
+	})
+
+	It("applies the first matching configured rule", func() {
+		init := false
+		rules := []config.SourceTypeRule{
+			{SourceType: "APP", Container: "istio-*", Result: "MESH"},
+			{Container: "app", Init: &init, Result: "{source_type}/{container}"},
+		}
+		Expect(SourceType(rules, labels("APP"), nil, "istio-proxy", false)).To(Equal("MESH"))
+		Expect(SourceType(rules, labels("CUSTOM"), nil, "app", false)).To(Equal("CUSTOM/app"))
+		Expect(SourceType(rules, labels("CUSTOM"), nil, "app", true)).To(Equal("CUSTOM"))
+	})
+})
@@ -0,0 +1,154 @@
+package podwatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TailStats counts what a container tail sent to Loggregator. A nil
+// TailStats discards everything, so that the Loggregator can be used alone.
+type TailStats struct {
+	mu                    sync.Mutex
+	streamed              time.Time
+	lines                 uint64
+	bytes                 uint64
+	lastLine              time.Time
+	lastError             string
+	loggregatorReconnects int
+}
+
+// Started records the start of the log stream
+func (s *TailStats) Started() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamed = time.Now()
+}
+
+// Emitted records an envelope, continuation chunks only count as bytes
+func (s *TailStats) Emitted(bytes int, continuation bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !continuation {
+		s.lines++
+	}
+	s.bytes += uint64(bytes)
+	s.lastLine = time.Now()
+}
+
+// Failed records the last error of the tail
+func (s *TailStats) Failed(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+}
+
+// LoggregatorReconnected records a new connection to Loggregator, after the
+// certificates or the destination changed
+func (s *TailStats) LoggregatorReconnected() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loggregatorReconnects++
+}
+
+// ContainerStatus is what the bridge knows about a tailed container
+type ContainerStatus struct {
+	UID           string              `json:"uid"`
+	Namespace     string              `json:"namespace"`
+	PodName       string              `json:"pod"`
+	Name          string              `json:"container"`
+	InitContainer bool                `json:"init_container"`
+	AppMeta       *LoggregatorAppMeta `json:"app_meta"`
+
+	StreamStart *time.Time `json:"stream_start,omitempty"`
+	Lines       uint64     `json:"lines"`
+	Bytes       uint64     `json:"bytes"`
+	LastLine    *time.Time `json:"last_line,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	// Restarts is the restart count of the container. A restart stops the
+	// log stream, which is started again for the new run.
+	Restarts int32 `json:"restarts"`
+	// LoggregatorReconnects counts the new connections to Loggregator after
+	// a certificate rotation or a change of the destination
+	LoggregatorReconnects int `json:"loggregator_reconnects"`
+}
+
+// Status is the state of the PodWatcher served by the status endpoint
+type Status struct {
+	Standby    bool              `json:"standby"`
+	Containers []ContainerStatus `json:"containers"`
+}
+
+// Status returns the tailed containers, sorted by UID
+func (pw *PodWatcher) Status() Status {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	status := Status{Standby: pw.Standby(), Containers: []ContainerStatus{}}
+	for _, c := range pw.Containers.Containers {
+		status.Containers = append(status.Containers, c.Status())
+	}
+	sort.Slice(status.Containers, func(i, j int) bool {
+		return status.Containers[i].UID < status.Containers[j].UID
+	})
+	return status
+}
+
+// Status returns the state of the container tail
+func (c *Container) Status() ContainerStatus {
+	status := ContainerStatus{
+		UID:           c.UID,
+		Namespace:     c.Namespace,
+		PodName:       c.PodName,
+		Name:          c.Name,
+		InitContainer: c.InitContainer,
+		AppMeta:       c.AppMeta.snapshot(),
+		Restarts:      c.Restarts,
+	}
+	if c.Stats == nil {
+		return status
+	}
+
+	c.Stats.mu.Lock()
+	defer c.Stats.mu.Unlock()
+	if !c.Stats.streamed.IsZero() {
+		streamed := c.Stats.streamed
+		status.StreamStart = &streamed
+	}
+	if !c.Stats.lastLine.IsZero() {
+		lastLine := c.Stats.lastLine
+		status.LastLine = &lastLine
+	}
+	status.Lines = c.Stats.lines
+	status.Bytes = c.Stats.bytes
+	status.LastError = c.Stats.lastError
+	status.LoggregatorReconnects = c.Stats.loggregatorReconnects
+	return status
+}
+
+// StatusHandler serves the Status as JSON, it is read-only
+func (pw *PodWatcher) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pw.Status())
+	})
+}
@@ -0,0 +1,170 @@
+package podwatcher_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	config "code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/podwatcher"
+	eirinix "code.cloudfoundry.org/eirinix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// kubeAPI serves the same running Eirini pods in every namespace, their UIDs
+// are prefixed by the namespace. When gate is set, the pod lists are announced
+// on listing and wait for gate to be closed.
+type kubeAPI struct {
+	*httptest.Server
+	listing chan struct{}
+	gate    chan struct{}
+}
+
+func newKubeAPI(pods int, gate chan struct{}) *kubeAPI {
+	api := &kubeAPI{listing: make(chan struct{}, 16), gate: gate}
+	api.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(r.URL.Path, "/")
+		if len(path) != 6 || path[3] != "namespaces" || path[5] != "pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if api.gate != nil {
+			api.listing <- struct{}{}
+			<-api.gate
+		}
+		namespace := path[4]
+		list := &corev1.PodList{
+			TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+			ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		}
+		for i := 0; i < pods; i++ {
+			list.Items = append(list.Items, corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      fmt.Sprintf("app-%d", i),
+					Namespace: namespace,
+					UID:       types.UID(fmt.Sprintf("%s-poduid-%d", namespace, i)),
+					Labels:    map[string]string{eirinix.LabelAppGUID: "app-guid"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "opi"}}},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+					{Name: "opi", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+				}},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}))
+	return api
+}
+
+// manager returns an eirinix manager connected to the API
+func (api *kubeAPI) manager() eirinix.Manager {
+	m := eirinix.NewManager(eirinix.ManagerOptions{Namespace: "test"})
+	m.(*eirinix.DefaultExtensionManager).SetKubeConnection(&rest.Config{Host: api.URL})
+	return m
+}
+
+var _ = Describe("Status", func() {
+	var (
+		pw    *PodWatcher
+		stats *TailStats
+	)
+
+	BeforeEach(func() {
+		pw = NewPodWatcher(config.ConfigType{Namespace: "test"})
+		stats = &TailStats{}
+		meta := &LoggregatorAppMeta{SourceID: "app-guid", InstanceID: "0", Namespace: "test", PodName: "app-0", Container: "opi"}
+		pw.Containers.Containers["poduid-opi"] = &Container{
+			UID: "poduid-opi", Namespace: "test", PodName: "app-0", Name: "opi", AppMeta: meta, Stats: stats, Restarts: 3,
+		}
+		pw.Containers.Containers["poduid-init"] = &Container{
+			UID: "poduid-init", Namespace: "test", PodName: "app-0", Name: "init", InitContainer: true,
+		}
+	})
+
+	It("reports what the tails sent", func() {
+		l := NewLoggregator(nil, pw.Containers.Containers["poduid-opi"].AppMeta, nil, config.LoggregatorOptions{MaxLineSize: 8})
+		l.LoggregatorClient = &fakeEmitter{}
+		l.Stats = stats
+		stats.Started()
+		Expect(l.Forward(strings.NewReader("hello\na-line-split-in-chunks\n"))).To(Succeed())
+		stats.Failed(errors.New("stream closed"))
+		stats.LoggregatorReconnected()
+
+		status := pw.Status()
+		Expect(status.Standby).To(BeFalse())
+		Expect(status.Containers).To(HaveLen(2))
+
+		initContainer := status.Containers[0]
+		Expect(initContainer.Name).To(Equal("init"))
+		Expect(initContainer.InitContainer).To(BeTrue())
+		Expect(initContainer.StreamStart).To(BeNil())
+		Expect(initContainer.Lines).To(BeZero())
+
+		opi := status.Containers[1]
+		Expect(opi.AppMeta.SourceID).To(Equal("app-guid"))
+		Expect(opi.StreamStart).ToNot(BeNil())
+		Expect(opi.Lines).To(Equal(uint64(2)))
+		Expect(opi.Bytes).To(Equal(uint64(len("hello") + len("a-line-split-in-chunks"))))
+		Expect(opi.LastLine).ToNot(BeNil())
+		Expect(opi.LastError).To(Equal("stream closed"))
+		Expect(opi.Restarts).To(Equal(int32(3)))
+		Expect(opi.LoggregatorReconnects).To(Equal(1))
+	})
+
+	It("serves the status as JSON", func() {
+		rec := httptest.NewRecorder()
+		pw.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var status Status
+		Expect(json.NewDecoder(rec.Body).Decode(&status)).To(Succeed())
+		Expect(status.Containers).To(HaveLen(2))
+		Expect(status.Containers[1].PodName).To(Equal("app-0"))
+	})
+
+	It("can be read while the running pods are synced", func() {
+		api := newKubeAPI(50, nil)
+		defer api.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer func() {
+			cancel()
+			pw.Finish()
+		}()
+
+		synced := make(chan struct{})
+		polled := make(chan struct{})
+		go func() {
+			defer close(polled)
+			for {
+				select {
+				case <-synced:
+					return
+				default:
+					pw.Status()
+				}
+			}
+		}()
+		err := pw.EnsureLogStream(ctx, api.manager())
+		close(synced)
+		<-polled
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pw.Status().Containers).To(HaveLen(50))
+	})
+
+	It("is read-only", func() {
+		rec := httptest.NewRecorder()
+		pw.StatusHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/status", nil))
+		Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
@@ -0,0 +1,147 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	"github.com/golang/protobuf/proto"
+)
+
+// Every record of a segment file holds a batch of envelopes, it starts with a
+// header made of the batch size in bytes, the number of envelopes and the
+// time it was spooled (unix nanoseconds).
+const (
+	segmentExt = ".spool"
+	headerSize = 16
+	// maxRecordSize bounds the batches, made of envelopes of at most
+	// max-line-size (see config.MaxBatchBytes). A bigger size read from a
+	// header can only come from a corrupt segment.
+	maxRecordSize = 64 * 1024 * 1024
+)
+
+var errCorruptRecord = errors.New("corrupt spool record")
+
+// segment is a spool file. Envelopes are appended to the newest segment and
+// replayed from the oldest one, which is removed once fully replayed.
+type segment struct {
+	path string
+	// size is the size of the file, envelopes the number of the envelopes
+	// still to replay
+	size      int64
+	envelopes int
+	// oldest and newest are the spool times of the first envelopes still to
+	// replay and of the last spooled ones
+	oldest, newest time.Time
+}
+
+type record struct {
+	spooled   time.Time
+	envelopes []*loggregator_v2.Envelope
+}
+
+func segmentPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func writeRecord(w io.Writer, batch []*loggregator_v2.Envelope, spooled time.Time) (int64, error) {
+	body, err := proto.Marshal(&loggregator_v2.EnvelopeBatch{Batch: batch})
+	if err != nil {
+		return 0, err
+	}
+	if len(body) > maxRecordSize {
+		return 0, fmt.Errorf("the batch of %d bytes exceeds the max record size", len(body))
+	}
+
+	buf := make([]byte, headerSize, headerSize+len(body))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(batch)))
+	binary.BigEndian.PutUint64(buf[8:], uint64(spooled.UnixNano()))
+	buf = append(buf, body...)
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func readHeader(r io.Reader) (size, envelopes int, spooled time.Time, err error) {
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	size = int(binary.BigEndian.Uint32(header[0:]))
+	envelopes = int(binary.BigEndian.Uint32(header[4:]))
+	spooled = time.Unix(0, int64(binary.BigEndian.Uint64(header[8:])))
+	return
+}
+
+// readRecord reads the next record, it returns io.EOF at the end of the
+// segment and errCorruptRecord if the record is incomplete or too big.
+func readRecord(r io.Reader) (*record, error) {
+	size, _, spooled, err := readHeader(r)
+	if err == io.ErrUnexpectedEOF {
+		return nil, errCorruptRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("%w: record of %d bytes", errCorruptRecord, size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errCorruptRecord
+	}
+	batch := &loggregator_v2.EnvelopeBatch{}
+	if err := proto.Unmarshal(body, batch); err != nil {
+		return nil, errCorruptRecord
+	}
+	return &record{spooled: spooled, envelopes: batch.Batch}, nil
+}
+
+// scanSegment reads the headers of an existing segment file. An incomplete
+// record at the end of the file (e.g. the bridge was killed while writing
+// it) is ignored. A record too big returns errCorruptRecord, together with
+// the segment made of the records before it.
+func scanSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{path: path, size: info.Size()}
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		size, envelopes, spooled, err := readHeader(r)
+		if err != nil {
+			break
+		}
+		if size > maxRecordSize {
+			seg.size = offset
+			return seg, fmt.Errorf("%w: record of %d bytes at offset %d", errCorruptRecord, size, offset)
+		}
+		if _, err := r.Discard(size); err != nil {
+			break
+		}
+		offset += int64(headerSize + size)
+		if seg.envelopes == 0 {
+			seg.oldest = spooled
+		}
+		seg.envelopes += envelopes
+		seg.newest = spooled
+	}
+	return seg, nil
+}
@@ -0,0 +1,511 @@
+// Package spool implements an on-disk write-ahead spool in front of the
+// Loggregator ingress. Envelopes are sent in batches as long as Loggregator is
+// reachable. When a batch can't be sent, it is written to disk together with
+// all the following ones, until the spool is replayed in order once
+// Loggregator is reachable again.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/logger"
+	"code.cloudfoundry.org/eirini-loggregator-bridge/metrics"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+)
+
+// Defaults of the spool Options
+const (
+	DefaultSegmentSize   = 4 * 1024 * 1024
+	DefaultBatchMaxSize  = 100
+	DefaultFlushInterval = time.Second
+	DefaultRetryInterval = 5 * time.Second
+	DefaultSendTimeout   = 10 * time.Second
+)
+
+var log = logger.Named("spool")
+
+// replayBatches is the max number of batches replayed in a row, so that
+// the new envelopes are not blocked for too long by a big spool
+const replayBatches = 100
+
+// Sender sends a batch of envelopes, returning an error if they were not
+// received
+type Sender interface {
+	Send(ctx context.Context, batch []*loggregator_v2.Envelope) error
+}
+
+// IngressSender sends the envelopes with the Loggregator ingress Send RPC
+type IngressSender struct {
+	Client loggregator_v2.IngressClient
+}
+
+func (s IngressSender) Send(ctx context.Context, batch []*loggregator_v2.Envelope) error {
+	_, err := s.Client.Send(ctx, &loggregator_v2.EnvelopeBatch{Batch: batch})
+	return err
+}
+
+type Options struct {
+	config.SpoolOptions
+
+	// SegmentSize is the size at which a new spool file is started
+	SegmentSize int64
+	// Envelopes are sent once BatchMaxSize are queued, or every FlushInterval
+	BatchMaxSize  int
+	FlushInterval time.Duration
+	// RetryInterval is how often the replay is attempted while Loggregator
+	// is unreachable
+	RetryInterval time.Duration
+	SendTimeout   time.Duration
+	// OnSend, when set, is called with the outcome of every send
+	OnSend func(error)
+}
+
+// Spool sends the envelopes to Loggregator, spooling them on disk while
+// Loggregator is unreachable. It must be closed to persist the envelopes
+// which are still queued.
+type Spool struct {
+	opts      Options
+	envelopes chan *loggregator_v2.Envelope
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// The following fields are owned by the run goroutine
+	segments []*segment
+	nextSeq  uint64
+	writer   *os.File
+	reader   *bufio.Reader
+	readFile *os.File
+	pending  *record
+	spooling bool
+
+	mu        sync.Mutex
+	sender    Sender
+	depth     int
+	size      int64
+	oldestAge time.Duration
+}
+
+// New returns a Spool sending the envelopes with sender. The envelopes left
+// in the spool directory by a previous run are replayed first.
+func New(sender Sender, opts Options) (*Spool, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = config.DefaultSpoolMaxSize
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = config.DefaultSpoolMaxAge
+	}
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	// Keep a few segments within the max size, so that dropping the oldest
+	// one doesn't empty the whole spool
+	if opts.SegmentSize > opts.MaxSize/4 {
+		opts.SegmentSize = opts.MaxSize / 4
+	}
+	if opts.SegmentSize < 1 {
+		opts.SegmentSize = 1
+	}
+	if opts.BatchMaxSize == 0 {
+		opts.BatchMaxSize = DefaultBatchMaxSize
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	if opts.SendTimeout == 0 {
+		opts.SendTimeout = DefaultSendTimeout
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Spool{
+		sender:    sender,
+		opts:      opts,
+		envelopes: make(chan *loggregator_v2.Envelope, opts.BatchMaxSize),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	if len(s.segments) > 0 {
+		s.spooling = true
+		log.Info("Replaying ", s.depth, " spooled envelopes from ", opts.Dir)
+	}
+
+	go s.run()
+	return s, nil
+}
+
+// load picks up the segments of a previous run, ordered by sequence number
+func (s *Spool) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.opts.Dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.nextSeq = seq + 1
+
+		seg, err := scanSegment(path)
+		if errors.Is(err, errCorruptRecord) {
+			// Keep the records before the corrupt one
+			log.Error("Dropping the end of ", path, ": ", err.Error())
+			if err := os.Truncate(path, seg.size); err != nil {
+				log.Error("Skipping ", path, ": ", err.Error())
+				os.Remove(path)
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+		if seg.envelopes == 0 {
+			os.Remove(path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+	}
+	s.updateStats()
+	return nil
+}
+
+// Emit queues an envelope, it blocks while the queue is full
+func (s *Spool) Emit(e *loggregator_v2.Envelope) {
+	select {
+	case s.envelopes <- e:
+	case <-s.done:
+	}
+}
+
+// Close sends or spools the queued envelopes and waits for the spool to be
+// written
+func (s *Spool) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Depth returns the number of envelopes waiting in the spool and the disk
+// space it uses
+func (s *Spool) Depth() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth, s.size
+}
+
+// OldestAge returns the age of the oldest envelope waiting in the spool
+func (s *Spool) OldestAge() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.oldestAge
+}
+
+func (s *Spool) run() {
+	defer close(s.done)
+	defer s.closeFiles()
+
+	flush := time.NewTicker(s.opts.FlushInterval)
+	defer flush.Stop()
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	batch := []*loggregator_v2.Envelope{}
+	for {
+		select {
+		case e := <-s.envelopes:
+			batch = append(batch, e)
+			if len(batch) >= s.opts.BatchMaxSize {
+				s.flush(batch)
+				batch = []*loggregator_v2.Envelope{}
+			}
+		case <-flush.C:
+			if len(batch) > 0 {
+				s.flush(batch)
+				batch = []*loggregator_v2.Envelope{}
+			}
+		case <-retry.C:
+			replayed := s.replay()
+			s.enforceLimits(time.Now())
+			s.updateStats()
+			s.report()
+			// Keep replaying as long as Loggregator accepts the envelopes
+			if replayed && len(s.segments) > 0 {
+				retry.Reset(0)
+			} else {
+				retry.Reset(s.opts.RetryInterval)
+			}
+		case <-s.ctx.Done():
+		drain:
+			for {
+				select {
+				case e := <-s.envelopes:
+					batch = append(batch, e)
+				default:
+					break drain
+				}
+			}
+			if len(batch) > 0 {
+				s.flush(batch)
+			}
+			return
+		}
+	}
+}
+
+func (s *Spool) send(batch []*loggregator_v2.Envelope) error {
+	parent := s.ctx
+	if parent.Err() != nil {
+		// Still try to send the last envelopes while closing
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, s.opts.SendTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	sender := s.sender
+	s.mu.Unlock()
+	err := sender.Send(ctx, batch)
+	if s.opts.OnSend != nil {
+		s.opts.OnSend(err)
+	}
+	return err
+}
+
+// SetSender replaces the sender, e.g. to reconnect with new certificates. A
+// batch failing with the previous sender is spooled and replayed.
+func (s *Spool) SetSender(sender Sender) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sender = sender
+}
+
+// flush sends the batch, or spools it if Loggregator is unreachable. Once
+// something is spooled, new batches are spooled as well until the spool is
+// replayed, to keep the envelopes in order.
+func (s *Spool) flush(batch []*loggregator_v2.Envelope) {
+	if len(s.segments) == 0 {
+		err := s.send(batch)
+		if err == nil {
+			return
+		}
+		log.Warn("Loggregator unreachable, spooling envelopes in ", s.opts.Dir, ": ", err.Error())
+		s.spooling = true
+	}
+
+	if err := s.append(batch); err != nil {
+		log.Error("Dropping ", len(batch), " envelopes, failed spooling them: ", err.Error())
+		metrics.SpoolDroppedEnvelopes.Add(float64(len(batch)))
+	}
+	s.enforceLimits(time.Now())
+	s.updateStats()
+}
+
+// append writes the batch to the newest segment, starting a new one if needed
+func (s *Spool) append(batch []*loggregator_v2.Envelope) error {
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	now := time.Now()
+	n, err := writeRecord(s.writer, batch, now)
+	seg.size += n
+	if err != nil {
+		return err
+	}
+	if seg.envelopes == 0 {
+		seg.oldest = now
+	}
+	seg.envelopes += len(batch)
+	seg.newest = now
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	path := segmentPath(s.opts.Dir, s.nextSeq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.nextSeq++
+	s.writer = f
+	s.segments = append(s.segments, &segment{path: path})
+	return nil
+}
+
+// replay sends the spooled batches in order. It returns false if
+// Loggregator is still unreachable.
+func (s *Spool) replay() bool {
+	for i := 0; i < replayBatches && len(s.segments) > 0; i++ {
+		rec, err := s.next()
+		if err == io.EOF {
+			// Batches are written by this goroutine only, so nothing is
+			// appended to a segment after its end was read
+			s.removeOldest()
+			continue
+		}
+		if err != nil {
+			log.Error("Dropping the rest of ", s.segments[0].path, ": ", err.Error())
+			s.dropOldest()
+			continue
+		}
+
+		if time.Since(rec.spooled) > s.opts.MaxAge {
+			metrics.SpoolDroppedEnvelopes.Add(float64(len(rec.envelopes)))
+			s.consume(rec)
+			continue
+		}
+		if err := s.send(rec.envelopes); err != nil {
+			log.Debug("Loggregator still unreachable: ", err.Error())
+			return false
+		}
+		s.consume(rec)
+	}
+
+	if s.spooling && len(s.segments) == 0 {
+		log.Info("Loggregator reachable again, the spool is replayed")
+		s.spooling = false
+	}
+	return true
+}
+
+// next returns the oldest record which is still to replay
+func (s *Spool) next() (*record, error) {
+	if s.pending != nil {
+		return s.pending, nil
+	}
+	if s.reader == nil {
+		f, err := os.Open(s.segments[0].path)
+		if err != nil {
+			return nil, err
+		}
+		s.readFile = f
+		s.reader = bufio.NewReader(f)
+	}
+
+	rec, err := readRecord(s.reader)
+	if err != nil {
+		return nil, err
+	}
+	s.pending = rec
+	return rec, nil
+}
+
+func (s *Spool) consume(rec *record) {
+	seg := s.segments[0]
+	seg.envelopes -= len(rec.envelopes)
+	seg.oldest = rec.spooled
+	s.pending = nil
+}
+
+// enforceLimits drops the oldest segments while the spool exceeds its max
+// size or they only hold expired envelopes
+func (s *Spool) enforceLimits(now time.Time) {
+	for len(s.segments) > 0 {
+		oldest := s.segments[0]
+		expired := now.Sub(oldest.newest) > s.opts.MaxAge
+		full := s.totalSize() > s.opts.MaxSize
+		if !expired && !full {
+			return
+		}
+		if oldest.envelopes > 0 {
+			log.Warn("Dropping ", oldest.envelopes, " spooled envelopes, the spool exceeds its max-size or max-age")
+		}
+		s.dropOldest()
+	}
+}
+
+func (s *Spool) totalSize() int64 {
+	size := int64(0)
+	for _, seg := range s.segments {
+		size += seg.size
+	}
+	return size
+}
+
+func (s *Spool) dropOldest() {
+	metrics.SpoolDroppedEnvelopes.Add(float64(s.segments[0].envelopes))
+	s.removeOldest()
+}
+
+func (s *Spool) removeOldest() {
+	if s.readFile != nil {
+		s.readFile.Close()
+		s.readFile, s.reader, s.pending = nil, nil, nil
+	}
+	if s.writer != nil && len(s.segments) == 1 {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if err := os.Remove(s.segments[0].path); err != nil && !os.IsNotExist(err) {
+		log.Error("Failed removing spool segment: ", err.Error())
+	}
+	s.segments = s.segments[1:]
+}
+
+func (s *Spool) closeFiles() {
+	if s.readFile != nil {
+		s.readFile.Close()
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+}
+
+func (s *Spool) updateStats() {
+	depth := 0
+	for _, seg := range s.segments {
+		depth += seg.envelopes
+	}
+	oldestAge := time.Duration(0)
+	if depth > 0 {
+		oldestAge = time.Since(s.segments[0].oldest)
+	}
+	size := s.totalSize()
+
+	s.mu.Lock()
+	s.depth, s.size, s.oldestAge = depth, size, oldestAge
+	s.mu.Unlock()
+
+	metrics.SpoolEnvelopes.Set(float64(depth))
+	metrics.SpoolBytes.Set(float64(size))
+	metrics.SpoolOldestEnvelopeAge.Set(oldestAge.Seconds())
+}
+
+func (s *Spool) report() {
+	if !s.spooling {
+		return
+	}
+	depth, size := s.Depth()
+	log.Warn("Spooled envelopes: ", depth, " (", size, " bytes), oldest: ", s.OldestAge().Round(time.Second))
+}
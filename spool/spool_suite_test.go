@@ -0,0 +1,13 @@
+package spool_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSpool(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Spool test Suite")
+}
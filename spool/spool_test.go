@@ -0,0 +1,211 @@
+package spool_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/eirini-loggregator-bridge/config"
+	. "code.cloudfoundry.org/eirini-loggregator-bridge/spool"
+	"code.cloudfoundry.org/go-loggregator/v8/rpc/loggregator_v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeSender struct {
+	mu          sync.Mutex
+	unreachable bool
+	sent        []string
+}
+
+func (f *fakeSender) Send(ctx context.Context, batch []*loggregator_v2.Envelope) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unreachable {
+		return errors.New("connection refused")
+	}
+	for _, e := range batch {
+		f.sent = append(f.sent, string(e.GetLog().Payload))
+	}
+	return nil
+}
+
+func (f *fakeSender) setUnreachable(unreachable bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unreachable = unreachable
+}
+
+func (f *fakeSender) payloads() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.sent...)
+}
+
+func envelope(payload string) *loggregator_v2.Envelope {
+	return &loggregator_v2.Envelope{
+		SourceId: "app",
+		Message: &loggregator_v2.Envelope_Log{
+			Log: &loggregator_v2.Log{Payload: []byte(payload)},
+		},
+	}
+}
+
+func emitRange(s *Spool, from, to int) []string {
+	payloads := []string{}
+	for i := from; i < to; i++ {
+		payloads = append(payloads, strconv.Itoa(i))
+		s.Emit(envelope(strconv.Itoa(i)))
+	}
+	return payloads
+}
+
+func segments(dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	Expect(err).ToNot(HaveOccurred())
+	return paths
+}
+
+var _ = Describe("Spool", func() {
+	var (
+		dir    string
+		sender *fakeSender
+		opts   Options
+		s      *Spool
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "spool")
+		Expect(err).ToNot(HaveOccurred())
+		sender = &fakeSender{}
+		opts = Options{
+			SpoolOptions:  config.SpoolOptions{Dir: dir},
+			BatchMaxSize:  10,
+			FlushInterval: 10 * time.Millisecond,
+			RetryInterval: 20 * time.Millisecond,
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		s, err = New(sender, opts)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("when Loggregator is reachable", func() {
+		It("sends the envelopes without spooling them", func() {
+			payloads := emitRange(s, 0, 25)
+			Eventually(sender.payloads).Should(Equal(payloads))
+			Expect(segments(dir)).To(BeEmpty())
+			Expect(s.Depth()).To(BeZero())
+		})
+	})
+
+	Context("when Loggregator is unreachable", func() {
+		BeforeEach(func() {
+			sender.setUnreachable(true)
+		})
+
+		It("spools the envelopes and replays them in order once reachable", func() {
+			payloads := emitRange(s, 0, 30)
+			Eventually(func() int {
+				depth, _ := s.Depth()
+				return depth
+			}).Should(Equal(30))
+			Expect(segments(dir)).ToNot(BeEmpty())
+			Eventually(s.OldestAge).Should(BeNumerically(">", 0))
+
+			sender.setUnreachable(false)
+			// Envelopes emitted while replaying come after the spooled ones
+			payloads = append(payloads, emitRange(s, 30, 40)...)
+
+			Eventually(sender.payloads).Should(Equal(payloads))
+			Eventually(func() []string { return segments(dir) }).Should(BeEmpty())
+			Expect(s.Depth()).To(BeZero())
+		})
+
+		It("replays the spool left by a previous run", func() {
+			payloads := emitRange(s, 0, 15)
+			s.Close()
+			Expect(segments(dir)).ToNot(BeEmpty())
+
+			sender.setUnreachable(false)
+			var err error
+			s, err = New(sender, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(sender.payloads).Should(Equal(payloads))
+		})
+
+		It("replays the records of a segment before a record too big, as it is corrupt", func() {
+			payloads := emitRange(s, 0, 15)
+			s.Close()
+			spooled := segments(dir)
+			Expect(spooled).To(HaveLen(1))
+			header := make([]byte, 16)
+			binary.BigEndian.PutUint32(header[0:], 1<<31)
+			binary.BigEndian.PutUint32(header[4:], 1)
+			binary.BigEndian.PutUint64(header[8:], uint64(time.Now().UnixNano()))
+			f, err := os.OpenFile(spooled[0], os.O_APPEND|os.O_WRONLY, 0600)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = f.Write(append(header, "garbage"...))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			sender.setUnreachable(false)
+			s, err = New(sender, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(sender.payloads).Should(Equal(payloads))
+			Eventually(func() []string { return segments(dir) }).Should(BeEmpty())
+		})
+
+		Context("when the spool exceeds its max size", func() {
+			BeforeEach(func() {
+				opts.MaxSize = 4096
+				opts.BatchMaxSize = 1
+			})
+
+			It("drops the oldest envelopes", func() {
+				emitRange(s, 0, 500)
+				Eventually(func() int64 {
+					_, size := s.Depth()
+					return size
+				}).Should(And(BeNumerically(">", 0), BeNumerically("<=", 4096)))
+
+				sender.setUnreachable(false)
+				Eventually(func() []string { return segments(dir) }).Should(BeEmpty())
+				sent := sender.payloads()
+				Expect(sent).ToNot(BeEmpty())
+				Expect(len(sent)).To(BeNumerically("<", 500))
+				Expect(sent[len(sent)-1]).To(Equal("499"))
+			})
+		})
+
+		Context("when the spooled envelopes exceed their max age", func() {
+			BeforeEach(func() {
+				opts.MaxAge = 50 * time.Millisecond
+			})
+
+			It("drops them", func() {
+				emitRange(s, 0, 20)
+				Eventually(func() []string { return segments(dir) }).ShouldNot(BeEmpty())
+				Eventually(func() []string { return segments(dir) }).Should(BeEmpty())
+
+				sender.setUnreachable(false)
+				payloads := emitRange(s, 20, 25)
+				Eventually(sender.payloads).Should(Equal(payloads))
+			})
+		})
+	})
+})